@@ -28,6 +28,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 var (
@@ -35,6 +37,9 @@ var (
 	RootURL = "https://apiban.org/api/"
 )
 
+// defaultClient is used by the package-level Banned and Check functions
+var defaultClient = &Client{HTTPClient: http.DefaultClient}
+
 // ErrBadRequest indicates a 400 response was received;
 //
 // NOTE: this is used by the server to indicate both that an IP address is not
@@ -52,10 +57,68 @@ type Entry struct {
 	IPs []string `json:"ipaddress"`
 }
 
+// Client is an APIBAN.org API client.  A Client keeps its HTTP connections
+// alive between calls, so long-running programs should create one and reuse
+// it.
+type Client struct {
+
+	// HTTPClient is the client used to talk to the server
+	HTTPClient *http.Client
+
+	// RootURL overrides the package RootURL when set
+	RootURL string
+
+	// Observe, if set, is called after every request to the server
+	Observe func(RequestInfo)
+}
+
+// RequestInfo describes a single request to the server, for instrumentation
+type RequestInfo struct {
+
+	// Kind is the type of request: "banned" or "check"
+	Kind string
+
+	// Duration is the time taken by the request
+	Duration time.Duration
+
+	// StatusCode is the HTTP status of the response, or 0 if none was
+	// received
+	StatusCode int
+
+	// Err is the error returned for the request, if any
+	Err error
+}
+
+// NewClient returns a Client with the given request timeout
+func NewClient(timeout time.Duration) *Client {
+	return &Client{
+		HTTPClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *Client) rootURL() string {
+	if c.RootURL != "" {
+		return c.RootURL
+	}
+	return RootURL
+}
+
 // Banned returns a set of banned addresses, optionally limited to the
 // specified startFrom ID.  If no startFrom is supplied, the entire current list will
 // be pulled.
 func Banned(key string, startFrom string) (*Entry, error) {
+	return defaultClient.Banned(key, startFrom)
+}
+
+// Check queries APIBAN.org to see if the provided IP address is blocked.
+func Check(key string, ip string) (bool, error) {
+	return defaultClient.Check(key, ip)
+}
+
+// Banned returns a set of banned addresses, optionally limited to the
+// specified startFrom ID.  If no startFrom is supplied, the entire current list will
+// be pulled.
+func (c *Client) Banned(key string, startFrom string) (*Entry, error) {
 	if key == "" {
 		return nil, errors.New("API Key is required")
 	}
@@ -69,7 +132,7 @@ func Banned(key string, startFrom string) (*Entry, error) {
 	}
 
 	for {
-		e, err := queryServer(http.DefaultClient, fmt.Sprintf("%s%s/banned/%s", RootURL, key, out.ID))
+		e, err := c.query("banned", key, "/banned/"+out.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -91,7 +154,7 @@ func Banned(key string, startFrom string) (*Entry, error) {
 }
 
 // Check queries APIBAN.org to see if the provided IP address is blocked.
-func Check(key string, ip string) (bool, error) {
+func (c *Client) Check(key string, ip string) (bool, error) {
 	if key == "" {
 		return false, errors.New("API Key is required")
 	}
@@ -99,7 +162,7 @@ func Check(key string, ip string) (bool, error) {
 		return false, errors.New("IP address is required")
 	}
 
-	entry, err := queryServer(http.DefaultClient, fmt.Sprintf("%s%s/check/%s", RootURL, key, ip))
+	entry, err := c.query("check", key, "/check/"+ip)
 	if err == ErrBadRequest {
 		// Not blocked
 		return false, nil
@@ -120,13 +183,41 @@ func Check(key string, ip string) (bool, error) {
 	return true, nil
 }
 
-func queryServer(c *http.Client, u string) (*Entry, error) {
-	resp, err := http.Get(u)
+// RedactedKey replaces the API key in the URLs quoted in errors
+const RedactedKey = "<redacted>"
+
+// query requests the path for the key.  The key is part of the URL, so
+// errors quote the URL with the key removed.
+func (c *Client) query(kind, key, path string) (*Entry, error) {
+	start := time.Now()
+
+	status := new(int)
+	e, err := queryServer(c.HTTPClient, c.rootURL()+key+path, c.rootURL()+RedactedKey+path, status)
+
+	if c.Observe != nil {
+		c.Observe(RequestInfo{
+			Kind:       kind,
+			Duration:   time.Since(start),
+			StatusCode: *status,
+			Err:        err,
+		})
+	}
+
+	return e, err
+}
+
+func queryServer(c *http.Client, u, display string, status *int) (*Entry, error) {
+	resp, err := c.Get(u)
 	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			ue.URL = display
+		}
 		return nil, fmt.Errorf("Query Error: %s", err.Error())
 	}
 	defer resp.Body.Close()
 
+	*status = resp.StatusCode
+
 	switch {
 	case resp.StatusCode == http.StatusBadRequest ||
 		resp.StatusCode == http.StatusNotFound ||
@@ -135,11 +226,11 @@ func queryServer(c *http.Client, u string) (*Entry, error) {
 	case resp.StatusCode == http.StatusOK:
 		break
 	case resp.StatusCode > 400 && resp.StatusCode < 500:
-		return nil, fmt.Errorf("client error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, u)
+		return nil, fmt.Errorf("client error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, display)
 	case resp.StatusCode >= 500:
-		return nil, fmt.Errorf("server error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, u)
+		return nil, fmt.Errorf("server error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, display)
 	case resp.StatusCode > 299:
-		return nil, fmt.Errorf("unhandled error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, u)
+		return nil, fmt.Errorf("unhandled error (%d) from apiban.org: %s from %q", resp.StatusCode, resp.Status, display)
 	}
 
 	entry := new(Entry)
@@ -169,7 +169,7 @@ func TestBanned(t *testing.T) {
 				startFrom: "12345678901",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (408) from apiban.org: 408 Request Timeout from \"%s/testKey/banned/12345678901\"", testServer.URL),
+				err: fmt.Errorf("client error (408) from apiban.org: 408 Request Timeout from \"%s/<redacted>/banned/12345678901\"", testServer.URL),
 			},
 		},
 		"no key": {
@@ -182,7 +182,7 @@ func TestBanned(t *testing.T) {
 				key: "badKey",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (404) from apiban.org: 404 Not Found from \"%s/badKey/banned/100\"", testServer.URL),
+				err: fmt.Errorf("client error (404) from apiban.org: 404 Not Found from \"%s/<redacted>/banned/100\"", testServer.URL),
 			},
 		},
 		"unreachable destination": {
@@ -191,7 +191,7 @@ func TestBanned(t *testing.T) {
 				badEndpoint: true,
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("Query Error: Get \"http://127.0.0.1:80/testKey/banned/100\": dial tcp 127.0.0.1:80: connectex: No connection could be made because the target machine actively refused it."),
+				err: fmt.Errorf("Query Error: Get \"http://127.0.0.1:80/<redacted>/banned/100\": dial tcp 127.0.0.1:80: connectex: No connection could be made because the target machine actively refused it."),
 			},
 		},
 		"nothing returned": {
@@ -232,7 +232,7 @@ func TestBanned(t *testing.T) {
 				key: "badAuth",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (401) from apiban.org: 401 Unauthorized from \"%s/badAuth/banned/100\"", testServer.URL),
+				err: fmt.Errorf("client error (401) from apiban.org: 401 Unauthorized from \"%s/<redacted>/banned/100\"", testServer.URL),
 			},
 		},
 	}
@@ -343,7 +343,7 @@ func TestCheck(t *testing.T) {
 				ip:  "1.2.3.251",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (404) from apiban.org: 404 Not Found from \"%s/badKey/check/1.2.3.251\"", testServer.URL),
+				err: fmt.Errorf("client error (404) from apiban.org: 404 Not Found from \"%s/<redacted>/check/1.2.3.251\"", testServer.URL),
 			},
 		},
 		"simulate rate limiter": {
@@ -352,7 +352,7 @@ func TestCheck(t *testing.T) {
 				ip:  "1.2.3.251",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (429) from apiban.org: 429 Too Many Requests from \"%s/testRateLimit/check/1.2.3.251\"", testServer.URL),
+				err: fmt.Errorf("client error (429) from apiban.org: 429 Too Many Requests from \"%s/<redacted>/check/1.2.3.251\"", testServer.URL),
 			},
 		},
 		"simulate unknown": {
@@ -361,7 +361,7 @@ func TestCheck(t *testing.T) {
 				ip:  "1.2.3.251",
 			},
 			expected: mockOutput{
-				err: fmt.Errorf("client error (429) from apiban.org: 429 Too Many Requests from \"%s/testUnknown/check/1.2.3.251\"", testServer.URL),
+				err: fmt.Errorf("client error (429) from apiban.org: 429 Too Many Requests from \"%s/<redacted>/check/1.2.3.251\"", testServer.URL),
 			},
 		},
 	}
@@ -382,3 +382,32 @@ func TestCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestClientObserve(t *testing.T) {
+	// initialize our test server
+	testServer := httptest.NewServer(mockServer)
+	defer testServer.Close()
+
+	var seen []RequestInfo
+	c := &Client{
+		HTTPClient: testServer.Client(),
+		RootURL:    fmt.Sprintf("%s/", testServer.URL),
+		Observe: func(ri RequestInfo) {
+			seen = append(seen, ri)
+		},
+	}
+
+	_, err := c.Banned("testKey", "")
+	assert.NoError(t, err)
+	_, err = c.Banned("badAuth", "")
+	assert.Error(t, err)
+
+	if assert.Len(t, seen, 3) {
+		assert.Equal(t, "banned", seen[0].Kind)
+		assert.Equal(t, 200, seen[0].StatusCode)
+		assert.NoError(t, seen[0].Err)
+		assert.Equal(t, 200, seen[1].StatusCode)
+		assert.Equal(t, 401, seen[2].StatusCode)
+		assert.Error(t, seen[2].Err)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/palner/apiban/clients/go/client"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// banner is what ban and unban need, from a client or a running daemon
+type banner interface {
+	Ban(addr string, d time.Duration, reason string) error
+	Unban(addr string) error
+}
+
+// banFlags parses the arguments of ban and unban, which take the address
+// before or after the flags
+func banFlags(cmd string, args []string) (addr string, d time.Duration, reason string, err error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	if cmd == "ban" {
+		fs.DurationVar(&d, "for", 0, "lift the ban after this long, such as 6h (default never)")
+		fs.StringVar(&reason, "reason", "", "why the address is banned, kept with the ban")
+	}
+	fs.Usage = func() {
+		if cmd == "ban" {
+			fmt.Fprintf(fs.Output(), "Usage: %s [flags] ban <ip|cidr> [-for 6h] [-reason text]\n\n", os.Args[0])
+			fmt.Fprint(fs.Output(), "Blocks an address by hand.  Manual bans are kept apart from the feed\n")
+			fmt.Fprint(fs.Output(), "and survive flushes until they expire or are unbanned.\n\nFlags:\n")
+			fs.PrintDefaults()
+			return
+		}
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] unban <ip|cidr>\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Lifts a manual ban, or a feed ban until the next full list.\n")
+	}
+
+	for {
+		if err = fs.Parse(args); err != nil {
+			return
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		if addr != "" {
+			return "", 0, "", fmt.Errorf("usage: %s <ip|cidr>", cmd)
+		}
+		addr, args = fs.Arg(0), fs.Args()[1:]
+	}
+	if addr == "" {
+		return "", 0, "", fmt.Errorf("usage: %s <ip|cidr>", cmd)
+	}
+	return
+}
+
+// runBan bans or unbans an address, through the daemon if one holds the
+// state
+func runBan(v Variant, cmd string, args []string) error {
+	addr, d, reason, err := banFlags(cmd, args)
+	if err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	lg, err := openLog()
+	if err != nil {
+		return err
+	}
+	defer lg.Close()
+
+	logging.SetDefault(lg)
+	log.SetFlags(0)
+	log.SetOutput(lg.Writer(logging.LevelInfo))
+
+	var b banner
+	lock, err := state.Acquire(state.LockFile(stateFileLocation))
+	switch {
+	case err == state.ErrLocked:
+		b = client.NewControlClient(client.DefaultSocket)
+	case err != nil:
+		return err
+	default:
+		defer lock.Release()
+
+		c, err := newClient(v, false)
+		if err != nil {
+			return err
+		}
+		b = c
+	}
+
+	if cmd == "ban" {
+		return b.Ban(addr, d, reason)
+	}
+	return b.Unban(addr)
+}
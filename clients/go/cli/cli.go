@@ -0,0 +1,388 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package cli implements the command line shared by the apiban-iptables
+// client builds.
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/palner/apiban/clients/go/client"
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// Variant describes how a client build differs from the standard one
+type Variant struct {
+
+	// Hooks are the built-in chains which jump to the APIBAN chain.  If
+	// empty, INPUT and FORWARD are used.
+	Hooks []string
+}
+
+var configFileLocation string
+var stateFileLocation string
+var logFile string
+var targetChain string
+var shardChains bool
+var keyFile string
+var logLevel string
+var logFormat string
+var force bool
+
+func init() {
+	flag.StringVar(&targetChain, "target", "", "verdict for matching entries: DROP, REJECT[:type], TARPIT, LIMIT:rate or a chain name; overrides TARGET (default REJECT)")
+	flag.StringVar(&configFileLocation, "config", "", "location of configuration file")
+	flag.StringVar(&stateFileLocation, "state", state.DefaultFile, "location of state file")
+	flag.StringVar(&keyFile, "key-file", "", "location of a file holding the API key; overrides APIKEY_FILE")
+	flag.StringVar(&logFile, "log", "", "location of log file, or stdout (-), stderr, syslog or journald; overrides LOG (default /var/log/apiban-client.log)")
+	flag.StringVar(&logLevel, "log-level", "", "minimum level logged: debug, info, warning or error; overrides LOG_LEVEL (default info)")
+	flag.StringVar(&logFormat, "log-format", "", "log format for files and streams: text or json; overrides LOG_FORMAT (default text)")
+	flag.BoolVar(&force, "force", false, "apply the feed even if it fails the sanity checks (MAX_ADDS, MAX_CHANGE, MIN_PREFIX_V4/V6)")
+	flag.BoolVar(&shardChains, "shard", false, "spread entries over per-prefix sub-chains (for very large lists); overrides SHARD")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n", os.Args[0])
+		fmt.Fprint(flag.CommandLine.Output(), "Commands:\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  (none)    sync new bans once\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  FULL      pull and apply the full list once\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  daemon    stay resident and sync on a schedule\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  restore   put back the bans of the last snapshot, offline (at boot)\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  ctl       control a running daemon (see ctl -h)\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  ban <ip|cidr> [-for 6h] [-reason text]\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            block an address by hand\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  unban <ip|cidr>\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            lift a ban\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  export [-o file] [-gzip]\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            write the banned entries for hosts with no path to APIBAN.org\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  import <file>\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            apply a file written by export\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  config show\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            print the effective configuration\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  report    list the banned sources seen by the hooks in shadow mode\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  score <ip|cidr>\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            explain the score of an address from the sources listing it\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  explain <ip|cidr>\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            show why an address is blocked, or not\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  history <ip|cidr> | history -from date [-to date]\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            show the bans of an address, or those added between dates\n")
+		fmt.Fprint(flag.CommandLine.Output(), "  check-health\n")
+		fmt.Fprint(flag.CommandLine.Output(), "            print a Nagios/Icinga status line and exit with its code\n\n")
+		fmt.Fprint(flag.CommandLine.Output(), "Flags:\n")
+		flag.PrintDefaults()
+	}
+}
+
+// Main runs the client and returns the process exit code.  Exit codes follow
+// the monitoring plugin conventions: 0 when all went well, 1 (warning) when
+// some rules could not be added and 2 (critical) when the client could not
+// run or reach APIBAN.org.
+func Main(v Variant) int {
+	flag.Parse()
+
+	// ctl talks to a running daemon; it needs neither the log nor iptables
+	if flag.Arg(0) == "ctl" {
+		if err := runCtl(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// config show only reads the configuration
+	if flag.Arg(0) == "config" {
+		if err := runConfig(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// report reads the counters of the shadow chain
+	if flag.Arg(0) == "report" {
+		if err := runReport(v, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// score reads the state and the configuration
+	if flag.Arg(0) == "score" {
+		if err := runScore(v, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// explain reads the firewall, the state and the history
+	if flag.Arg(0) == "explain" {
+		if err := runExplain(v, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// history only reads the history database
+	if flag.Arg(0) == "history" {
+		if err := runHistory(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// export reads the state and the configuration
+	if flag.Arg(0) == "export" {
+		if err := runExport(v, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// import changes the firewall, so it takes the state lock
+	if flag.Arg(0) == "import" {
+		if err := runImport(v, flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// ban and unban go through the daemon when it holds the state
+	if flag.Arg(0) == "ban" || flag.Arg(0) == "unban" {
+		if err := runBan(v, flag.Arg(0), flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return client.ExitCritical
+		}
+		return client.ExitOK
+	}
+
+	// check-health reports to stdout for the monitoring system
+	if flag.Arg(0) == "check-health" {
+		return runCheckHealth(v, flag.Args()[1:])
+	}
+
+	lg, err := openLog()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return client.ExitCritical
+	}
+	defer lg.Close()
+
+	logging.SetDefault(lg)
+
+	// Anything still using the standard logger goes to the same place
+	log.SetFlags(0)
+	log.SetOutput(lg.Writer(logging.LevelInfo))
+
+	logging.Info("** Started APIBAN CLIENT")
+	logging.Info("** Licensed under GPLv2. See LICENSE for details.")
+
+	// Only one client may change the firewall and the state at a time
+	lock, err := state.Acquire(state.LockFile(stateFileLocation))
+	if err == state.ErrLocked {
+		logging.Warning(err.Error())
+		return client.ExitWarning
+	}
+	if err != nil {
+		logging.Error(err.Error())
+		return client.ExitCritical
+	}
+	defer lock.Release()
+
+	c, err := newClient(v, false)
+	if err != nil {
+		logging.Error(err.Error())
+		return client.ExitCritical
+	}
+
+	sync := c.Sync
+	if force {
+		sync = c.ForceSync
+	}
+
+	var res *client.Result
+	switch cmd := flag.Arg(0); cmd {
+	case "daemon":
+		if err = runDaemon(c, flag.Args()[1:]); err != nil {
+			logging.Error(err.Error())
+		}
+	case "FULL":
+		// allow cli of FULL to reset LKID to 100
+		res, err = sync(true)
+	case "restore":
+		// put the bans back before the network is up; the next sync
+		// reconciles them
+		if res, err = c.Restore(); err != nil {
+			logging.Error("restoring the snapshot failed", "error", err)
+		}
+	case "":
+		logging.Debug("no command line arguments received")
+		res, err = sync(false)
+	default:
+		logging.Error("unknown command", "command", cmd)
+		return client.ExitUnknown
+	}
+	if err != nil {
+		// Sync has logged the error
+		return client.ExitCritical
+	}
+
+	if res != nil && res.Failed > 0 {
+		logging.Warning("** Done with warnings. Exiting.", "failed", res.Failed)
+		return client.ExitWarning
+	}
+
+	logging.Info("** Done. Exiting.")
+	return client.ExitOK
+}
+
+// openLog opens the log described by the configuration
+func openLog() (*logging.Logger, error) {
+	cfg, err := client.LoadConfig(configFileLocation, overrides())
+	if err != nil {
+		return nil, err
+	}
+
+	lc, err := cfg.Logging()
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	lg, err := logging.Open(lc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log: %w", err)
+	}
+
+	lg.SetSecrets(cfg.APIKEY)
+	return lg, nil
+}
+
+// newClient opens the client.  The commands which only look at the
+// firewall and the state open it readOnly, so they leave the rules alone
+// and may run alongside the daemon; the others must hold the state lock.
+func newClient(v Variant, readOnly bool) (*client.Client, error) {
+	return client.New(client.Options{
+		ConfigFile: configFileLocation,
+		Overrides:  overrides(),
+		StateFile:  stateFileLocation,
+		Firewall: firewall.Config{
+			Chain: "APIBAN",
+			Hooks: v.Hooks,
+		},
+		ReadOnly: readOnly,
+	})
+}
+
+// healthFlags adds the health threshold flags to fs
+func healthFlags(fs *flag.FlagSet, t *client.HealthThresholds) {
+	fs.DurationVar(&t.WarnAge, "warning-age", t.WarnAge, "warn when the last successful sync is older than this")
+	fs.DurationVar(&t.CritAge, "critical-age", t.CritAge, "critical when the last successful sync is older than this")
+	fs.IntVar(&t.WarnRules, "warning-rules", t.WarnRules, "warn when there are fewer rules than this")
+	fs.IntVar(&t.CritRules, "critical-rules", t.CritRules, "critical when there are fewer rules than this")
+}
+
+func runDaemon(c *client.Client, args []string) error {
+	s := client.DefaultSchedule
+	t := client.DefaultHealthThresholds
+	var socket, listen string
+
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	fs.StringVar(&socket, "socket", client.DefaultSocket, "location of the control socket, or empty to disable")
+	fs.StringVar(&listen, "listen", "", "address to serve /metrics and /healthz on (e.g. 127.0.0.1:9120), or empty to disable")
+	fs.DurationVar(&s.Interval, "interval", s.Interval, "time between syncs")
+	fs.DurationVar(&s.Jitter, "jitter", s.Jitter, "maximum random delay added to each interval")
+	fs.DurationVar(&s.RetryMin, "retry-min", s.RetryMin, "delay after the first failed sync")
+	fs.DurationVar(&s.RetryMax, "retry-max", s.RetryMax, "maximum delay between failed syncs")
+	healthFlags(fs, &t)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if s.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+
+	if socket != "" {
+		cs, err := c.ServeControl(socket)
+		if err != nil {
+			return err
+		}
+		defer cs.Close()
+	}
+
+	if listen != "" {
+		srv, err := c.ServeMonitoring(listen, t)
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+	}
+
+	return c.Daemon(s)
+}
+
+// runCheckHealth prints a monitoring plugin status line and returns its exit
+// code.  A running daemon is asked over the control socket; otherwise the
+// state file and the firewall are checked directly.
+func runCheckHealth(v Variant, args []string) int {
+	t := client.DefaultHealthThresholds
+	var socket string
+
+	fs := flag.NewFlagSet("check-health", flag.ContinueOnError)
+	fs.StringVar(&socket, "socket", client.DefaultSocket, "location of the control socket of a running daemon")
+	healthFlags(fs, &t)
+	if err := fs.Parse(args); err != nil {
+		return client.ExitUnknown
+	}
+
+	// Keep the client quiet; only the status line goes to stdout
+	logging.SetDefault(logging.New(logging.Discard, logging.LevelError))
+	log.SetOutput(ioutil.Discard)
+
+	var h *client.Health
+	if st, err := client.NewControlClient(socket).Status(); err == nil {
+		h = client.CheckHealth(st.LastSuccess, st.Banned, st.Paused, time.Now(), t)
+	} else {
+		c, err := newClient(v, true)
+		if err == nil {
+			h, err = c.Health(t)
+		}
+		if err != nil {
+			fmt.Printf("APIBAN UNKNOWN - %v\n", err)
+			return client.ExitUnknown
+		}
+	}
+
+	fmt.Println(h)
+	return h.Code
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/palner/apiban/clients/go/client"
+)
+
+// flagSettings maps global flags to the configuration keys they override
+var flagSettings = map[string]string{
+	"target":     "TARGET",
+	"shard":      "SHARD",
+	"key-file":   "APIKEY_FILE",
+	"log":        "LOG",
+	"log-level":  "LOG_LEVEL",
+	"log-format": "LOG_FORMAT",
+}
+
+// overrides returns the configuration settings given on the command line
+func overrides() map[string]string {
+	o := map[string]string{}
+	flag.Visit(func(f *flag.Flag) {
+		if key, ok := flagSettings[f.Name]; ok {
+			o[key] = f.Value.String()
+		}
+	})
+	return o
+}
+
+func runConfig(args []string) error {
+	var asJSON bool
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] config show [-json]\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Prints the effective configuration and where each setting came from.\n")
+		fmt.Fprint(fs.Output(), "Secrets are redacted.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	if len(args) == 0 || args[0] != "show" {
+		fs.Usage()
+		return errors.New("unknown config command")
+	}
+
+	if err := fs.Parse(args[1:]); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cfg, err := client.LoadConfig(configFileLocation, overrides())
+	if err != nil {
+		return err
+	}
+
+	for _, w := range cfg.Warnings {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", w)
+	}
+
+	if asJSON {
+		if err := printJSON(cfg.Settings()); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "KEY\tVALUE\tSOURCE")
+		for _, s := range cfg.Settings() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, s.Value, s.Source)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return cfg.Validate()
+}
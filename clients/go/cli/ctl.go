@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/palner/apiban/clients/go/client"
+)
+
+func ctlUsage(fs *flag.FlagSet) func() {
+	return func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s ctl [flags] command [args]\n\n", os.Args[0])
+		fmt.Fprint(out, "Commands:\n")
+		fmt.Fprint(out, "  status          show the state of the daemon\n")
+		fmt.Fprint(out, "  sync [full] [force]\n")
+		fmt.Fprint(out, "                  sync now, optionally pulling the full list or\n")
+		fmt.Fprint(out, "                  applying a feed which fails the sanity checks\n")
+		fmt.Fprint(out, "  ban <ip|cidr> [-for 6h] [-reason text]\n")
+		fmt.Fprint(out, "                  block an address, for a while or until unbanned\n")
+		fmt.Fprint(out, "  unban <ip|cidr> lift a block\n")
+		fmt.Fprint(out, "  pause           stop enforcing (bans are kept and still synced)\n")
+		fmt.Fprint(out, "  resume          start enforcing again\n\n")
+		fmt.Fprint(out, "Flags:\n")
+		fs.PrintDefaults()
+	}
+}
+
+func runCtl(args []string) error {
+	var socket string
+
+	fs := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	fs.StringVar(&socket, "socket", client.DefaultSocket, "location of the control socket")
+	fs.Usage = ctlUsage(fs)
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cc := client.NewControlClient(socket)
+
+	switch cmd := fs.Arg(0); cmd {
+	case "status":
+		st, err := cc.Status()
+		if err != nil {
+			return err
+		}
+		return printJSON(st)
+	case "sync":
+		var full, force bool
+		for _, arg := range fs.Args()[1:] {
+			switch arg {
+			case "full":
+				full = true
+			case "force":
+				force = true
+			default:
+				return fmt.Errorf("usage: ctl sync [full] [force]")
+			}
+		}
+
+		sync := cc.Sync
+		if force {
+			sync = cc.ForceSync
+		}
+		res, err := sync(full)
+		if err != nil {
+			return err
+		}
+		return printJSON(res)
+	case "ban", "unban":
+		addr, d, reason, err := banFlags(cmd, fs.Args()[1:])
+		if err == flag.ErrHelp {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if cmd == "ban" {
+			return cc.Ban(addr, d, reason)
+		}
+		return cc.Unban(addr)
+	case "pause":
+		return cc.SetPaused(true)
+	case "resume":
+		return cc.SetPaused(false)
+	case "":
+		fs.Usage()
+		return errors.New("no ctl command given")
+	default:
+		return fmt.Errorf("unknown ctl command %q", cmd)
+	}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palner/apiban/clients/go/client"
+	"github.com/palner/apiban/clients/go/logging"
+)
+
+// runExplain tells why an address is, or is not, blocked
+func runExplain(v Variant, args []string) error {
+	var asJSON, noCheck bool
+
+	fs := flag.NewFlagSet("explain", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.BoolVar(&noCheck, "no-check", false, "don't ask APIBAN.org about the address")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] explain [-json] [-no-check] <ip|cidr>\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Shows the firewall rules holding an address, the sources which banned\n")
+		fmt.Fprint(fs.Output(), "it and when, what keeps it from being banned, the escalations covering\n")
+		fmt.Fprint(fs.Output(), "it and what APIBAN.org says of it.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Allow the address ahead of the flags, as ban does
+	addr := ""
+	if fs.NArg() > 0 && !strings.HasPrefix(fs.Arg(0), "-") {
+		addr = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if addr == "" || fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("usage: explain <ip|cidr>")
+	}
+
+	// Keep the client quiet; only the explanation goes to stdout
+	logging.SetDefault(logging.New(logging.Discard, logging.LevelError))
+	log.SetOutput(ioutil.Discard)
+
+	c, err := newClient(v, true)
+	if err != nil {
+		return err
+	}
+
+	e, err := c.Explain(addr, !noCheck)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(e)
+	}
+	return printExplanation(os.Stdout, e)
+}
+
+// printExplanation writes an Explanation as a table, one fact per line
+func printExplanation(out io.Writer, e *client.Explanation) error {
+	verdict := "not blocked"
+	if e.Blocked {
+		verdict = "blocked"
+		if e.Paused {
+			verdict += ", but enforcement is paused"
+		}
+	}
+	fmt.Fprintf(out, "%s: %s\n", e.Address, verdict)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	row := func(key, format string, a ...interface{}) {
+		fmt.Fprintf(w, "%s\t%s\n", key, fmt.Sprintf(format, a...))
+	}
+
+	for _, r := range e.Rules {
+		rule := r.Rule
+		if rule == "" {
+			rule = r.Network
+		}
+		if r.Shadow {
+			rule += " (shadow, not enforced)"
+		}
+		row("rule", "%s", rule)
+		if len(r.Members) > 0 {
+			row("", "merges %s", strings.Join(r.Members, ", "))
+		}
+	}
+	if len(e.Rules) == 0 {
+		row("rule", "-")
+	}
+
+	for _, x := range e.Entries {
+		s := fmt.Sprintf("%s by %s", x.Entry, dash(strings.Join(x.Sources, ", ")))
+		if x.Since != nil {
+			s += " since " + x.Since.Local().Format(time.RFC3339)
+		}
+		if x.FeedID != "" {
+			s += " (feed ID " + x.FeedID + ")"
+		}
+		if x.Until != nil {
+			s += " until " + x.Until.Local().Format(time.RFC3339)
+		}
+		if x.Reason != "" {
+			s += ": " + x.Reason
+		}
+		row("entry", "%s", s)
+	}
+	if len(e.Entries) == 0 {
+		row("entry", "-")
+	}
+
+	for _, x := range e.Escalations {
+		row("escalation", "%s since %s: %s", x.Network, x.Since.Local().Format(time.RFC3339), x.Reason)
+	}
+	if len(e.Escalations) == 0 {
+		row("escalation", "-")
+	}
+
+	for _, a := range e.Allowed {
+		row("allowlist", "%s (%s)", a.Network, a.Source)
+	}
+	if len(e.Allowed) == 0 {
+		row("allowlist", "-")
+	}
+
+	if e.Protected != nil {
+		row("protected", "%s (%s)", e.Protected.Network, e.Protected.Source)
+	} else {
+		row("protected", "-")
+	}
+
+	switch {
+	case e.Reserved == nil:
+		row("reserved", "-")
+	case e.Reserved.Overridden:
+		row("reserved", "%s (%s), banned anyway (RESERVED_OVERRIDE)", e.Reserved.Network, e.Reserved.Source)
+	default:
+		row("reserved", "%s (%s), never banned from the feed", e.Reserved.Network, e.Reserved.Source)
+	}
+	for _, q := range e.Quarantined {
+		row("quarantined", "%s since %s: %s", q.Address, q.Since.Local().Format(time.RFC3339), q.Reason)
+	}
+
+	if s := e.Score; s != nil {
+		rule := fmt.Sprintf("threshold %d", s.Threshold)
+		if s.Threshold == 0 {
+			rule = "no threshold"
+		}
+		row("score", "%d (%s)", s.Total, rule)
+	}
+
+	switch {
+	case e.Check == nil:
+	case e.Check.Error != "":
+		row("apiban.org", "check failed: %s", e.Check.Error)
+	case e.Check.Listed:
+		row("apiban.org", "listed")
+	default:
+		row("apiban.org", "not listed")
+	}
+
+	return w.Flush()
+}
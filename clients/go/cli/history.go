@@ -0,0 +1,197 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// runHistory shows the history of an address, or the bans added or lifted
+// between two dates
+func runHistory(args []string) error {
+	var asJSON bool
+	var from, to, action string
+
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.StringVar(&from, "from", "", "list the changes from this date (2006-01-02 or RFC 3339)")
+	fs.StringVar(&to, "to", "", "list the changes up to this date, included (default now)")
+	fs.StringVar(&action, "action", "", "list only bans (ban) or lifts (lift)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] history [-json] <ip|cidr>\n", os.Args[0])
+		fmt.Fprintf(fs.Output(), "       %s [flags] history [-json] -from date [-to date] [-action ban|lift]\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Shows when an address was banned and lifted, by what and why, and the\n")
+		fmt.Fprint(fs.Output(), "traffic dropped; or lists the changes between two dates.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Allow the address ahead of the flags, as ban does
+	addr := ""
+	if fs.NArg() > 0 && !strings.HasPrefix(fs.Arg(0), "-") {
+		addr = fs.Arg(0)
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return err
+		}
+	}
+	if fs.NArg() != 0 || (addr == "") == (from == "") {
+		fs.Usage()
+		return errors.New("usage: history <ip|cidr> or history -from date")
+	}
+	if action != "" && action != history.Banned && action != history.Lifted {
+		return fmt.Errorf("-action must be %s or %s", history.Banned, history.Lifted)
+	}
+
+	h, err := history.OpenReadOnly(history.Path(stateFileLocation))
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+
+	if addr != "" {
+		return showRecord(h, addr, asJSON)
+	}
+
+	start, err := parseDate(from, false)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	end := time.Now().Add(time.Second)
+	if to != "" {
+		if end, err = parseDate(to, true); err != nil {
+			return fmt.Errorf("-to: %w", err)
+		}
+	}
+
+	events, err := h.Between(start, end, action)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(events)
+	}
+	if len(events) == 0 {
+		fmt.Println("no changes in that period")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tADDRESS\tSOURCE\tDETAIL")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.Action, e.Address, dash(e.Source), dash(e.Reason))
+	}
+	return w.Flush()
+}
+
+// showRecord prints what the history knows of an address
+func showRecord(h *history.DB, addr string, asJSON bool) error {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return err
+	}
+	key := n.String()
+	if ones, bits := n.Mask.Size(); ones == bits {
+		key = n.IP.String()
+	}
+
+	r, err := h.Get(key)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		if asJSON {
+			return printJSON(nil)
+		}
+		fmt.Printf("%s has never been banned\n", key)
+		return nil
+	}
+	if asJSON {
+		return printJSON(r)
+	}
+
+	if r.Active() {
+		fmt.Printf("%s: banned since %s\n", r.Address, r.Since.Local().Format(time.RFC3339))
+	} else {
+		fmt.Printf("%s: lifted %s (%s)\n", r.Address, r.Removed.Local().Format(time.RFC3339), dash(r.RemovalReason))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "first seen\t%s\n", r.FirstSeen.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "last seen\t%s\n", r.LastSeen.Local().Format(time.RFC3339))
+	fmt.Fprintf(w, "bans\t%d\n", r.Bans)
+	fmt.Fprintf(w, "sources\t%s\n", dash(strings.Join(r.Sources, ", ")))
+	if r.FeedID != "" {
+		fmt.Fprintf(w, "feed ID\t%s\n", r.FeedID)
+	}
+	if r.Expires != nil {
+		fmt.Fprintf(w, "expires\t%s\n", r.Expires.Local().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "dropped\t%d packets, %d bytes\n", r.Packets, r.Bytes)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTION\tSOURCE\tDETAIL")
+	for _, e := range r.Events {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC3339), e.Action, dash(e.Source), dash(e.Reason))
+	}
+	return w.Flush()
+}
+
+// parseDate reads a date as RFC 3339 or, in local time, 2006-01-02.  A bare
+// date ending a period includes the whole day.
+func parseDate(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither 2006-01-02 nor RFC 3339", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// dash stands in for an empty value in a table
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palner/apiban/clients/go/logging"
+)
+
+// runReport prints the banned sources which sent traffic to the hooks in
+// shadow mode
+func runReport(v Variant, args []string) error {
+	var asJSON bool
+
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] report [-json]\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Lists the banned sources which sent traffic to the hooks in shadow mode\n")
+		fmt.Fprint(fs.Output(), "(see SHADOW), that is the traffic which would have been dropped.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Keep the client quiet; only the report goes to stdout
+	logging.SetDefault(logging.New(logging.Discard, logging.LevelError))
+	log.SetOutput(ioutil.Discard)
+
+	c, err := newClient(v, true)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.ShadowReport()
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(r)
+	}
+
+	since := "the next sync"
+	if !r.Since.IsZero() {
+		since = r.Since.Format(time.RFC3339)
+	}
+	hit := 0
+	for _, h := range r.Hits {
+		hit++
+		if len(h.Entries) > 0 {
+			hit += len(h.Entries) - 1
+		}
+	}
+
+	fmt.Printf("Observing %s (%s) since %s\n", strings.Join(r.Hooks, ", "), r.Action, since)
+	if r.Rules != r.Banned {
+		fmt.Printf("%d of %d banned entries sent traffic, through %d of %d aggregated rules\n", hit, r.Banned, len(r.Hits), r.Rules)
+	} else {
+		fmt.Printf("%d of %d banned entries sent traffic\n", hit, r.Banned)
+	}
+	if len(r.Hits) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tPACKETS\tBYTES\tBANNED BY")
+	for _, h := range r.Hits {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", h.Source, h.Packets, h.Bytes, strings.Join(h.Sources, ", "))
+		if len(h.Entries) > 0 {
+			// Packets are counted by rule, not by the entries it merges
+			fmt.Fprintf(w, "  aggregates %s\t\t\t\n", strings.Join(h.Entries, " "))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/palner/apiban/clients/go/logging"
+)
+
+// runScore explains the score of an address: the sources listing it, their
+// weights and whether the total reaches SCORE_THRESHOLD
+func runScore(v Variant, args []string) error {
+	var asJSON bool
+
+	fs := flag.NewFlagSet("score", flag.ContinueOnError)
+	fs.BoolVar(&asJSON, "json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] score [-json] <ip|cidr>\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Shows the sources listing an address, their weights and whether the\n")
+		fmt.Fprint(fs.Output(), "total reaches SCORE_THRESHOLD.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("usage: score <ip|cidr>")
+	}
+
+	// Keep the client quiet; only the score goes to stdout
+	logging.SetDefault(logging.New(logging.Discard, logging.LevelError))
+	log.SetOutput(ioutil.Discard)
+
+	c, err := newClient(v, true)
+	if err != nil {
+		return err
+	}
+
+	s, err := c.Score(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return printJSON(s)
+	}
+
+	verdict := "not banned"
+	if s.Ban {
+		verdict = "banned"
+	}
+	rule := fmt.Sprintf("threshold %d", s.Threshold)
+	if s.Threshold == 0 {
+		rule = "no threshold, any source bans"
+	}
+	fmt.Printf("%s: %s (score %d, %s)\n", s.Address, verdict, s.Total, rule)
+	if s.Manual {
+		fmt.Println("banned by hand, whatever the score")
+	}
+	if len(s.Sources) == 0 {
+		fmt.Println("no source lists it")
+		return nil
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tWEIGHT")
+	for _, src := range s.Sources {
+		fmt.Fprintf(w, "%s\t%d\n", src.Name, src.Weight)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package cli
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// runExport writes the entries to be banned to a file for import on hosts
+// with no path to APIBAN.org
+func runExport(v Variant, args []string) error {
+	var out string
+	var compress bool
+
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.StringVar(&out, "o", "-", "file to write, or - for stdout")
+	fs.BoolVar(&compress, "gzip", false, "compress the file with gzip (default if the file name ends in .gz)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] export [-o file] [-gzip]\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Writes the entries banned here, with their sources and the LKID, for\n")
+		fmt.Fprint(fs.Output(), "import on another host.\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.New("usage: export [-o file]")
+	}
+	compress = compress || strings.HasSuffix(out, ".gz")
+
+	// Keep the client quiet; stdout may be the export
+	logging.SetDefault(logging.New(logging.Discard, logging.LevelError))
+	log.SetOutput(ioutil.Discard)
+
+	c, err := newClient(v, true)
+	if err != nil {
+		return err
+	}
+
+	e, err := c.Export()
+	if err != nil {
+		return err
+	}
+
+	if out == "-" {
+		return e.Write(os.Stdout, compress)
+	}
+
+	var buf bytes.Buffer
+	if err := e.Write(&buf, compress); err != nil {
+		return err
+	}
+	if err := state.WriteFile(out, buf.Bytes()); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d entries (LKID %s) to %s\n", len(e.Entries), e.LKID, out)
+	return nil
+}
+
+// runImport applies a file written by export in place of the last one
+func runImport(v Variant, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags] import <file|->\n\n", os.Args[0])
+		fmt.Fprint(fs.Output(), "Applies a file written by export, compressed or not, in place of the\n")
+		fmt.Fprint(fs.Output(), "last one.  Its entries are checked like those of any other source; use\n")
+		fmt.Fprint(fs.Output(), "-force before import to skip the sanity checks.\n")
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("usage: import <file|->")
+	}
+
+	var in io.Reader = os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	lg, err := openLog()
+	if err != nil {
+		return err
+	}
+	defer lg.Close()
+
+	logging.SetDefault(lg)
+	log.SetFlags(0)
+	log.SetOutput(lg.Writer(logging.LevelInfo))
+
+	lock, err := state.Acquire(state.LockFile(stateFileLocation))
+	if err != nil {
+		return err
+	}
+	defer lock.Release()
+
+	c, err := newClient(v, false)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Import(in, force)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported: %d added, %d removed, %d failed, %d invalid, %d suppressed, %d protected, %d rejected\n",
+		res.Added, res.Removed, res.Failed, res.Invalid, res.Suppressed, res.Protected, res.Rejected)
+	return nil
+}
@@ -0,0 +1,304 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// aggregator is a Backend which bans the shortest list of networks holding
+// exactly the banned entries (see netlist.Aggregate).  It is handed and
+// reports the entries themselves, so callers never see the rules.
+type aggregator struct {
+	Backend
+
+	// seed returns the entries already applied, read at the first Init
+	seed   func() []string
+	seeded bool
+
+	// entries are the banned entries and rules the networks banned by the
+	// Backend, both keyed by CIDR
+	entries map[string]*net.IPNet
+	rules   map[string]*net.IPNet
+}
+
+func newAggregator(be Backend, seed func() []string) *aggregator {
+	return &aggregator{
+		Backend: be,
+		seed:    seed,
+		entries: make(map[string]*net.IPNet),
+		rules:   make(map[string]*net.IPNet),
+	}
+}
+
+// Init prepares the Backend and, the first time, makes sure the rules for
+// the entries already applied are in place
+func (a *aggregator) Init() (bool, error) {
+	created, err := a.Backend.Init()
+	if err != nil {
+		return created, err
+	}
+
+	if created {
+		a.reset()
+		a.seeded = true
+	}
+	if a.seeded {
+		return created, nil
+	}
+
+	a.reset()
+	for _, addr := range a.seed() {
+		if n, err := netlist.ParseNet(addr); err == nil {
+			a.entries[n.String()] = n
+		}
+	}
+
+	current, err := a.Backend.List()
+	if err != nil {
+		return created, err
+	}
+	have := make(map[string]bool, len(current))
+	for _, r := range current {
+		have[r] = true
+	}
+
+	for _, n := range netlist.Aggregate(a.nets(a.entries)) {
+		if !have[n.String()] {
+			if err := a.Backend.Add(n.String()); err != nil {
+				return created, err
+			}
+		}
+		a.rules[n.String()] = n
+	}
+
+	// Drop rules left within wider ones, such as those of entries applied
+	// before they were aggregated
+	for _, r := range current {
+		n, err := netlist.ParseNet(r)
+		if err != nil || a.rules[r] != nil {
+			continue
+		}
+		if a.covering(n) != nil {
+			if err := a.Backend.Remove(r); err != nil {
+				return created, err
+			}
+		}
+	}
+
+	a.seeded = true
+	return created, nil
+}
+
+// Add bans an entry, widening or merging rules as needed.  The new rule is
+// added before the ones it replaces are removed, so nothing is let through
+// in between.
+func (a *aggregator) Add(addr string) error {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return err
+	}
+	key := n.String()
+	if _, ok := a.entries[key]; ok {
+		return nil
+	}
+
+	entry := n
+	if a.covering(n) != nil {
+		a.entries[key] = entry
+		return nil
+	}
+
+	// Replace the rules within n, then merge with complete siblings
+	var replaced []string
+	if ones, bits := n.Mask.Size(); ones < bits {
+		for k, r := range a.rules {
+			if within(r, n) {
+				replaced = append(replaced, k)
+			}
+		}
+	}
+	for {
+		ones, _ := n.Mask.Size()
+		sib := netlist.Sibling(n).String()
+		if ones == 0 || a.rules[sib] == nil {
+			break
+		}
+		replaced = append(replaced, sib)
+		n = netlist.Parent(n)
+	}
+
+	if err := a.Backend.Add(n.String()); err != nil {
+		return err
+	}
+	a.rules[n.String()] = n
+	a.entries[key] = entry
+
+	if len(replaced) > 0 {
+		logging.Debug("aggregated rules", "rule", n, "replaces", strings.Join(replaced, " "))
+	}
+	for _, k := range replaced {
+		if err := a.Backend.Remove(k); err != nil {
+			return fmt.Errorf("failed to remove %s, replaced by %s: %w", k, n, err)
+		}
+		delete(a.rules, k)
+	}
+	return nil
+}
+
+// Remove lifts the ban on an entry, splitting the rule which held it into
+// rules for the remaining entries
+func (a *aggregator) Remove(addr string) error {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return err
+	}
+	key := n.String()
+	if _, ok := a.entries[key]; !ok {
+		return a.Backend.Remove(addr)
+	}
+
+	r := a.covering(n)
+	delete(a.entries, key)
+	if r == nil {
+		return nil
+	}
+
+	var members []*net.IPNet
+	for _, e := range a.entries {
+		if within(e, r) {
+			members = append(members, e)
+		}
+	}
+
+	keep := false
+	for _, m := range netlist.Aggregate(members) {
+		if m.String() == r.String() {
+			keep = true
+			continue
+		}
+		if err := a.Backend.Add(m.String()); err != nil {
+			return err
+		}
+		a.rules[m.String()] = m
+	}
+
+	if !keep {
+		if err := a.Backend.Remove(r.String()); err != nil {
+			return err
+		}
+		delete(a.rules, r.String())
+	}
+	return nil
+}
+
+// List returns the banned entries.  Before the first Init, when they are
+// not known yet, the rules are returned instead.
+func (a *aggregator) List() ([]string, error) {
+	if !a.seeded {
+		return a.Backend.List()
+	}
+
+	out := make([]string, 0, len(a.entries))
+	for k := range a.entries {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// Rules returns the networks banned in the Backend
+func (a *aggregator) Rules() ([]string, error) {
+	return a.Backend.List()
+}
+
+// Members returns the entries held by rule
+func (a *aggregator) Members(rule string) []string {
+	r, err := netlist.ParseNet(rule)
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for k, e := range a.entries {
+		if within(e, r) {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (a *aggregator) Flush() error {
+	if err := a.Backend.Flush(); err != nil {
+		return err
+	}
+	a.reset()
+	return nil
+}
+
+func (a *aggregator) Teardown() error {
+	if err := a.Backend.Teardown(); err != nil {
+		return err
+	}
+	a.reset()
+	a.seeded = true
+	return nil
+}
+
+func (a *aggregator) reset() {
+	a.entries = make(map[string]*net.IPNet)
+	a.rules = make(map[string]*net.IPNet)
+}
+
+// covering returns the rule holding n, if any
+func (a *aggregator) covering(n *net.IPNet) *net.IPNet {
+	for m := n; ; m = netlist.Parent(m) {
+		if r := a.rules[m.String()]; r != nil {
+			return r
+		}
+		if ones, _ := m.Mask.Size(); ones == 0 {
+			return nil
+		}
+	}
+}
+
+func (a *aggregator) nets(m map[string]*net.IPNet) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(m))
+	for _, n := range m {
+		out = append(out, n)
+	}
+	return out
+}
+
+// within reports whether all of n is in r
+func within(n, r *net.IPNet) bool {
+	rOnes, _ := r.Mask.Size()
+	nOnes, _ := n.Mask.Size()
+	return len(n.IP) == len(r.IP) && rOnes <= nOnes && r.Contains(n.IP)
+}
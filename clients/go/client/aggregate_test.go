@@ -0,0 +1,149 @@
+package client
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/stretchr/testify/assert"
+)
+
+// aggregated returns the rules expected for entries
+func aggregated(t *testing.T, entries []string) []string {
+	var nets []*net.IPNet
+	for _, e := range entries {
+		n, err := netlist.ParseNet(e)
+		assert.NoError(t, err)
+		nets = append(nets, n)
+	}
+
+	out := []string{}
+	for _, n := range netlist.Aggregate(nets) {
+		out = append(out, n.String())
+	}
+	return out
+}
+
+func sorted(list []string) []string {
+	out := append([]string{}, list...)
+	sort.Strings(out)
+	return out
+}
+
+func TestAggregator(t *testing.T) {
+	be := new(fakeBackend)
+	a := newAggregator(be, func() []string { return nil })
+	_, err := a.Init()
+	assert.NoError(t, err)
+
+	steps := []struct {
+		add, remove string
+		rules       []string
+	}{
+		{add: "192.0.2.0", rules: []string{"192.0.2.0/32"}},
+		{add: "192.0.2.1", rules: []string{"192.0.2.0/31"}},
+		{add: "192.0.2.3", rules: []string{"192.0.2.0/31", "192.0.2.3/32"}},
+		{add: "192.0.2.2", rules: []string{"192.0.2.0/30"}},
+		{add: "192.0.2.2", rules: []string{"192.0.2.0/30"}},
+		{add: "192.0.2.0/24", rules: []string{"192.0.2.0/24"}},
+		{add: "2001:db8::1", rules: []string{"192.0.2.0/24", "2001:db8::1/128"}},
+		{remove: "192.0.2.0/24", rules: []string{"192.0.2.0/30", "2001:db8::1/128"}},
+		{remove: "192.0.2.1", rules: []string{"192.0.2.0/32", "192.0.2.2/31", "2001:db8::1/128"}},
+		{remove: "2001:db8::1", rules: []string{"192.0.2.0/32", "192.0.2.2/31"}},
+	}
+
+	for _, s := range steps {
+		if s.add != "" {
+			assert.NoError(t, a.Add(s.add))
+		} else {
+			assert.NoError(t, a.Remove(s.remove))
+		}
+		assert.Equal(t, sorted(s.rules), sorted(be.added), "after %s%s", s.add, s.remove)
+	}
+
+	entries, err := a.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/32", "192.0.2.2/32", "192.0.2.3/32"}, entries)
+	assert.Equal(t, []string{"192.0.2.2/32", "192.0.2.3/32"}, a.Members("192.0.2.2/31"))
+
+	assert.Error(t, a.Remove("198.51.100.1"))
+	assert.Error(t, a.Add("bad"))
+}
+
+func TestAggregatorRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	be := new(fakeBackend)
+	a := newAggregator(be, func() []string { return nil })
+	_, err := a.Init()
+	assert.NoError(t, err)
+
+	entries := map[string]bool{}
+	for i := 0; i < 2000; i++ {
+		n := &net.IPNet{IP: net.IPv4(198, 51, 100, byte(rnd.Intn(64))).To4(), Mask: net.CIDRMask(30+rnd.Intn(3), 32)}
+		n.IP = n.IP.Mask(n.Mask)
+		addr := n.String()
+
+		if entries[addr] && rnd.Intn(2) == 0 {
+			assert.NoError(t, a.Remove(addr))
+			delete(entries, addr)
+		} else {
+			assert.NoError(t, a.Add(addr))
+			entries[addr] = true
+		}
+
+		var list []string
+		for e := range entries {
+			list = append(list, e)
+		}
+		if !assert.Equal(t, sorted(aggregated(t, list)), sorted(be.added)) {
+			return
+		}
+	}
+}
+
+func TestAggregatorSeed(t *testing.T) {
+	be := &fakeBackend{added: []string{"192.0.2.0/32"}}
+	a := newAggregator(be, func() []string { return []string{"192.0.2.0", "192.0.2.1"} })
+
+	// Before Init the rules are all that is known
+	list, err := a.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/32"}, list)
+
+	_, err = a.Init()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/31"}, be.added)
+
+	list, err = a.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/32", "192.0.2.1/32"}, list)
+}
+
+func TestSyncAggregate(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{AGGREGATE: true})
+	defer cleanup()
+	c.Backend = newAggregator(be, c.applied)
+	be.created = true
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.False(t, res.Flushed)
+	assert.True(t, c.State.Aggregated)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, c.State.Applied())
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, st.Banned)
+	assert.Equal(t, 2, st.Rules)
+
+	// Turning aggregation off replaces the rules
+	c.Config.AGGREGATE = false
+	c.Backend = be
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.True(t, res.Flushed)
+	assert.False(t, c.State.Aggregated)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, be.added)
+}
@@ -0,0 +1,915 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package client implements the APIBAN client: it pulls the banned list from
+// APIBAN.org and applies it to the local firewall.
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palner/apiban/clients/go/apiban"
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// flushInterval is how often the chain is flushed and the full list pulled
+// again
+const flushInterval = 7 * 24 * time.Hour
+
+// ErrReadOnly is returned by the methods which change the firewall or the
+// state of a Client opened with Options.ReadOnly
+var ErrReadOnly = errors.New("the client was opened read-only")
+
+// Backend applies bans to the local firewall
+type Backend interface {
+
+	// Init makes sure the firewall is ready to accept bans, returning true if
+	// it had to be (re)built
+	Init() (bool, error)
+
+	// Add bans an address or CIDR
+	Add(addr string) error
+
+	// Remove lifts the ban on an address or CIDR
+	Remove(addr string) error
+
+	// List returns the banned networks
+	List() ([]string, error)
+
+	// SetPaused stops or resumes enforcement without removing the bans
+	SetPaused(paused bool) error
+
+	// SetAllowed replaces the networks which are let through ahead of the
+	// bans
+	SetAllowed(addrs []string) error
+
+	// Flush removes all bans
+	Flush() error
+
+	// Teardown removes the bans and anything else the Backend installed
+	Teardown() error
+}
+
+// Options configures a Client
+type Options struct {
+
+	// ConfigFile is the preferred configuration file location
+	ConfigFile string
+
+	// Overrides are configuration settings from the command line, keyed
+	// like the configuration file
+	Overrides map[string]string
+
+	// StateFile is the location of the state file (default
+	// state.DefaultFile)
+	StateFile string
+
+	// Firewall describes the chain layout
+	Firewall firewall.Config
+
+	// Timeout is the timeout for APIBAN.org requests
+	Timeout time.Duration
+
+	// ReadOnly opens the Client for the commands which only look at the
+	// firewall and the state, alongside a running daemon: nothing is
+	// installed or lifted, and the methods which would change the firewall
+	// or the state return ErrReadOnly
+	ReadOnly bool
+}
+
+// Client pulls bans from APIBAN.org and applies them to a Backend
+type Client struct {
+	Config  *ApibanConfig
+	State   *state.State
+	API     *apiban.Client
+	Backend Backend
+	Metrics *Metrics
+
+	opts       Options
+	fwConfigs  []firewall.Config
+	allow      *netlist.List
+	protected  *netlist.List
+	lists      []*list
+	newBackend func(firewall.Config) (Backend, error)
+
+	// shadow is the Backend of the shadow chain, if any hooks are in shadow
+	// mode, and shadowHooks are those hooks
+	shadow      Backend
+	shadowHooks []string
+
+	// detectProtected finds the addresses which must never be banned
+	detectProtected func() *netlist.List
+
+	// journal holds the changes to the bans not yet written to the history
+	journal []history.Event
+
+	// mu serialises everything which touches the Backend or the state
+	mu       sync.Mutex
+	paused   bool
+	lastSync time.Time
+	lastOK   time.Time
+	last     *Result
+	lastErr  error
+}
+
+// Result summarises a sync
+type Result struct {
+
+	// ID is the last known ID after the sync
+	ID string `json:"id"`
+
+	// Added is the number of addresses added
+	Added int `json:"added"`
+
+	// Failed is the number of addresses which could not be added
+	Failed int `json:"failed"`
+
+	// Invalid is the number of list entries skipped because they are not
+	// an address or CIDR
+	Invalid int `json:"invalid"`
+
+	// Removed is the number of addresses removed
+	Removed int `json:"removed"`
+
+	// Suppressed is the number of addresses not banned because they are
+	// allowlisted
+	Suppressed int `json:"suppressed"`
+
+	// Protected is the number of addresses not banned because they would
+	// lock the host out (see DetectProtected)
+	Protected int `json:"protected"`
+
+	// Rejected is the number of addresses not banned because they are in a
+	// reserved range (see netlist.Reserved)
+	Rejected int `json:"rejected"`
+
+	// Unscored is the number of entries listed but not banned because
+	// their score is below SCORE_THRESHOLD
+	Unscored int `json:"unscored"`
+
+	// Expired is the number of manual bans lifted because they expired
+	Expired int `json:"expired"`
+
+	// Escalated and Deescalated are the numbers of networks banned and
+	// lifted by the escalation rules
+	Escalated   int `json:"escalated"`
+	Deescalated int `json:"deescalated"`
+
+	// Flushed indicates the chain was flushed during the sync
+	Flushed bool `json:"flushed"`
+}
+
+// New loads the configuration and connects to the firewall
+func New(opts Options) (*Client, error) {
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+
+	c := &Client{
+		API:     apiban.NewClient(timeout),
+		Metrics: NewMetrics(),
+		opts:    opts,
+		newBackend: func(fc firewall.Config) (Backend, error) {
+			return firewall.New(fc)
+		},
+		detectProtected: DetectProtected,
+	}
+
+	c.API.Observe = c.Metrics.observeRequest
+
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	if err := c.loadState(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadState reads the state file.  The first time, the state kept in
+// config.json by older versions is carried over.
+func (c *Client) loadState() error {
+	path := c.statePath()
+	st, err := state.Load(path)
+	if err != nil {
+		return err
+	}
+
+	if st.IsNew() && c.Config.LKID != "" {
+		logging.Info("moving LKID and FLUSH from the config file to the state file", "state", path)
+		st.LKID = c.Config.LKID
+		if t, err := strconv.ParseInt(c.Config.FLUSH, 10, 64); err == nil {
+			st.Flushed = time.Unix(t, 0)
+		}
+	}
+
+	c.State = st
+	c.lastOK = st.LastSuccess
+	return nil
+}
+
+// Reload re-reads the configuration file.  If the firewall settings changed,
+// the old chains are torn down, a new Backend is connected and true is
+// returned; the caller should then run a full sync.  On error the current
+// configuration is kept.
+func (c *Client) Reload() (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cfg, err := LoadConfig(c.opts.ConfigFile, c.opts.Overrides)
+	if err != nil {
+		return false, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return false, err
+	}
+
+	for _, w := range cfg.Warnings {
+		logging.Warning(w)
+	}
+
+	// Keep the key out of the logs
+	logging.Default().SetSecrets(cfg.APIKEY)
+
+	fc := c.opts.Firewall
+	fc.Sharded = fc.Sharded || cfg.SHARD
+	fc.AllowTarget = cfg.ALLOWTARGET
+
+	allow, err := cfg.Allowlist()
+	if err != nil {
+		return false, err
+	}
+
+	fcs, err := cfg.firewallConfigs(fc)
+	if err != nil {
+		return false, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	var hc *http.Client
+	if c.API != nil {
+		hc = c.API.HTTPClient
+	}
+	lists, err := openLists(cfg, hc)
+	if err != nil {
+		return false, err
+	}
+	if l := c.importList(cfg); l != nil {
+		lists = append(lists, l)
+	}
+
+	if c.Backend != nil && reflect.DeepEqual(fcs, c.fwConfigs) && cfg.AGGREGATE == c.Config.AGGREGATE {
+		c.Config = cfg
+		c.lists = lists
+		if !reflect.DeepEqual(allow.Strings(), c.allow.Strings()) {
+			c.setAllowed(allow)
+		}
+		return false, nil
+	}
+
+	var backends tee
+	var shadow Backend
+	var shadowHooks []string
+	for _, fc := range fcs {
+		be, err := c.newBackend(fc)
+		if err != nil {
+			return false, fmt.Errorf("failed to connect to iptables: %w", err)
+		}
+		if be, err = c.checkVerdict(be, fc); err != nil {
+			return false, err
+		}
+		backends = append(backends, be)
+		if isShadow(fc) {
+			shadow, shadowHooks = be, fc.Hooks
+		}
+	}
+
+	var be Backend = backends
+	if len(backends) == 1 {
+		be = backends[0]
+	}
+	if cfg.AGGREGATE {
+		be = newAggregator(be, c.applied)
+	}
+
+	changed := c.Backend != nil
+	if changed && !c.opts.ReadOnly {
+		if err := c.Backend.Teardown(); err != nil {
+			logging.Error("removing old APIBAN chain failed", "error", err)
+		}
+	}
+
+	if c.paused && !c.opts.ReadOnly {
+		if err := be.SetPaused(true); err != nil {
+			logging.Error("pausing new APIBAN chain failed", "error", err)
+		}
+	}
+
+	c.Config = cfg
+	c.Backend = be
+	c.lists = lists
+	c.fwConfigs = fcs
+	c.shadow = shadow
+	c.shadowHooks = shadowHooks
+	c.setAllowed(allow)
+
+	return changed, nil
+}
+
+// applied returns the entries recorded as applied in the state: those of
+// the feed, of the other lists and the manual bans
+func (c *Client) applied() []string {
+	if c.State == nil {
+		return nil
+	}
+	out := c.State.Applied()
+	seen := make(map[string]bool, len(out))
+	for _, a := range out {
+		seen[a] = true
+	}
+	for _, src := range c.State.Sources() {
+		for _, a := range src.Entries {
+			if !seen[a] {
+				seen[a] = true
+				out = append(out, a)
+			}
+		}
+	}
+	for _, m := range c.State.Manual() {
+		if !seen[m.Address] {
+			out = append(out, m.Address)
+		}
+	}
+	return out
+}
+
+// Rules returns the networks banned in the firewall.  Unless AGGREGATE is
+// set, they are the banned entries.
+func (c *Client) Rules() ([]string, error) {
+	if a, ok := c.Backend.(*aggregator); ok {
+		return a.Rules()
+	}
+	return c.Backend.List()
+}
+
+// Members returns the banned entries held by a rule
+func (c *Client) Members(rule string) []string {
+	if a, ok := c.Backend.(*aggregator); ok {
+		return a.Members(rule)
+	}
+	return []string{rule}
+}
+
+// setAllowed passes the allowlist to the Backend and lifts any bans it
+// covers
+func (c *Client) setAllowed(allow *netlist.List) {
+	c.allow = allow
+	if c.opts.ReadOnly {
+		return
+	}
+	if err := c.Backend.SetAllowed(allow.Strings()); err != nil {
+		logging.Error("setting allow rules failed", "error", err)
+	}
+
+	c.liftCovered(allow, "allowlisted")
+}
+
+// refreshProtected detects the protected addresses again and lifts any bans
+// covering them
+func (c *Client) refreshProtected() {
+	if c.detectProtected == nil || !c.Config.PROTECT {
+		c.protected = nil
+		return
+	}
+
+	c.protected = c.detectProtected()
+	c.liftCovered(c.protected, "protected")
+}
+
+// liftCovered removes the bans which share any address with l
+func (c *Client) liftCovered(l *netlist.List, why string) {
+	if l.Len() == 0 {
+		return
+	}
+
+	list, err := c.Backend.List()
+	if err != nil {
+		return
+	}
+
+	for _, addr := range list {
+		n, err := netlist.ParseNet(addr)
+		if err != nil {
+			continue
+		}
+		e, ok := l.Match(n)
+		if !ok {
+			continue
+		}
+		if err := c.Backend.Remove(addr); err != nil {
+			logging.Error("removing "+why+" ban failed", "ip", addr, "error", err)
+			continue
+		}
+		logging.Info("unblocking "+why+" address", "ip", addr, "match", e.Net, "source", e.Source)
+		c.lifted(addr, why)
+		if c.State != nil {
+			c.State.SetApplied(addr, false)
+			c.State.Unlist(addr)
+			c.State.Unban(addr)
+			c.State.Deescalate(addr)
+		}
+	}
+}
+
+// allowed returns the allowlist entry covering any part of addr
+func (c *Client) allowed(addr string) (netlist.Entry, bool) {
+	return match(c.allow, addr)
+}
+
+// isProtected returns the protected address within addr
+func (c *Client) isProtected(addr string) (netlist.Entry, bool) {
+	return match(c.protected, addr)
+}
+
+// match returns the entry of l sharing any address with addr
+func match(l *netlist.List, addr string) (netlist.Entry, bool) {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return netlist.Entry{}, false
+	}
+	return l.Match(n)
+}
+
+// Sync pulls any new bans and applies them.  If full is set, the entire list
+// is pulled again.  A feed which fails the sanity checks (see checkFeed) is
+// not applied and a *GuardError is returned.
+func (c *Client) Sync(full bool) (*Result, error) {
+	return c.doSync(full, false)
+}
+
+// ForceSync is Sync without the sanity checks
+func (c *Client) ForceSync(full bool) (*Result, error) {
+	return c.doSync(full, true)
+}
+
+func (c *Client) doSync(full, force bool) (*Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.ReadOnly {
+		return &Result{ID: c.State.LKID}, ErrReadOnly
+	}
+
+	start := time.Now()
+	hits := c.hits()
+	res, err := c.sync(full, force)
+	if err == nil {
+		c.escalate(res)
+	}
+
+	c.lastSync = time.Now()
+	if err == nil {
+		// Save the updated LKID and time of this sync
+		c.State.LastSuccess = c.lastSync
+		err = c.State.Save()
+	}
+	if err == nil {
+		c.takeSnapshot()
+	}
+	c.writeHistory(hits)
+
+	c.last = res
+	c.lastErr = err
+	if err == nil {
+		c.lastOK = c.lastSync
+	}
+
+	if err != nil {
+		logging.Error("sync failed", "lkid", res.ID, "added", res.Added, "error", err)
+	} else {
+		logging.Info("sync complete", "lkid", res.ID, "added", res.Added, "failed", res.Failed, "invalid", res.Invalid,
+			"removed", res.Removed, "suppressed", res.Suppressed, "protected", res.Protected, "rejected", res.Rejected, "unscored", res.Unscored, "expired", res.Expired, "escalated", res.Escalated, "deescalated", res.Deescalated, "flushed", res.Flushed, "full", full, "duration", time.Since(start).Round(time.Millisecond))
+	}
+
+	c.Metrics.observeSync(c.lastSync, res, err)
+	list, lerr := c.Backend.List()
+	rules, rerr := c.Rules()
+	if lerr == nil && rerr == nil {
+		c.Metrics.observeBanned(list, rules)
+	}
+
+	return res, err
+}
+
+func (c *Client) sync(full, force bool) (*Result, error) {
+	now := time.Now()
+	st := c.State
+
+	if full {
+		logging.Info("full sync requested, resetting LKID")
+		st.LKID = "100"
+	}
+
+	// if no LKID, reset it to 100
+	if len(st.LKID) == 0 {
+		logging.Debug("no LKID, starting from 100")
+		st.LKID = "100"
+	}
+
+	// if no FLUSH, reset it to now
+	if st.Flushed.IsZero() {
+		logging.Debug("no FLUSH time, starting now")
+		st.Flushed = now
+	}
+
+	res := &Result{ID: st.LKID}
+
+	created, err := c.Backend.Init()
+	if err != nil {
+		return res, fmt.Errorf("failed to initialize IPTables: %w", err)
+	}
+
+	c.refreshProtected()
+	c.observeShadow(now, created)
+
+	// The chain is empty once recreated, so the feed is checked against
+	// what was applied before
+	var prev []string
+	if created {
+		prev = st.Applied()
+		c.recreated()
+	} else if !st.Restored.IsZero() {
+		c.reconcile(res)
+	}
+	st.Restored = time.Time{}
+
+	// The chain is flushed once the new list is known to be sane
+	flush := now.Sub(st.Flushed) >= flushInterval
+	if st.Aggregated != c.Config.AGGREGATE {
+		logging.Info("AGGREGATE changed, replacing the rules", "aggregate", c.Config.AGGREGATE)
+		flush = true
+	}
+	if st.Scoring != c.scoring() {
+		logging.Info("SCORE_THRESHOLD or the weights changed, replacing the rules", "scoring", c.scoring())
+		flush = true
+	}
+	if flush {
+		st.LKID = "100"
+	}
+
+	c.releaseQuarantine(res)
+	c.expireManual(res, now)
+
+	if err := c.syncFeed(res, now, prev, flush, force); err != nil {
+		return res, err
+	}
+
+	c.syncLists(res, now, full, force)
+	return res, nil
+}
+
+// verdictChecker is a Backend which can tell whether iptables supports its
+// verdict (see firewall.Firewall.CheckVerdict)
+type verdictChecker interface {
+	CheckVerdict() error
+}
+
+// checkVerdict makes sure iptables supports the verdict of be before any
+// ban relies on it.  TARPIT is only used when available; without it the
+// chain drops instead.
+func (c *Client) checkVerdict(be Backend, fc firewall.Config) (Backend, error) {
+	vc, ok := be.(verdictChecker)
+	if !ok || c.opts.ReadOnly {
+		return be, nil
+	}
+
+	err := vc.CheckVerdict()
+	if err == nil {
+		return be, nil
+	}
+	if fc.Verdict.Target != firewall.Tarpit {
+		return nil, err
+	}
+
+	logging.Warning("TARPIT is not available (it needs xtables-addons), dropping instead", "chain", fc.Chain, "hooks", strings.Join(fc.Hooks, ","), "error", err)
+	fc.Verdict = firewall.Verdict{Target: "DROP"}
+	be, err = c.newBackend(fc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to iptables: %w", err)
+	}
+	return be, nil
+}
+
+// recreated starts over after the chain was created: the feed is pulled
+// again from the start, and the manual bans and lists are put back
+func (c *Client) recreated() {
+	st := c.State
+	logging.Info("APIBAN chain was created, resetting LKID")
+	st.LKID = "100"
+	st.ClearApplied()
+	st.Aggregated = c.Config.AGGREGATE
+	st.Scoring = c.scoring()
+	c.applyManual()
+	c.applyLists()
+}
+
+// syncFeed applies the new entries of the APIBAN feed, flushing the chain
+// first if flush is set.  prev, if set, are the entries applied before the
+// chain was recreated, which the full list replaces.
+func (c *Client) syncFeed(res *Result, now time.Time, prev []string, flush, force bool) error {
+	st := c.State
+
+	// Get list of banned ip's from APIBAN.org
+	feed := &source.APIBAN{Client: c.API, Key: c.Config.APIKEY}
+	batch, err := feed.Fetch(st.LKID)
+	if err != nil {
+		return fmt.Errorf("failed to get banned list: %w", err)
+	}
+
+	if batch.Cursor == st.LKID {
+		logging.Debug("Great news... no new bans to add.")
+		return nil
+	}
+
+	if len(batch.Entries) == 0 {
+		logging.Debug("No IP addresses detected.")
+		return nil
+	}
+
+	adds, err := c.screen(batch.Entries, res, now)
+	if err != nil {
+		return err
+	}
+
+	applied, replace := st.Applied(), flush
+	if prev != nil {
+		applied, replace = prev, true
+	}
+	if err := c.Config.checkFeed(adds, applied, replace); err != nil {
+		if !force {
+			c.Metrics.observeGuard(err.(*GuardError).Check)
+			return err
+		}
+		logging.Warning("applying the feed despite the sanity check", "reason", err.(*GuardError).Reason)
+	}
+
+	var before []string
+	if flush {
+		before, _ = c.Backend.List()
+		if err := c.Backend.Flush(); err != nil {
+			logging.Error("flushing APIBAN chain failed", "error", err)
+		} else {
+			logging.Info("APIBAN chain flushed", "removed", len(before))
+			res.Flushed = true
+			res.Removed = len(before)
+			st.ClearApplied()
+			st.Aggregated = c.Config.AGGREGATE
+			st.Scoring = c.scoring()
+			c.observeShadow(now, true)
+			c.applyManual()
+			c.applyLists()
+		}
+		st.Flushed = now
+	}
+
+	start := time.Now()
+	for _, ip := range adds {
+		// Recorded even when held back, since the feed adds to its score
+		st.SetApplied(ip, true)
+		if !c.passes(ip) {
+			logging.Debug("not blocking address below the score threshold", "ip", ip, "score", c.score(ip).Total)
+			res.Unscored++
+			continue
+		}
+		if !c.add(ip, res) {
+			st.SetApplied(ip, false)
+			continue
+		}
+		c.record(history.Event{Action: history.Banned, Address: ip, Source: source.APIBANName, FeedID: batch.Cursor})
+	}
+
+	if res.Flushed {
+		c.liftMissing(before, "no longer listed by "+source.APIBANName)
+	}
+
+	c.Metrics.observeApply(time.Since(start))
+
+	// The state is saved with the new LKID by Sync
+	st.LKID = batch.Cursor
+	res.ID = batch.Cursor
+
+	return nil
+}
+
+// screen drops the feed entries which are reserved, allowlisted or
+// protected, and returns the rest
+func (c *Client) screen(ips []string, res *Result, now time.Time) ([]string, error) {
+	reserved := netlist.Reserved()
+	override, err := c.Config.ReservedOverride()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, ip := range ips {
+		if e, ok := isReserved(reserved, override, ip); ok {
+			logging.Warning("rejecting reserved address", "ip", ip, "range", e.Net, "kind", e.Source, "action", c.Config.RESERVEDACTION)
+			res.Rejected++
+			if c.Config.RESERVEDACTION == ReservedQuarantine {
+				c.State.Quarantine(ip, e.Source+" "+e.Net.String(), now)
+			}
+			continue
+		}
+
+		if c.admit(ip, res) {
+			out = append(out, ip)
+		}
+	}
+	return out, nil
+}
+
+// admit reports whether an address from the feed may be banned, that is it
+// is neither allowlisted nor protected
+func (c *Client) admit(ip string, res *Result) bool {
+	if e, ok := c.allowed(ip); ok {
+		logging.Info("not blocking allowlisted address", "ip", ip, "match", e.Net, "source", e.Source)
+		res.Suppressed++
+		return false
+	}
+
+	if e, ok := c.isProtected(ip); ok {
+		logging.Warning("not blocking protected address", "ip", ip, "match", e.Net, "reason", e.Source)
+		res.Protected++
+		return false
+	}
+
+	return true
+}
+
+// add bans an address, reporting whether it worked
+func (c *Client) add(ip string, res *Result) bool {
+	if err := c.Backend.Add(ip); err != nil {
+		logging.Debug("adding rule failed", "ip", ip, "error", err)
+		res.Failed++
+		return false
+	}
+	logging.Debug("blocking", "ip", ip)
+	res.Added++
+	return true
+}
+
+// releaseQuarantine applies the quarantined entries which RESERVED_OVERRIDE
+// now covers
+func (c *Client) releaseQuarantine(res *Result) {
+	override, err := c.Config.ReservedOverride()
+	if err != nil {
+		return
+	}
+
+	reserved := netlist.Reserved()
+	for _, q := range c.State.Quarantined() {
+		if _, ok := isReserved(reserved, override, q.Address); ok {
+			continue
+		}
+		logging.Info("releasing quarantined address", "ip", q.Address, "since", q.Since)
+		c.State.Release(q.Address)
+		if c.admit(q.Address, res) && c.add(q.Address, res) {
+			c.State.SetApplied(q.Address, true)
+			c.banned(q.Address, source.APIBANName)
+		}
+	}
+}
+
+// isReserved returns the reserved range overlapping addr, unless override
+// covers addr.  An IPv4-mapped address is reserved as a whole, whatever
+// IPv4 address it maps.
+func isReserved(reserved, override *netlist.List, addr string) (netlist.Entry, bool) {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return netlist.Entry{}, false
+	}
+	if _, ok := override.Covers(n); ok {
+		return netlist.Entry{}, false
+	}
+	if netlist.Mapped(addr) {
+		return netlist.Entry{Net: n, Source: netlist.IPv4Mapped}, true
+	}
+	return reserved.Match(n)
+}
+
+// SetPaused stops or resumes enforcement.  Syncs carry on while paused, so
+// the bans are up to date when enforcement resumes.
+func (c *Client) SetPaused(paused bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.Backend.SetPaused(paused); err != nil {
+		return err
+	}
+	c.paused = paused
+
+	if paused {
+		logging.Info("enforcement paused")
+	} else {
+		logging.Info("enforcement resumed")
+	}
+	return nil
+}
+
+// Status describes the state of the client
+type Status struct {
+	LKID        string    `json:"lkid"`
+	Paused      bool      `json:"paused"`
+	Banned      int       `json:"banned"`
+	Rules       int       `json:"rules"`
+	LastSync    time.Time `json:"last_sync"`
+	LastSuccess time.Time `json:"last_success"`
+	LastResult  *Result   `json:"last_result,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// Protected are the addresses which are never banned
+	Protected []Protection `json:"protected"`
+
+	// Quarantined are the feed entries held back for review
+	Quarantined []state.Quarantined `json:"quarantined,omitempty"`
+
+	// Escalations are the networks banned by the escalation rules
+	Escalations []state.Escalation `json:"escalations,omitempty"`
+
+	// Manual are the bans added by hand
+	Manual []state.Manual `json:"manual,omitempty"`
+
+	// Sources are the APIBAN feed and the lists merged with it
+	Sources []SourceStatus `json:"sources"`
+}
+
+// Status returns the current state of the client
+func (c *Client) Status() (*Status, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list, err := c.Backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := c.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	st := &Status{
+		LKID:        c.State.LKID,
+		Paused:      c.paused,
+		Banned:      len(list),
+		Rules:       len(rules),
+		LastSync:    c.lastSync,
+		LastSuccess: c.lastOK,
+		LastResult:  c.last,
+		Quarantined: c.State.Quarantined(),
+		Escalations: c.State.Escalations(),
+		Manual:      c.State.Manual(),
+		Sources:     c.sourceStatus(),
+	}
+	if c.detectProtected != nil && c.Config.PROTECT {
+		st.Protected = Protections(c.detectProtected())
+	}
+	if c.lastErr != nil {
+		st.LastError = c.lastErr.Error()
+	}
+
+	return st, nil
+}
@@ -0,0 +1,541 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/apiban"
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBackend records the bans applied to it
+type fakeBackend struct {
+	cfg      firewall.Config
+	created  bool
+	added    []string
+	flushed  int
+	tornDown bool
+	paused   bool
+	allowed  []string
+}
+
+func (f *fakeBackend) Init() (bool, error) {
+	created := f.created
+	f.created = false
+	return created, nil
+}
+
+func (f *fakeBackend) Add(addr string) error {
+	if addr == "bad" {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	// Like AppendUnique, adding a rule twice leaves one
+	for _, a := range f.added {
+		if a == addr {
+			return nil
+		}
+	}
+	f.added = append(f.added, addr)
+	return nil
+}
+
+func (f *fakeBackend) Remove(addr string) error {
+	for i, a := range f.added {
+		if a == addr {
+			f.added = append(f.added[:i], f.added[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not blocked", addr)
+}
+
+func (f *fakeBackend) List() ([]string, error) {
+	return append([]string(nil), f.added...), nil
+}
+
+func (f *fakeBackend) SetPaused(paused bool) error {
+	f.paused = paused
+	return nil
+}
+
+func (f *fakeBackend) SetAllowed(addrs []string) error {
+	f.allowed = addrs
+	return nil
+}
+
+func (f *fakeBackend) Flush() error {
+	f.flushed++
+	f.added = nil
+	return nil
+}
+
+func (f *fakeBackend) Teardown() error {
+	f.tornDown = true
+	f.added = nil
+	return nil
+}
+
+// feedServer serves two pages of bans starting from ID 100
+var feedServer = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/testKey/banned/100":
+		_, _ = w.Write([]byte(`{"ipaddress":["192.0.2.1","bad","10.0.0.0/8"],"ID":"200"}`))
+	case "/testKey/banned/200":
+		_, _ = w.Write([]byte(`{"ipaddress":["192.0.2.2"],"ID":"300"}`))
+	case "/testKey/banned/300":
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"ipaddress":["no new bans"],"ID":"none"}`))
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+})
+
+func newTestClient(t *testing.T, cfg *ApibanConfig) (*Client, *fakeBackend, func()) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(feedServer)
+
+	cfg.APIKEY = "testKey"
+	// The feed serves documentation addresses
+	cfg.RESERVEDOVERRIDE = append(cfg.RESERVEDOVERRIDE, "192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24")
+	cfg.sourceFile = filepath.Join(dir, "config.json")
+
+	be := new(fakeBackend)
+	c := &Client{
+		Config:  cfg,
+		API:     &apiban.Client{HTTPClient: srv.Client(), RootURL: srv.URL + "/"},
+		Backend: be,
+		Metrics: NewMetrics(),
+		opts:    Options{StateFile: filepath.Join(dir, "state.json")},
+	}
+	c.API.Observe = c.Metrics.observeRequest
+
+	if err := c.loadState(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, be, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSync(t *testing.T) {
+	now := fmt.Sprint(time.Now().Unix())
+
+	testCases := map[string]struct {
+		cfg     ApibanConfig
+		allow   []string
+		protect []string
+		full    bool
+		created bool
+		added   []string
+		result  Result
+	}{
+		"first run": {
+			added:  []string{"192.0.2.1", "192.0.2.2"},
+			result: Result{ID: "300", Added: 2, Failed: 1, Rejected: 1},
+		},
+		"nothing new": {
+			cfg:    ApibanConfig{LKID: "300", FLUSH: now},
+			result: Result{ID: "300"},
+		},
+		"incremental": {
+			cfg:    ApibanConfig{LKID: "200", FLUSH: now},
+			added:  []string{"192.0.2.2"},
+			result: Result{ID: "300", Added: 1},
+		},
+		"full": {
+			cfg:    ApibanConfig{LKID: "300", FLUSH: now},
+			full:   true,
+			added:  []string{"192.0.2.1", "192.0.2.2"},
+			result: Result{ID: "300", Added: 2, Failed: 1, Rejected: 1},
+		},
+		"chain created": {
+			cfg:     ApibanConfig{LKID: "300", FLUSH: now},
+			created: true,
+			added:   []string{"192.0.2.1", "192.0.2.2"},
+			result:  Result{ID: "300", Added: 2, Failed: 1, Rejected: 1},
+		},
+		"flush due": {
+			cfg:    ApibanConfig{LKID: "300", FLUSH: "200"},
+			added:  []string{"192.0.2.1", "192.0.2.2"},
+			result: Result{ID: "300", Added: 2, Failed: 1, Rejected: 1, Flushed: true},
+		},
+		"allowlisted": {
+			allow:  []string{"192.0.2.0/31"},
+			added:  []string{"192.0.2.2"},
+			result: Result{ID: "300", Added: 1, Failed: 1, Rejected: 1, Suppressed: 1},
+		},
+		"protected": {
+			cfg:     ApibanConfig{PROTECT: true},
+			protect: []string{"192.0.2.2"},
+			added:   []string{"192.0.2.1"},
+			result:  Result{ID: "300", Added: 1, Failed: 1, Rejected: 1, Protected: 1},
+		},
+		"protection disabled": {
+			protect: []string{"192.0.2.2"},
+			added:   []string{"192.0.2.1", "192.0.2.2"},
+			result:  Result{ID: "300", Added: 2, Failed: 1, Rejected: 1},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := tc.cfg
+			c, be, cleanup := newTestClient(t, &cfg)
+			defer cleanup()
+			be.created = tc.created
+			for _, a := range tc.allow {
+				if c.allow == nil {
+					c.allow = new(netlist.List)
+				}
+				assert.NoError(t, c.allow.Add(a, "test"))
+			}
+			c.detectProtected = func() *netlist.List {
+				l := new(netlist.List)
+				for _, a := range tc.protect {
+					assert.NoError(t, l.Add(a, ProtectSSH))
+				}
+				return l
+			}
+
+			res, err := c.Sync(tc.full)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.result, *res)
+			assert.Equal(t, tc.added, be.added)
+			assert.Equal(t, "300", c.State.LKID)
+			assert.False(t, c.State.LastSuccess.IsZero())
+
+			saved, err := state.Load(c.State.Path())
+			assert.NoError(t, err)
+			assert.Equal(t, "300", saved.LKID)
+			assert.True(t, c.State.LastSuccess.Equal(saved.LastSuccess))
+			assert.ElementsMatch(t, tc.added, saved.Applied())
+		})
+	}
+}
+
+func TestProtected(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{PROTECT: true})
+	defer cleanup()
+	c.detectProtected = func() *netlist.List {
+		l := new(netlist.List)
+		assert.NoError(t, l.Add("203.0.113.1", ProtectGateway))
+		return l
+	}
+	be.added = []string{"203.0.113.0/24", "198.51.100.1"}
+
+	assert.EqualError(t, c.Ban("203.0.113.1", 0, ""), "203.0.113.1 is protected (203.0.113.1/32 is a default gateway)")
+	assert.Equal(t, []string{"198.51.100.1"}, be.added)
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, []Protection{{Address: "203.0.113.1/32", Reason: ProtectGateway}}, st.Protected)
+}
+
+func TestQuarantine(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{RESERVEDACTION: ReservedQuarantine})
+	defer cleanup()
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Rejected)
+	assert.NotContains(t, be.added, "10.0.0.0/8")
+	if assert.Len(t, c.State.Quarantined(), 1) {
+		assert.Equal(t, "10.0.0.0/8", c.State.Quarantined()[0].Address)
+		assert.Equal(t, "private 10.0.0.0/8", c.State.Quarantined()[0].Reason)
+	}
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	assert.Len(t, st.Quarantined, 1)
+
+	// Overriding the range releases the entry on the next sync
+	c.Config.RESERVEDOVERRIDE = append(c.Config.RESERVEDOVERRIDE, "10.0.0.0/8")
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Added)
+	assert.Contains(t, be.added, "10.0.0.0/8")
+	assert.Empty(t, c.State.Quarantined())
+	assert.True(t, c.State.IsApplied("10.0.0.0/8"))
+}
+
+func TestIsReserved(t *testing.T) {
+	override := new(netlist.List)
+	assert.NoError(t, override.Add("198.18.0.0/24", "RESERVED_OVERRIDE"))
+
+	testCases := map[string]string{
+		"45.0.0.1":        "",
+		"240.1.2.3":       netlist.Future,
+		"198.18.1.1":      netlist.Benchmarking,
+		"198.18.0.1":      "",
+		"::ffff:45.0.0.1": netlist.IPv4Mapped,
+		"::ffff:0:0/96":   netlist.IPv4Mapped,
+		"64:ff9b::1":      netlist.Translation,
+	}
+
+	for addr, kind := range testCases {
+		t.Run(addr, func(t *testing.T) {
+			e, ok := isReserved(netlist.Reserved(), override, addr)
+			assert.Equal(t, kind != "", ok)
+			assert.Equal(t, kind, e.Source)
+		})
+	}
+}
+
+func TestSyncGuard(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{MAXADDS: 1})
+	defer cleanup()
+
+	_, err := c.Sync(false)
+	assert.IsType(t, &GuardError{}, err)
+	assert.Empty(t, be.added)
+	assert.Equal(t, "100", c.State.LKID)
+	assert.True(t, c.State.IsNew())
+
+	res, err := c.ForceSync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Added)
+	assert.Equal(t, "300", c.State.LKID)
+}
+
+func TestSyncGuardRecreated(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+
+	// After a reboot the full list comes back into an empty chain; it
+	// matches what was applied before, so it is no flood of adds
+	c.Config.MAXADDS = 1
+	be.added = nil
+	be.created = true
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Added)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, be.added)
+}
+
+func TestSyncAPIError(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+	c.Config.APIKEY = "otherKey"
+
+	_, err := c.Sync(false)
+	assert.Error(t, err)
+	assert.Empty(t, be.added)
+	assert.Equal(t, "100", c.State.LKID)
+}
+
+func TestScheduleNext(t *testing.T) {
+	s := Schedule{
+		Interval: 5 * time.Minute,
+		Jitter:   30 * time.Second,
+		RetryMin: 30 * time.Second,
+		RetryMax: 5 * time.Minute,
+	}
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		d := s.next(0, rnd)
+		assert.True(t, d >= s.Interval && d < s.Interval+s.Jitter, d)
+	}
+
+	assert.Equal(t, 30*time.Second, s.next(1, rnd))
+	assert.Equal(t, time.Minute, s.next(2, rnd))
+	assert.Equal(t, 2*time.Minute, s.next(3, rnd))
+	assert.Equal(t, 4*time.Minute, s.next(4, rnd))
+	assert.Equal(t, 5*time.Minute, s.next(5, rnd))
+	assert.Equal(t, 5*time.Minute, s.next(50, rnd))
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "config.json")
+	writeConfig := func(s string) {
+		if err := ioutil.WriteFile(cfgFile, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backends []*fakeBackend
+	c := &Client{
+		opts: Options{ConfigFile: cfgFile, Firewall: firewall.Config{Chain: "APIBAN"}},
+		newBackend: func(fc firewall.Config) (Backend, error) {
+			be := &fakeBackend{cfg: fc}
+			backends = append(backends, be)
+			return be, nil
+		},
+	}
+
+	// Initial load
+	writeConfig(`{"APIKEY":"key1","LKID":"100"}`)
+	changed, err := c.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, backends, 1)
+	assert.Equal(t, "key1", c.Config.APIKEY)
+
+	// A new key keeps the backend
+	writeConfig(`{"APIKEY":"key2","LKID":"100"}`)
+	changed, err = c.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, backends, 1)
+	assert.Equal(t, "key2", c.Config.APIKEY)
+
+	// A new target replaces the backend
+	writeConfig(`{"APIKEY":"key2","TARGET":"DROP","SHARD":true}`)
+	changed, err = c.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, backends, 2)
+	assert.True(t, backends[0].tornDown)
+	assert.Equal(t, firewall.Config{
+		Chain:       "APIBAN",
+		Hooks:       []string{"INPUT", "FORWARD"},
+		Verdict:     firewall.Verdict{Target: "DROP"},
+		Sharded:     true,
+		AllowTarget: "RETURN",
+		Retire:      []string{"APIBAN_SHADOW", "APIBAN_INPUT", "APIBAN_FORWARD"},
+	}, backends[1].cfg)
+
+	// A new allowlist keeps the backend and lifts the bans it covers
+	backends[1].added = []string{"192.0.2.1", "198.51.100.1"}
+	writeConfig(`{"APIKEY":"key2","TARGET":"DROP","SHARD":true,"ALLOW":["192.0.2.0/24"]}`)
+	changed, err = c.Reload()
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Len(t, backends, 2)
+	assert.Equal(t, []string{"192.0.2.0/24"}, backends[1].allowed)
+	assert.Equal(t, []string{"198.51.100.1"}, backends[1].added)
+	assert.EqualError(t, c.Ban("192.0.2.7", 0, ""), "192.0.2.7 is allowlisted (192.0.2.0/24 from ALLOW)")
+
+	// Shadow mode for FORWARD adds the shadow chain
+	writeConfig(`{"APIKEY":"key2","TARGET":"DROP","SHARD":true,"ALLOW":["192.0.2.0/24"],"SHADOW":"FORWARD"}`)
+	changed, err = c.Reload()
+	assert.NoError(t, err)
+	assert.True(t, changed)
+	assert.Len(t, backends, 4)
+	assert.Equal(t, []string{"INPUT"}, backends[2].cfg.Hooks)
+	assert.Equal(t, "APIBAN_SHADOW", backends[3].cfg.Chain)
+	assert.Equal(t, Backend(backends[3]), c.shadow)
+	assert.Equal(t, []string{"192.0.2.0/24"}, backends[3].allowed)
+
+	// A broken file keeps the current configuration
+	writeConfig(`{"APIKEY":"MY API KEY"}`)
+	_, err = c.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, "key2", c.Config.APIKEY)
+	assert.Equal(t, Backend(tee{backends[2], backends[3]}), c.Backend)
+}
+
+// checkedBackend is a fakeBackend whose verdict iptables may not support
+type checkedBackend struct {
+	*fakeBackend
+	err error
+}
+
+func (b checkedBackend) CheckVerdict() error {
+	return b.err
+}
+
+func TestReloadVerdictCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "config.json")
+	writeConfig := func(s string) {
+		if err := ioutil.WriteFile(cfgFile, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither TARPIT nor hashlimit is available
+	var backends []*fakeBackend
+	c := &Client{
+		opts: Options{ConfigFile: cfgFile, Firewall: firewall.Config{Chain: "APIBAN"}},
+		newBackend: func(fc firewall.Config) (Backend, error) {
+			be := &fakeBackend{cfg: fc}
+			backends = append(backends, be)
+			if fc.Verdict.Target == "DROP" {
+				return be, nil
+			}
+			return checkedBackend{be, fmt.Errorf("iptables does not support the %s verdict", fc.Verdict)}, nil
+		},
+	}
+
+	// TARPIT falls back to DROP
+	writeConfig(`{"APIKEY":"key","TARGET":"TARPIT"}`)
+	_, err = c.Reload()
+	assert.NoError(t, err)
+	assert.Len(t, backends, 2)
+	assert.Equal(t, firewall.Verdict{Target: "DROP"}, backends[1].cfg.Verdict)
+	assert.Equal(t, Backend(backends[1]), c.Backend)
+
+	// Other verdicts are refused
+	writeConfig(`{"APIKEY":"key","TARGET":"LIMIT:10/minute"}`)
+	_, err = c.Reload()
+	assert.EqualError(t, err, "iptables does not support the LIMIT:10/minute verdict")
+	assert.Equal(t, Backend(backends[1]), c.Backend)
+}
+
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(cfgFile, []byte(`{"APIKEY":"key","ALLOW":["192.0.2.0/24"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	be := &fakeBackend{added: []string{"192.0.2.1", "198.51.100.1"}}
+	c := &Client{
+		opts: Options{ConfigFile: cfgFile, StateFile: filepath.Join(dir, "state.json"), ReadOnly: true},
+		newBackend: func(fc firewall.Config) (Backend, error) {
+			return be, nil
+		},
+	}
+	_, err = c.Reload()
+	assert.NoError(t, err)
+	assert.NoError(t, c.loadState())
+
+	// The allowlist is known but neither installed nor enforced
+	assert.Nil(t, be.allowed)
+	assert.Equal(t, []string{"192.0.2.1", "198.51.100.1"}, be.added)
+	_, ok := c.allowed("192.0.2.1")
+	assert.True(t, ok)
+
+	_, err = c.Sync(false)
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = c.Restore()
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Equal(t, ErrReadOnly, c.Ban("203.0.113.1", 0, ""))
+	assert.Equal(t, ErrReadOnly, c.Unban("198.51.100.1"))
+	assert.Equal(t, []string{"192.0.2.1", "198.51.100.1"}, be.added)
+}
@@ -0,0 +1,785 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix is prepended to a configuration key to form the name of the
+// environment variable which sets it
+const EnvPrefix = "APIBAN_"
+
+// Values of RESERVED_ACTION
+const (
+	// ReservedDrop discards feed entries in reserved ranges
+	ReservedDrop = "drop"
+
+	// ReservedQuarantine keeps them in the state file for review
+	ReservedQuarantine = "quarantine"
+)
+
+// Values of SHADOW_ACTION
+const (
+	// ShadowLog logs the packets from banned sources to the kernel log
+	ShadowLog = "log"
+
+	// ShadowNflog passes them to SHADOW_NFLOG_GROUP, for ulogd and the like
+	ShadowNflog = "nflog"
+
+	// ShadowCount only counts them
+	ShadowCount = "count"
+)
+
+// ApibanConfig is the client configuration.  Each setting is taken from, in
+// increasing order of precedence, its default, the configuration file, the
+// APIBAN_<KEY> environment variable and the command line.  The client never
+// writes to the file; its own state is kept in the state file.
+type ApibanConfig struct {
+	APIKEY  string
+	VERSION string
+
+	// APIKEYFILE is a file holding the API key
+	APIKEYFILE string
+
+	// LKID and FLUSH are only read to carry them over to a new state file
+	LKID  string
+	FLUSH string
+
+	// TARGET is the verdict for matching entries: DROP, REJECT,
+	// REJECT:<type>, TARPIT, LIMIT:<rate> or a chain name (see
+	// firewall.ParseVerdict)
+	TARGET string
+
+	// TARGETIN, TARGETFORWARD and TARGETOUT override TARGET for the INPUT,
+	// FORWARD and OUTPUT hooks
+	TARGETIN      string
+	TARGETFORWARD string
+	TARGETOUT     string
+
+	// SHARD enables the sharded chain layout
+	SHARD bool
+
+	// LOG is the log file, or stdout, stderr, syslog or journald
+	LOG string
+
+	// LOGLEVEL is the minimum level logged: debug, info, warning or error
+	LOGLEVEL string
+
+	// LOGFORMAT is text or json
+	LOGFORMAT string
+
+	// LOGMAXSIZE is the size in megabytes at which the log file is
+	// rotated, or 0 to leave rotation to another tool
+	LOGMAXSIZE int
+
+	// LOGMAXFILES is the number of rotated log files kept
+	LOGMAXFILES int
+
+	// ALLOW are addresses and CIDRs which are never banned
+	ALLOW []string
+
+	// ALLOWINCLUDE are files listing more addresses and CIDRs to allow, one
+	// per line.  Shell patterns are expanded.
+	ALLOWINCLUDE []string
+
+	// SOURCES are lists merged with the APIBAN feed, as
+	// name=location[;option=value...] (see source.Spec)
+	SOURCES []string
+
+	// SCORETHRESHOLD is the combined weight of the sources listing an entry
+	// at which it is banned, or 0 to ban whatever any source lists
+	SCORETHRESHOLD int
+
+	// FEEDWEIGHT is the weight of the APIBAN feed
+	FEEDWEIGHT int
+
+	// RESERVEDACTION is what happens to feed entries in reserved ranges:
+	// drop or quarantine
+	RESERVEDACTION string
+
+	// RESERVEDOVERRIDE are networks within the reserved ranges which the
+	// feed may ban
+	RESERVEDOVERRIDE []string
+
+	// AGGREGATE bans the shortest list of networks holding exactly the
+	// entries, rather than each entry
+	AGGREGATE bool
+
+	// ESCALATEV4COUNT is the number of banned IPv4 addresses within an
+	// ESCALATEV4PREFIX network at which the whole network is banned, or 0
+	ESCALATEV4COUNT  int
+	ESCALATEV4PREFIX int
+
+	// ESCALATEV6COUNT and ESCALATEV6PREFIX do the same for IPv6; a count of
+	// 1 bans the network of every banned address
+	ESCALATEV6COUNT  int
+	ESCALATEV6PREFIX int
+
+	// MAXADDS is the most entries a sync may add, or 0 for no limit
+	MAXADDS int
+
+	// MAXCHANGE is the largest change a sync may make to the current set
+	// of entries, as a percentage, or 0 for no limit
+	MAXCHANGE int
+
+	// MINPREFIXV4 and MINPREFIXV6 are the shortest prefix lengths accepted
+	// from the feed
+	MINPREFIXV4 int
+	MINPREFIXV6 int
+
+	// SHADOW are the hooks (e.g. FORWARD), or all, which only observe the
+	// banned sources: their rules log or count the packets instead of
+	// dropping them
+	SHADOW []string
+
+	// SHADOWACTION is what the rules of the shadow hooks do: log, nflog or
+	// count
+	SHADOWACTION string
+
+	// SHADOWNFLOGGROUP is the NFLOG group for SHADOW_ACTION nflog
+	SHADOWNFLOGGROUP int
+
+	// SHADOWLOGLIMIT is the rate at which the shadow rules log or pass on
+	// packets, such as 10/minute, or 0 for every packet; SHADOWLOGBURST is
+	// how many packets are logged before the rate applies
+	SHADOWLOGLIMIT string
+	SHADOWLOGBURST int
+
+	// PROTECT keeps the addresses found by DetectProtected from being
+	// banned
+	PROTECT bool
+
+	// HISTORY keeps a record of every ban in a database next to the state
+	// file (see package history)
+	HISTORY bool
+
+	// ALLOWTARGET is the target of the allow rules placed ahead of the
+	// bans: RETURN (leave the packet to the rest of the firewall) or ACCEPT
+	ALLOWTARGET string
+
+	// Warnings are problems which do not stop the client
+	Warnings []string
+
+	sourceFile string
+	sources    map[string]string
+}
+
+// setting describes a configuration key
+type setting struct {
+	key string
+
+	// secret values are redacted when shown
+	secret bool
+
+	// legacy keys are only read from configuration files written by older
+	// versions, and are not shown
+	legacy bool
+
+	// lines lists are split on newlines only, since their items may hold
+	// commas and spaces
+	lines bool
+
+	// value returns a pointer to the field holding the setting
+	value func(*ApibanConfig) interface{}
+}
+
+var settings = []setting{
+	{key: "APIKEY", secret: true, value: func(c *ApibanConfig) interface{} { return &c.APIKEY }},
+	{key: "APIKEY_FILE", value: func(c *ApibanConfig) interface{} { return &c.APIKEYFILE }},
+	{key: "TARGET", value: func(c *ApibanConfig) interface{} { return &c.TARGET }},
+	{key: "TARGET_IN", value: func(c *ApibanConfig) interface{} { return &c.TARGETIN }},
+	{key: "TARGET_FORWARD", value: func(c *ApibanConfig) interface{} { return &c.TARGETFORWARD }},
+	{key: "TARGET_OUT", value: func(c *ApibanConfig) interface{} { return &c.TARGETOUT }},
+	{key: "SHARD", value: func(c *ApibanConfig) interface{} { return &c.SHARD }},
+	{key: "ALLOW", value: func(c *ApibanConfig) interface{} { return &c.ALLOW }},
+	{key: "ALLOW_INCLUDE", value: func(c *ApibanConfig) interface{} { return &c.ALLOWINCLUDE }},
+	{key: "ALLOW_TARGET", value: func(c *ApibanConfig) interface{} { return &c.ALLOWTARGET }},
+	{key: "PROTECT", value: func(c *ApibanConfig) interface{} { return &c.PROTECT }},
+	{key: "SOURCES", lines: true, value: func(c *ApibanConfig) interface{} { return &c.SOURCES }},
+	{key: "SCORE_THRESHOLD", value: func(c *ApibanConfig) interface{} { return &c.SCORETHRESHOLD }},
+	{key: "FEED_WEIGHT", value: func(c *ApibanConfig) interface{} { return &c.FEEDWEIGHT }},
+	{key: "RESERVED_ACTION", value: func(c *ApibanConfig) interface{} { return &c.RESERVEDACTION }},
+	{key: "RESERVED_OVERRIDE", value: func(c *ApibanConfig) interface{} { return &c.RESERVEDOVERRIDE }},
+	{key: "AGGREGATE", value: func(c *ApibanConfig) interface{} { return &c.AGGREGATE }},
+	{key: "ESCALATE_V4_COUNT", value: func(c *ApibanConfig) interface{} { return &c.ESCALATEV4COUNT }},
+	{key: "ESCALATE_V4_PREFIX", value: func(c *ApibanConfig) interface{} { return &c.ESCALATEV4PREFIX }},
+	{key: "ESCALATE_V6_COUNT", value: func(c *ApibanConfig) interface{} { return &c.ESCALATEV6COUNT }},
+	{key: "ESCALATE_V6_PREFIX", value: func(c *ApibanConfig) interface{} { return &c.ESCALATEV6PREFIX }},
+	{key: "MAX_ADDS", value: func(c *ApibanConfig) interface{} { return &c.MAXADDS }},
+	{key: "MAX_CHANGE", value: func(c *ApibanConfig) interface{} { return &c.MAXCHANGE }},
+	{key: "MIN_PREFIX_V4", value: func(c *ApibanConfig) interface{} { return &c.MINPREFIXV4 }},
+	{key: "MIN_PREFIX_V6", value: func(c *ApibanConfig) interface{} { return &c.MINPREFIXV6 }},
+	{key: "SHADOW", value: func(c *ApibanConfig) interface{} { return &c.SHADOW }},
+	{key: "SHADOW_ACTION", value: func(c *ApibanConfig) interface{} { return &c.SHADOWACTION }},
+	{key: "SHADOW_NFLOG_GROUP", value: func(c *ApibanConfig) interface{} { return &c.SHADOWNFLOGGROUP }},
+	{key: "SHADOW_LOG_LIMIT", value: func(c *ApibanConfig) interface{} { return &c.SHADOWLOGLIMIT }},
+	{key: "SHADOW_LOG_BURST", value: func(c *ApibanConfig) interface{} { return &c.SHADOWLOGBURST }},
+	{key: "HISTORY", value: func(c *ApibanConfig) interface{} { return &c.HISTORY }},
+	{key: "LOG", value: func(c *ApibanConfig) interface{} { return &c.LOG }},
+	{key: "LOG_LEVEL", value: func(c *ApibanConfig) interface{} { return &c.LOGLEVEL }},
+	{key: "LOG_FORMAT", value: func(c *ApibanConfig) interface{} { return &c.LOGFORMAT }},
+	{key: "LOG_MAX_SIZE", value: func(c *ApibanConfig) interface{} { return &c.LOGMAXSIZE }},
+	{key: "LOG_MAX_FILES", value: func(c *ApibanConfig) interface{} { return &c.LOGMAXFILES }},
+	{key: "VERSION", value: func(c *ApibanConfig) interface{} { return &c.VERSION }},
+	{key: "LKID", legacy: true, value: func(c *ApibanConfig) interface{} { return &c.LKID }},
+	{key: "FLUSH", legacy: true, value: func(c *ApibanConfig) interface{} { return &c.FLUSH }},
+	{key: "LASTSYNC", legacy: true},
+}
+
+// DefaultConfig returns the configuration before any file, environment
+// variable or flag is applied
+func DefaultConfig() *ApibanConfig {
+	cfg := &ApibanConfig{
+		TARGET:           "REJECT",
+		ALLOWTARGET:      "RETURN",
+		PROTECT:          true,
+		HISTORY:          true,
+		FEEDWEIGHT:       1,
+		RESERVEDACTION:   ReservedDrop,
+		ESCALATEV4PREFIX: 24,
+		ESCALATEV6PREFIX: 64,
+		MAXADDS:          20000,
+		MINPREFIXV4:      16,
+		MINPREFIXV6:      32,
+		SHADOWACTION:     ShadowLog,
+		SHADOWLOGLIMIT:   "10/minute",
+		SHADOWLOGBURST:   20,
+		LOG:              "/var/log/apiban-client.log",
+		LOGLEVEL:         "info",
+		LOGFORMAT:        "text",
+		LOGMAXSIZE:       10,
+		LOGMAXFILES:      5,
+		sources:          map[string]string{},
+	}
+	for _, s := range settings {
+		cfg.sources[s.key] = "default"
+	}
+	return cfg
+}
+
+// set parses and stores the value of a key
+func (cfg *ApibanConfig) set(key, value, source string) error {
+	for _, s := range settings {
+		if s.key != key {
+			continue
+		}
+
+		if s.value == nil {
+			return nil
+		}
+
+		switch p := s.value(cfg).(type) {
+		case *string:
+			*p = value
+		case *[]string:
+			if s.lines {
+				*p = splitLines(value)
+			} else {
+				*p = splitList(value)
+			}
+		case *int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid number %q", key, value)
+			}
+			*p = n
+		case *bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid boolean %q", key, value)
+			}
+			*p = b
+		}
+
+		cfg.sources[key] = source
+		return nil
+	}
+
+	return fmt.Errorf("unknown setting %q", key)
+}
+
+// configFormats are the extensions tried at each search location
+var configFormats = []string{".json", ".yaml", ".yml", ".toml"}
+
+// findConfig returns the configuration file to use, or "" if there is none.
+// If configFileLocation is not empty, it must exist.
+func findConfig(configFileLocation string) (string, error) {
+	if configFileLocation != "" {
+		if _, err := os.Stat(configFileLocation); err != nil {
+			return "", fmt.Errorf("failed to read configuration: %w", err)
+		}
+		return configFileLocation, nil
+	}
+
+	var dirs []string
+
+	// If we can determine the user configuration directory, try there
+	configDir, err := os.UserConfigDir()
+	if err == nil {
+		dirs = append(dirs, filepath.Join(configDir, "apiban"))
+	}
+
+	// Add standard static locations
+	dirs = append(dirs,
+		"/etc/apiban",
+		".",
+		"/usr/local/bin/apiban",
+	)
+
+	for _, dir := range dirs {
+		for _, ext := range configFormats {
+			loc := filepath.Join(dir, "config"+ext)
+			if _, err := os.Stat(loc); err == nil {
+				return loc, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
+// readConfigFile decodes a JSON, YAML or TOML file, chosen by its extension,
+// into a flat set of keys and values
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &raw)
+	case ".toml":
+		_, err = toml.Decode(string(data), &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		key := strings.ToUpper(k)
+		switch v := v.(type) {
+		case nil:
+			values[key] = ""
+		case string:
+			values[key] = v
+		case bool, int, int64, float64:
+			values[key] = fmt.Sprint(v)
+		case []interface{}:
+			if !isList(key) {
+				return nil, fmt.Errorf("%s: must be a single value", key)
+			}
+
+			// Lists are passed on like environment variables, comma
+			// or newline separated
+			var items []string
+			for _, item := range v {
+				switch item.(type) {
+				case string, int, int64, float64:
+					items = append(items, fmt.Sprint(item))
+				default:
+					return nil, fmt.Errorf("%s: must be a list of single values", key)
+				}
+			}
+			sep := ","
+			if isLines(key) {
+				sep = "\n"
+			}
+			values[key] = strings.Join(items, sep)
+		default:
+			return nil, fmt.Errorf("%s: must be a single value", key)
+		}
+	}
+	return values, nil
+}
+
+// LoadConfig builds the configuration from the defaults, the configuration
+// file, the environment and overrides (typically from the command line, keyed
+// like the file).  The configuration file is searched for in various
+// locations; if configFileLocation is not empty, it is used instead.  The
+// result is not validated.
+func LoadConfig(configFileLocation string, overrides map[string]string) (*ApibanConfig, error) {
+	cfg := DefaultConfig()
+
+	loc, err := findConfig(configFileLocation)
+	if err != nil {
+		return nil, err
+	}
+
+	if loc != "" {
+		values, err := readConfigFile(loc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read configuration from %s: %w", loc, err)
+		}
+
+		// Apply the keys in order, so errors are reported consistently
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if err := cfg.set(k, values[k], loc); err != nil {
+				return nil, fmt.Errorf("invalid configuration in %s: %w", loc, err)
+			}
+		}
+
+		// Store the location of the config file for the logs
+		cfg.sourceFile = loc
+	}
+
+	for _, s := range settings {
+		if s.legacy {
+			continue
+		}
+
+		name := EnvPrefix + s.key
+		if v, ok := os.LookupEnv(name); ok {
+			if err := cfg.set(s.key, v, name); err != nil {
+				return nil, fmt.Errorf("invalid environment variable %s: %w", name, err)
+			}
+		}
+	}
+
+	for k, v := range overrides {
+		if err := cfg.set(k, v, "command line"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadKey(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration, reporting every problem found
+func (cfg *ApibanConfig) Validate() error {
+	var problems []string
+
+	switch {
+	case cfg.APIKEY == "":
+		problems = append(problems, "APIKEY is not set (set APIKEY or APIKEY_FILE)")
+	case cfg.APIKEY == "MY API KEY":
+		problems = append(problems, "APIKEY is still the example key: go to apiban.org and get an api key")
+	case strings.ContainsAny(cfg.APIKEY, " \t\r\n/?#"):
+		problems = append(problems, "APIKEY contains invalid characters")
+	}
+
+	if cfg.ALLOWTARGET != "RETURN" && cfg.ALLOWTARGET != "ACCEPT" {
+		problems = append(problems, fmt.Sprintf("ALLOW_TARGET %q is not RETURN or ACCEPT", cfg.ALLOWTARGET))
+	}
+
+	for _, t := range cfg.targets() {
+		if t.value == "" {
+			continue
+		}
+		v, err := firewall.ParseVerdict(t.value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", t.key, err))
+		} else if v.Target == cfg.ALLOWTARGET {
+			problems = append(problems, fmt.Sprintf("ALLOW_TARGET and %s must differ", t.key))
+		}
+	}
+
+	if _, err := cfg.Allowlist(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if specs, err := cfg.Sources(); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		for _, spec := range specs {
+			if _, err := spec.Allowlist(); err != nil {
+				problems = append(problems, fmt.Sprintf("SOURCES: %v", err))
+			}
+		}
+	}
+
+	if cfg.SCORETHRESHOLD < 0 || cfg.FEEDWEIGHT < 0 {
+		problems = append(problems, "SCORE_THRESHOLD and FEED_WEIGHT must not be negative")
+	}
+
+	if cfg.RESERVEDACTION != ReservedDrop && cfg.RESERVEDACTION != ReservedQuarantine {
+		problems = append(problems, fmt.Sprintf("RESERVED_ACTION %q is not drop or quarantine", cfg.RESERVEDACTION))
+	}
+
+	if _, err := cfg.ReservedOverride(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if cfg.ESCALATEV4COUNT < 0 || cfg.ESCALATEV6COUNT < 0 {
+		problems = append(problems, "ESCALATE_V4_COUNT and ESCALATE_V6_COUNT must not be negative")
+	}
+	if cfg.ESCALATEV4COUNT > 0 && (cfg.ESCALATEV4PREFIX < 8 || cfg.ESCALATEV4PREFIX > 31) {
+		problems = append(problems, fmt.Sprintf("ESCALATE_V4_PREFIX %d is not between 8 and 31", cfg.ESCALATEV4PREFIX))
+	}
+	if cfg.ESCALATEV6COUNT > 0 && (cfg.ESCALATEV6PREFIX < 16 || cfg.ESCALATEV6PREFIX > 127) {
+		problems = append(problems, fmt.Sprintf("ESCALATE_V6_PREFIX %d is not between 16 and 127", cfg.ESCALATEV6PREFIX))
+	}
+
+	if cfg.MAXADDS < 0 {
+		problems = append(problems, "MAX_ADDS must not be negative")
+	}
+	if cfg.MAXCHANGE < 0 {
+		problems = append(problems, "MAX_CHANGE must not be negative")
+	}
+	if cfg.MINPREFIXV4 < 0 || cfg.MINPREFIXV4 > 32 {
+		problems = append(problems, fmt.Sprintf("MIN_PREFIX_V4 %d is not between 0 and 32", cfg.MINPREFIXV4))
+	}
+	if cfg.MINPREFIXV6 < 0 || cfg.MINPREFIXV6 > 128 {
+		problems = append(problems, fmt.Sprintf("MIN_PREFIX_V6 %d is not between 0 and 128", cfg.MINPREFIXV6))
+	}
+
+	for _, hook := range cfg.SHADOW {
+		if hook != "all" && !firewall.IsChainName(hook) {
+			problems = append(problems, fmt.Sprintf("SHADOW %q is not a chain name or all", hook))
+		}
+	}
+	if cfg.SHADOWACTION != ShadowLog && cfg.SHADOWACTION != ShadowNflog && cfg.SHADOWACTION != ShadowCount {
+		problems = append(problems, fmt.Sprintf("SHADOW_ACTION %q is not log, nflog or count", cfg.SHADOWACTION))
+	}
+	if cfg.SHADOWNFLOGGROUP < 0 || cfg.SHADOWNFLOGGROUP > 65535 {
+		problems = append(problems, fmt.Sprintf("SHADOW_NFLOG_GROUP %d is not between 0 and 65535", cfg.SHADOWNFLOGGROUP))
+	}
+	if l := cfg.SHADOWLOGLIMIT; l != "" && l != "0" && !firewall.IsRate(l) {
+		problems = append(problems, fmt.Sprintf("SHADOW_LOG_LIMIT %q is not a rate such as 10/minute, or 0", l))
+	}
+	if cfg.SHADOWLOGBURST < 1 {
+		problems = append(problems, fmt.Sprintf("SHADOW_LOG_BURST %d is not a number from 1", cfg.SHADOWLOGBURST))
+	}
+
+	if _, err := logging.ParseLevel(cfg.LOGLEVEL); err != nil {
+		problems = append(problems, fmt.Sprintf("LOG_LEVEL %q is not debug, info, warning or error", cfg.LOGLEVEL))
+	}
+
+	if _, err := logging.ParseFormat(cfg.LOGFORMAT); err != nil {
+		problems = append(problems, fmt.Sprintf("LOG_FORMAT %q is not text or json", cfg.LOGFORMAT))
+	}
+
+	if cfg.LOG == "" {
+		problems = append(problems, "LOG is not set")
+	}
+
+	if cfg.LOGMAXSIZE < 0 || cfg.LOGMAXFILES < 0 {
+		problems = append(problems, "LOG_MAX_SIZE and LOG_MAX_FILES must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Allowlist returns the networks which are never banned, from ALLOW and the
+// ALLOW_INCLUDE files
+func (cfg *ApibanConfig) Allowlist() (*netlist.List, error) {
+	l := new(netlist.List)
+	for _, addr := range cfg.ALLOW {
+		if err := l.Add(addr, "ALLOW"); err != nil {
+			return nil, fmt.Errorf("ALLOW: %v", err)
+		}
+	}
+
+	for _, pattern := range cfg.ALLOWINCLUDE {
+		files, err := netlist.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("ALLOW_INCLUDE: %v", err)
+		}
+
+		for _, file := range files {
+			addrs, err := netlist.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("ALLOW_INCLUDE: %v", err)
+			}
+			for _, addr := range addrs {
+				if err := l.Add(addr, file); err != nil {
+					return nil, fmt.Errorf("ALLOW_INCLUDE: %s: %v", file, err)
+				}
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// Sources returns the lists to merge with the APIBAN feed
+func (cfg *ApibanConfig) Sources() ([]*source.Spec, error) {
+	var out []*source.Spec
+	seen := map[string]bool{}
+	for _, s := range cfg.SOURCES {
+		spec, err := source.ParseSpec(s)
+		if err != nil {
+			return nil, fmt.Errorf("SOURCES: %v", err)
+		}
+		if seen[spec.Name] {
+			return nil, fmt.Errorf("SOURCES: %q is used twice", spec.Name)
+		}
+		seen[spec.Name] = true
+		out = append(out, spec)
+	}
+	return out, nil
+}
+
+// ReservedOverride returns the networks within the reserved ranges which the
+// feed may ban
+func (cfg *ApibanConfig) ReservedOverride() (*netlist.List, error) {
+	l := new(netlist.List)
+	for _, addr := range cfg.RESERVEDOVERRIDE {
+		if err := l.Add(addr, "RESERVED_OVERRIDE"); err != nil {
+			return nil, fmt.Errorf("RESERVED_OVERRIDE: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// Logging returns the logging settings
+func (cfg *ApibanConfig) Logging() (logging.Config, error) {
+	level, err := logging.ParseLevel(cfg.LOGLEVEL)
+	if err != nil {
+		return logging.Config{}, err
+	}
+
+	format, err := logging.ParseFormat(cfg.LOGFORMAT)
+	if err != nil {
+		return logging.Config{}, err
+	}
+
+	return logging.Config{
+		Output:     cfg.LOG,
+		Level:      level,
+		Format:     format,
+		MaxSize:    int64(cfg.LOGMAXSIZE) << 20,
+		MaxFiles:   cfg.LOGMAXFILES,
+		Identifier: "apiban-client",
+	}, nil
+}
+
+// Setting is one effective configuration value, as shown to the user
+type Setting struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// Settings returns the effective configuration with secrets redacted
+func (cfg *ApibanConfig) Settings() []Setting {
+	var out []Setting
+	for _, s := range settings {
+		if s.legacy {
+			continue
+		}
+
+		v := fmt.Sprint(settingValue(s.value(cfg)))
+		if s.secret {
+			v = Redact(v)
+		}
+
+		out = append(out, Setting{Key: s.key, Value: v, Source: cfg.sources[s.key]})
+	}
+	return out
+}
+
+// settingValue dereferences a setting field
+func settingValue(p interface{}) interface{} {
+	switch p := p.(type) {
+	case *string:
+		return *p
+	case *[]string:
+		return strings.Join(*p, ", ")
+	case *int:
+		return *p
+	case *bool:
+		return *p
+	}
+	return nil
+}
+
+// isList reports whether key is a list setting
+func isList(key string) bool {
+	for _, s := range settings {
+		if s.key == key && s.value != nil {
+			_, ok := s.value(new(ApibanConfig)).(*[]string)
+			return ok
+		}
+	}
+	return false
+}
+
+// isLines reports whether key is a list setting split on newlines only
+func isLines(key string) bool {
+	for _, s := range settings {
+		if s.key == key {
+			return s.lines
+		}
+	}
+	return false
+}
+
+// splitLines splits a list setting on newlines, trimming the white space
+// around each item
+func splitLines(s string) []string {
+	var out []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// splitList splits a list setting on commas and white space
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// Redact hides all but the last four characters of a secret
+func Redact(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return strings.Repeat("*", 8) + s[len(s)-4:]
+}
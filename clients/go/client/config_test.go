@@ -0,0 +1,404 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	testCases := map[string]struct {
+		file      string
+		data      string
+		env       map[string]string
+		overrides map[string]string
+		want      []Setting
+		err       string
+	}{
+		"json": {
+			file: "config.json",
+			data: `{"APIKEY":"abcdef0123456789","LKID":"100","VERSION":"0.7","FLUSH":"200"}`,
+			want: []Setting{
+				{Key: "APIKEY", Value: "********6789", Source: "config.json"},
+				{Key: "APIKEY_FILE", Value: "", Source: "default"},
+				{Key: "TARGET", Value: "REJECT", Source: "default"},
+				{Key: "SHARD", Value: "false", Source: "default"},
+				{Key: "VERSION", Value: "0.7", Source: "config.json"},
+			},
+		},
+		"yaml": {
+			file: "config.yaml",
+			data: "apikey: abcdef0123456789\ntarget: DROP\nshard: true\n",
+			want: []Setting{
+				{Key: "APIKEY", Value: "********6789", Source: "config.yaml"},
+				{Key: "APIKEY_FILE", Value: "", Source: "default"},
+				{Key: "TARGET", Value: "DROP", Source: "config.yaml"},
+				{Key: "SHARD", Value: "true", Source: "config.yaml"},
+				{Key: "VERSION", Value: "", Source: "default"},
+			},
+		},
+		"lists": {
+			file: "config.yaml",
+			data: "apikey: abcdef0123456789\nallow:\n  - 192.0.2.1\n  - 2001:db8::/32\n",
+			env:  map[string]string{"APIBAN_ALLOW_INCLUDE": "/etc/apiban/allow.d/*, /etc/apiban/office"},
+			want: []Setting{
+				{Key: "ALLOW", Value: "192.0.2.1, 2001:db8::/32", Source: "config.yaml"},
+				{Key: "ALLOW_INCLUDE", Value: "/etc/apiban/allow.d/*, /etc/apiban/office", Source: "APIBAN_ALLOW_INCLUDE"},
+				{Key: "ALLOW_TARGET", Value: "RETURN", Source: "default"},
+			},
+		},
+		"toml": {
+			file: "config.toml",
+			data: "APIKEY = \"abcdef0123456789\"\nSHARD = true\n",
+			want: []Setting{
+				{Key: "APIKEY", Value: "********6789", Source: "config.toml"},
+				{Key: "APIKEY_FILE", Value: "", Source: "default"},
+				{Key: "TARGET", Value: "REJECT", Source: "default"},
+				{Key: "SHARD", Value: "true", Source: "config.toml"},
+				{Key: "VERSION", Value: "", Source: "default"},
+			},
+		},
+		"precedence": {
+			file:      "config.json",
+			data:      `{"APIKEY":"abcdef0123456789","TARGET":"DROP","SHARD":true}`,
+			env:       map[string]string{"APIBAN_TARGET": "ACCEPT", "APIBAN_SHARD": "false"},
+			overrides: map[string]string{"TARGET": "RETURN"},
+			want: []Setting{
+				{Key: "APIKEY", Value: "********6789", Source: "config.json"},
+				{Key: "APIKEY_FILE", Value: "", Source: "default"},
+				{Key: "TARGET", Value: "RETURN", Source: "command line"},
+				{Key: "SHARD", Value: "false", Source: "APIBAN_SHARD"},
+				{Key: "VERSION", Value: "", Source: "default"},
+			},
+		},
+		"unknown key": {
+			file: "config.yaml",
+			data: "apikey: abc\ntagret: DROP\n",
+			err:  `invalid configuration in config.yaml: unknown setting "TAGRET"`,
+		},
+		"nested value": {
+			file: "config.json",
+			data: `{"APIKEY":["a","b"]}`,
+			err:  "failed to read configuration from config.json: APIKEY: must be a single value",
+		},
+		"bad environment": {
+			file: "config.json",
+			data: `{"APIKEY":"abc"}`,
+			env:  map[string]string{"APIBAN_SHARD": "maybe"},
+			err:  `invalid environment variable APIBAN_SHARD: SHARD: invalid boolean "maybe"`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "apiban")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, tc.file)
+			if err := ioutil.WriteFile(path, []byte(tc.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			for k, v := range tc.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+
+			cfg, err := LoadConfig(path, tc.overrides)
+			if tc.err != "" {
+				assert.EqualError(t, err, replacePath(tc.err, tc.file, path))
+				return
+			}
+			assert.NoError(t, err)
+
+			got := map[string]Setting{}
+			for _, s := range cfg.Settings() {
+				got[s.Key] = s
+			}
+			for _, want := range tc.want {
+				want.Source = replacePath(want.Source, tc.file, path)
+				assert.Equal(t, want, got[want.Key])
+			}
+		})
+	}
+}
+
+func TestLoadConfigSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Commas and spaces are part of the specs
+	path := filepath.Join(dir, "config.yaml")
+	data := "apikey: abcdef0123456789\nsources:\n  - feed=https://lists.example.com/get?fmt=txt,v4&days=7;refresh=2h\n  - local=/etc/apiban/my list.txt\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"feed=https://lists.example.com/get?fmt=txt,v4&days=7;refresh=2h", "local=/etc/apiban/my list.txt"}, cfg.SOURCES)
+	assert.NoError(t, cfg.Validate())
+
+	// The environment takes one spec per line
+	os.Setenv("APIBAN_SOURCES", "feed=https://lists.example.com/get?fmt=txt,v4\n  drop=https://www.spamhaus.org/drop/drop.txt\n")
+	defer os.Unsetenv("APIBAN_SOURCES")
+	cfg, err = LoadConfig(path, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"feed=https://lists.example.com/get?fmt=txt,v4", "drop=https://www.spamhaus.org/drop/drop.txt"}, cfg.SOURCES)
+}
+
+// replacePath puts the full path of the test file into an expectation
+func replacePath(s, file, path string) string {
+	return strings.Replace(s, file, path, 1)
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	_, err := LoadConfig("/nonexistent/apiban.json", nil)
+	assert.Error(t, err)
+}
+
+func TestLoadKey(t *testing.T) {
+	testCases := map[string]struct {
+		mode       os.FileMode
+		credential bool
+		source     string
+		warnings   int
+		err        string
+	}{
+		"key file": {
+			mode:   0600,
+			source: "APIBAN_APIKEY_FILE",
+		},
+		"group readable": {
+			mode:     0640,
+			source:   "APIBAN_APIKEY_FILE",
+			warnings: 1,
+		},
+		"world readable": {
+			mode: 0644,
+			err:  "failed to read API key: KEYFILE is readable by all users (mode 0644); run chmod 600 KEYFILE",
+		},
+		"group writable": {
+			mode: 0620,
+			err:  "failed to read API key: KEYFILE is writable by other users (mode 0620); run chmod 600 KEYFILE",
+		},
+		"systemd credential": {
+			mode:       0400,
+			credential: true,
+			source:     "systemd credential apikey",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "apiban")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			cfgFile := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(cfgFile, []byte(`{"APIKEY":"fromconfig"}`), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			keyFile := filepath.Join(dir, "key")
+			if tc.credential {
+				keyFile = filepath.Join(dir, CredentialName)
+				os.Setenv("CREDENTIALS_DIRECTORY", dir)
+				defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+			} else {
+				os.Setenv("APIBAN_APIKEY_FILE", keyFile)
+				defer os.Unsetenv("APIBAN_APIKEY_FILE")
+			}
+
+			if err := ioutil.WriteFile(keyFile, []byte("fromfile\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(keyFile, tc.mode); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadConfig(cfgFile, nil)
+			if tc.err != "" {
+				assert.EqualError(t, err, strings.Replace(tc.err, "KEYFILE", keyFile, -1))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "fromfile", cfg.APIKEY)
+			assert.Equal(t, tc.source, cfg.sources["APIKEY"])
+			assert.Len(t, cfg.Warnings, tc.warnings)
+		})
+	}
+}
+
+func TestLoadKeyExposed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(cfgFile, []byte(`{"APIKEY":"fromconfig"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(cfgFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(cfgFile, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "fromconfig", cfg.APIKEY)
+	assert.Len(t, cfg.Warnings, 1)
+}
+
+func TestAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	office := filepath.Join(dir, "office.txt")
+	if err := ioutil.WriteFile(office, []byte("# office\n198.51.100.0/24\n\n203.0.113.7 # vpn\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.ALLOW = []string{"192.0.2.1"}
+	cfg.ALLOWINCLUDE = []string{filepath.Join(dir, "*.txt")}
+
+	l, err := cfg.Allowlist()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1/32", "198.51.100.0/24", "203.0.113.7/32"}, l.Strings())
+
+	e, ok := l.Match(&net.IPNet{IP: net.ParseIP("198.51.100.9").To4(), Mask: net.CIDRMask(32, 32)})
+	assert.True(t, ok)
+	assert.Equal(t, office, e.Source)
+
+	cfg.ALLOWINCLUDE = []string{filepath.Join(dir, "missing.txt")}
+	_, err = cfg.Allowlist()
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	testCases := map[string]struct {
+		key      string
+		target   string
+		level    string
+		allow    []string
+		override []string
+		shadow   []string
+		limit    string
+		in       string
+		sources  []string
+		err      string
+	}{
+		"ok": {
+			key: "abc", target: "MY-CHAIN",
+		},
+		"no key": {
+			target: "REJECT",
+			err:    "invalid configuration: APIKEY is not set (set APIKEY or APIKEY_FILE)",
+		},
+		"example key and bad target": {
+			key: "MY API KEY", target: "RE JECT",
+			err: `invalid configuration: APIKEY is still the example key: go to apiban.org and get an api key; TARGET: "RE JECT" is not a valid verdict or chain name`,
+		},
+		"bad log level": {
+			key:    "abc",
+			target: "DROP",
+			level:  "verbose",
+			err:    `invalid configuration: LOG_LEVEL "verbose" is not debug, info, warning or error`,
+		},
+		"key with slash": {
+			key: "abc/def", target: "DROP",
+			err: "invalid configuration: APIKEY contains invalid characters",
+		},
+		"bad allow entry": {
+			key: "abc", target: "DROP",
+			allow: []string{"192.0.2.0/24", "office"},
+			err:   `invalid configuration: ALLOW: invalid address "office"`,
+		},
+		"bad reserved override": {
+			key: "abc", target: "DROP",
+			override: []string{"10.0.0.0/33"},
+			err:      `invalid configuration: RESERVED_OVERRIDE: invalid address "10.0.0.0/33"`,
+		},
+		"bad shadow hook": {
+			key: "abc", target: "DROP",
+			shadow: []string{"FORWARD", "pre routing"},
+			err:    `invalid configuration: SHADOW "pre routing" is not a chain name or all`,
+		},
+		"bad shadow limit": {
+			key: "abc", target: "DROP",
+			shadow: []string{"FORWARD"}, limit: "10/fortnight",
+			err: `invalid configuration: SHADOW_LOG_LIMIT "10/fortnight" is not a rate such as 10/minute, or 0`,
+		},
+		"unlimited shadow": {
+			key: "abc", target: "DROP",
+			shadow: []string{"FORWARD"}, limit: "0",
+		},
+		"bad inbound target": {
+			key: "abc", target: "DROP",
+			in:  "REJECT:tcp-rst",
+			err: `invalid configuration: TARGET_IN: unknown REJECT type "tcp-rst" (port-unreachable, host-unreachable, net-unreachable, admin-prohibited or tcp-reset)`,
+		},
+		"sources": {
+			key: "abc", target: "DROP",
+			sources: []string{"drop=https://www.spamhaus.org/drop/drop.txt;refresh=12h", "local=/etc/apiban/blocklist.txt"},
+		},
+		"duplicate source": {
+			key: "abc", target: "DROP",
+			sources: []string{"drop=https://www.spamhaus.org/drop/drop.txt", "drop=/etc/apiban/drop.txt"},
+			err:     `invalid configuration: SOURCES: "drop" is used twice`,
+		},
+		"bad source allowlist": {
+			key: "abc", target: "DROP",
+			sources: []string{"local=/etc/apiban/blocklist.txt;allow=/nonexistent/allow.txt"},
+			err:     "invalid configuration: SOURCES: local: open /nonexistent/allow.txt: no such file or directory",
+		},
+		"allow target same as target": {
+			key: "abc", target: "RETURN",
+			err: "invalid configuration: ALLOW_TARGET and TARGET must differ",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.APIKEY = tc.key
+			cfg.TARGET = tc.target
+			if tc.level != "" {
+				cfg.LOGLEVEL = tc.level
+			}
+			cfg.ALLOW = tc.allow
+			cfg.RESERVEDOVERRIDE = tc.override
+			cfg.SHADOW = tc.shadow
+			if tc.limit != "" {
+				cfg.SHADOWLOGLIMIT = tc.limit
+			}
+			cfg.TARGETIN = tc.in
+			cfg.SOURCES = tc.sources
+
+			err := cfg.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/palner/apiban/clients/go/logging"
+)
+
+// DefaultSocket is the default location of the control socket
+const DefaultSocket = "/run/apiban/control.sock"
+
+type connKey struct{}
+
+// controlRequest is the body of the POST requests of the control API
+type controlRequest struct {
+	Address string        `json:"address,omitempty"`
+	For     time.Duration `json:"for,omitempty"`
+	Reason  string        `json:"reason,omitempty"`
+	Full    bool          `json:"full,omitempty"`
+	Force   bool          `json:"force,omitempty"`
+}
+
+// controlResponse is the body of every control API response
+type controlResponse struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// ControlServer serves the control API on a Unix socket
+type ControlServer struct {
+	srv  *http.Server
+	path string
+}
+
+// ServeControl starts the control API on the Unix socket at path.  The socket
+// is only accessible to its owner, and requests are only accepted from root
+// or from the user running the client.
+func (c *Client) ServeControl(path string) (*ControlServer, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create control socket directory: %w", err)
+	}
+
+	// Remove a socket left behind by an earlier run
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to set control socket permissions: %w", err)
+	}
+
+	cs := &ControlServer{
+		path: path,
+		srv: &http.Server{
+			Handler: authorize(c.controlHandler()),
+			ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+				return context.WithValue(ctx, connKey{}, conn)
+			},
+			ReadTimeout: 10 * time.Second,
+		},
+	}
+
+	go func() {
+		if err := cs.srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logging.Error("control socket failed", "error", err)
+		}
+	}()
+
+	logging.Info("control API listening", "socket", path)
+	return cs, nil
+}
+
+// Close stops the control API and removes the socket
+func (cs *ControlServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := cs.srv.Shutdown(ctx)
+	os.Remove(cs.path)
+	return err
+}
+
+// authorize only lets requests from root or our own user through
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := r.Context().Value(connKey{}).(net.Conn)
+		if err := checkPeer(conn); err != nil {
+			writeControl(w, http.StatusForbidden, nil, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *Client) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/v1/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeControl(w, http.StatusMethodNotAllowed, nil, errors.New("method not allowed"))
+			return
+		}
+		st, err := c.Status()
+		writeControl(w, http.StatusOK, st, err)
+	})
+
+	post := func(path string, fn func(req *controlRequest) (interface{}, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				writeControl(w, http.StatusMethodNotAllowed, nil, errors.New("method not allowed"))
+				return
+			}
+
+			req := new(controlRequest)
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+					writeControl(w, http.StatusBadRequest, nil, fmt.Errorf("failed to decode request: %w", err))
+					return
+				}
+			}
+
+			result, err := fn(req)
+			logging.Info("control request", "path", path, "address", req.Address, "result", outcome(err))
+			writeControl(w, http.StatusOK, result, err)
+		})
+	}
+
+	post("/v1/sync", func(req *controlRequest) (interface{}, error) {
+		if req.Force {
+			return c.ForceSync(req.Full)
+		}
+		return c.Sync(req.Full)
+	})
+	post("/v1/ban", func(req *controlRequest) (interface{}, error) {
+		return nil, c.Ban(req.Address, req.For, req.Reason)
+	})
+	post("/v1/unban", func(req *controlRequest) (interface{}, error) {
+		return nil, c.Unban(req.Address)
+	})
+	post("/v1/pause", func(req *controlRequest) (interface{}, error) {
+		return nil, c.SetPaused(true)
+	})
+	post("/v1/resume", func(req *controlRequest) (interface{}, error) {
+		return nil, c.SetPaused(false)
+	})
+
+	return mux
+}
+
+func writeControl(w http.ResponseWriter, code int, result interface{}, err error) {
+	resp := controlResponse{OK: err == nil, Result: result}
+	if err != nil {
+		resp.Error = err.Error()
+		if code == http.StatusOK {
+			code = http.StatusUnprocessableEntity
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "failed: " + err.Error()
+	}
+	return "ok"
+}
+
+// ControlClient talks to the control API of a running client
+type ControlClient struct {
+	hc *http.Client
+}
+
+// NewControlClient returns a ControlClient for the socket at path
+func NewControlClient(path string) *ControlClient {
+	return &ControlClient{
+		hc: &http.Client{
+			Timeout: 5 * time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}
+}
+
+// Status returns the status of the running client
+func (cc *ControlClient) Status() (*Status, error) {
+	st := new(Status)
+	return st, cc.do(http.MethodGet, "/v1/status", nil, st)
+}
+
+// Sync triggers a sync and returns its result
+func (cc *ControlClient) Sync(full bool) (*Result, error) {
+	res := new(Result)
+	return res, cc.do(http.MethodPost, "/v1/sync", &controlRequest{Full: full}, res)
+}
+
+// ForceSync triggers a sync which skips the sanity checks
+func (cc *ControlClient) ForceSync(full bool) (*Result, error) {
+	res := new(Result)
+	return res, cc.do(http.MethodPost, "/v1/sync", &controlRequest{Full: full, Force: true}, res)
+}
+
+// Ban blocks an address or CIDR for d, or until it is unbanned if d is 0
+func (cc *ControlClient) Ban(addr string, d time.Duration, reason string) error {
+	return cc.do(http.MethodPost, "/v1/ban", &controlRequest{Address: addr, For: d, Reason: reason}, nil)
+}
+
+// Unban lifts the ban on an address or CIDR
+func (cc *ControlClient) Unban(addr string) error {
+	return cc.do(http.MethodPost, "/v1/unban", &controlRequest{Address: addr}, nil)
+}
+
+// SetPaused stops or resumes enforcement
+func (cc *ControlClient) SetPaused(paused bool) error {
+	if paused {
+		return cc.do(http.MethodPost, "/v1/pause", nil, nil)
+	}
+	return cc.do(http.MethodPost, "/v1/resume", nil, nil)
+}
+
+func (cc *ControlClient) do(method, path string, req interface{}, result interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+
+	hreq, err := http.NewRequest(method, "http://apiban"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	resp, err := cc.hc.Do(hreq)
+	if err != nil {
+		return fmt.Errorf("failed to reach the apiban daemon: %w", err)
+	}
+	defer resp.Body.Close()
+
+	cr := controlResponse{Result: result}
+	if err := json.NewDecoder(resp.Body).Decode(&cr); err != nil {
+		return fmt.Errorf("failed to decode response (%s): %w", resp.Status, err)
+	}
+	if !cr.OK {
+		return errors.New(cr.Error)
+	}
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControl(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "control.sock")
+	srv, err := c.ServeControl(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	fi, err := os.Stat(sock)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	cc := NewControlClient(sock)
+
+	res, err := cc.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, &Result{ID: "300", Added: 2, Failed: 1, Rejected: 1}, res)
+
+	assert.NoError(t, cc.Ban("198.51.100.7", 0, ""))
+	assert.EqualError(t, cc.Ban("bad", 0, ""), `invalid address "bad"`)
+	assert.NoError(t, cc.Unban("192.0.2.1"))
+	assert.EqualError(t, cc.Unban("192.0.2.1"), "192.0.2.1 is not blocked")
+	assert.Equal(t, []string{"192.0.2.2", "198.51.100.7"}, be.added)
+
+	assert.NoError(t, cc.SetPaused(true))
+	assert.True(t, be.paused)
+
+	st, err := cc.Status()
+	assert.NoError(t, err)
+	assert.Equal(t, "300", st.LKID)
+	assert.True(t, st.Paused)
+	assert.Equal(t, 2, st.Banned)
+	assert.Equal(t, &Result{ID: "300", Added: 2, Failed: 1, Rejected: 1}, st.LastResult)
+	assert.False(t, st.LastSuccess.IsZero())
+
+	assert.NoError(t, cc.SetPaused(false))
+	assert.False(t, be.paused)
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/palner/apiban/clients/go/logging"
+)
+
+// Schedule controls how often the daemon syncs
+type Schedule struct {
+
+	// Interval is the time between successful syncs
+	Interval time.Duration
+
+	// Jitter is the maximum random delay added to each Interval, so that a
+	// fleet of clients does not poll in lockstep
+	Jitter time.Duration
+
+	// RetryMin is the delay after the first failed sync.  It doubles with
+	// each consecutive failure, up to RetryMax.
+	RetryMin time.Duration
+
+	// RetryMax caps the delay between failed syncs
+	RetryMax time.Duration
+}
+
+// DefaultSchedule matches the interval of the old systemd timer
+var DefaultSchedule = Schedule{
+	Interval: 5 * time.Minute,
+	Jitter:   30 * time.Second,
+	RetryMin: 30 * time.Second,
+	RetryMax: 30 * time.Minute,
+}
+
+// next returns the delay before the next sync, given the number of
+// consecutive failures so far
+func (s Schedule) next(failures int, rnd *rand.Rand) time.Duration {
+	if failures > 0 {
+		delay := s.RetryMin
+		for i := 1; i < failures && delay < s.RetryMax; i++ {
+			delay *= 2
+		}
+		if delay > s.RetryMax {
+			delay = s.RetryMax
+		}
+		return delay
+	}
+
+	delay := s.Interval
+	if s.Jitter > 0 {
+		delay += time.Duration(rnd.Int63n(int64(s.Jitter)))
+	}
+	return delay
+}
+
+// Daemon syncs on the given schedule until SIGTERM or SIGINT is received.  A
+// sync in progress is always allowed to finish before returning.
+//
+// While running, SIGHUP reloads the configuration file, SIGUSR1 triggers an
+// immediate sync and SIGUSR2 an immediate full resync.
+func (c *Client) Daemon(s Schedule) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(sigs)
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	logging.Info("daemon started", "interval", s.Interval, "jitter", s.Jitter)
+
+	var failures int
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		full := false
+
+		select {
+		case sig := <-sigs:
+			switch sig {
+			case syscall.SIGHUP:
+				logging.Info("SIGHUP received, reloading configuration")
+				changed, err := c.Reload()
+				if err != nil {
+					logging.Error("reload failed, keeping current configuration", "error", err)
+					continue
+				}
+				if !changed {
+					logging.Info("configuration reloaded")
+					continue
+				}
+				logging.Info("configuration reloaded, firewall settings changed; resyncing")
+				full = true
+			case syscall.SIGUSR1:
+				logging.Info("SIGUSR1 received, syncing now")
+			case syscall.SIGUSR2:
+				logging.Info("SIGUSR2 received, running full resync")
+				full = true
+			default:
+				logging.Info("shutting down", "signal", sig)
+				return nil
+			}
+
+			// Reschedule from the end of this sync
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-timer.C:
+		}
+
+		// Sync logs its own outcome
+		if _, err := c.Sync(full); err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		delay := s.next(failures, rnd)
+		logging.Debug("next sync scheduled", "delay", delay.Round(time.Second))
+		timer.Reset(delay)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// escalationSource names the escalations in the history and exports
+const escalationSource = "escalation"
+
+// escalation is an escalation rule for one address family
+type escalation struct {
+	count, prefix int
+	setting       string
+}
+
+// escalations returns the escalation rule for IPv4 and IPv6 addresses, by
+// address length
+func (cfg *ApibanConfig) escalations() map[int]escalation {
+	return map[int]escalation{
+		net.IPv4len: {cfg.ESCALATEV4COUNT, cfg.ESCALATEV4PREFIX, "ESCALATE_V4_COUNT"},
+		net.IPv6len: {cfg.ESCALATEV6COUNT, cfg.ESCALATEV6PREFIX, "ESCALATE_V6_COUNT"},
+	}
+}
+
+// escalate bans the networks holding enough banned entries, and lifts the
+// escalations whose networks no longer do.  Entries held back by the score
+// threshold don't count.  Networks overlapping the
+// allowlist or the protected addresses are never escalated, and a network
+// also banned by another source keeps its rule when de-escalated.
+func (c *Client) escalate(res *Result) {
+	rules := c.Config.escalations()
+	now := time.Now()
+
+	// Group the entries narrower than the escalation prefix by network
+	members := make(map[string][]string)
+	networks := make(map[string]*net.IPNet)
+	for _, addr := range c.applied() {
+		n, err := netlist.ParseNet(addr)
+		if err != nil || !c.passes(addr) {
+			continue
+		}
+		r := rules[len(n.IP)]
+		if ones, _ := n.Mask.Size(); r.count == 0 || ones <= r.prefix {
+			continue
+		}
+
+		mask := net.CIDRMask(r.prefix, len(n.IP)*8)
+		network := &net.IPNet{IP: n.IP.Mask(mask), Mask: mask}
+		key := network.String()
+		members[key] = append(members[key], addr)
+		networks[key] = network
+	}
+
+	// Lift the escalations which no longer apply, such as after an unban
+	for _, e := range c.State.Escalations() {
+		n, err := netlist.ParseNet(e.Network)
+		if err != nil {
+			continue
+		}
+		r := rules[len(n.IP)]
+		if ones, _ := n.Mask.Size(); r.count > 0 && ones == r.prefix && len(members[e.Network]) >= r.count {
+			continue
+		}
+
+		// The rule stays if the network is banned in its own right, by
+		// hand, by a list or by the feed
+		if c.passes(e.Network) {
+			logging.Info("de-escalating, keeping the ban of the network", "network", e.Network, "members", len(members[e.Network]),
+				"sources", strings.Join(c.provenance(e.Network), " "))
+			c.State.Deescalate(e.Network)
+			res.Deescalated++
+			continue
+		}
+
+		if err := c.Backend.Remove(e.Network); err != nil {
+			logging.Error("lifting escalated ban failed", "network", e.Network, "error", err)
+			continue
+		}
+		logging.Info("de-escalating", "network", e.Network, "members", len(members[e.Network]))
+		c.lifted(e.Network, "fewer than the escalation count of banned addresses")
+		c.State.Deescalate(e.Network)
+		res.Deescalated++
+	}
+
+	keys := make([]string, 0, len(members))
+	for k := range members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		r := rules[len(networks[key].IP)]
+		if len(members[key]) < r.count {
+			continue
+		}
+
+		e := state.Escalation{
+			Network: key,
+			Reason:  fmt.Sprintf("%d banned addresses in %s (%s %d)", len(members[key]), key, r.setting, r.count),
+			Members: members[key],
+			Since:   now,
+		}
+		if _, ok := c.State.Escalation(key); ok {
+			c.State.Escalate(e)
+			continue
+		}
+
+		if m, ok := c.allowed(key); ok {
+			logging.Debug("not escalating allowlisted network", "network", key, "match", m.Net, "source", m.Source)
+			continue
+		}
+		if m, ok := c.isProtected(key); ok {
+			logging.Debug("not escalating protected network", "network", key, "match", m.Net, "reason", m.Source)
+			continue
+		}
+
+		if err := c.Backend.Add(key); err != nil {
+			logging.Error("escalating failed", "network", key, "error", err)
+			continue
+		}
+		logging.Info("escalating", "network", key, "reason", e.Reason)
+		c.record(history.Event{Action: history.Banned, Address: key, Source: escalationSource, Reason: e.Reason})
+		c.State.Escalate(e)
+		res.Escalated++
+	}
+}
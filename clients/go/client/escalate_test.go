@@ -0,0 +1,91 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscalate(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{
+		ESCALATEV4COUNT: 2, ESCALATEV4PREFIX: 24,
+		ESCALATEV6COUNT: 1, ESCALATEV6PREFIX: 64,
+	})
+	defer cleanup()
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Escalated)
+	assert.Contains(t, be.added, "192.0.2.0/24")
+	if es := c.State.Escalations(); assert.Len(t, es, 1) {
+		assert.Equal(t, "192.0.2.0/24", es[0].Network)
+		assert.Equal(t, "2 banned addresses in 192.0.2.0/24 (ESCALATE_V4_COUNT 2)", es[0].Reason)
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, es[0].Members)
+	}
+
+	// A second sync keeps the escalation
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Zero(t, res.Escalated)
+	assert.Len(t, c.State.Escalations(), 1)
+
+	// It is lifted when too few members are left
+	assert.NoError(t, c.Unban("192.0.2.1"))
+	assert.NotContains(t, be.added, "192.0.2.0/24")
+	assert.Empty(t, c.State.Escalations())
+
+	// Any IPv6 ban covers its /64
+	assert.NoError(t, c.Ban("2001:db8::1", 0, ""))
+	assert.Contains(t, be.added, "2001:db8::/64")
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	assert.Len(t, st.Escalations, 1)
+}
+
+func TestEscalateAllowlisted(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{ESCALATEV4COUNT: 2, ESCALATEV4PREFIX: 24})
+	defer cleanup()
+	c.allow = new(netlist.List)
+	assert.NoError(t, c.allow.Add("192.0.2.200", "ALLOW"))
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Zero(t, res.Escalated)
+	assert.NotContains(t, be.added, "192.0.2.0/24")
+	assert.Empty(t, c.State.Escalations())
+}
+
+func TestDeescalateKeepsOwnBan(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{ESCALATEV4COUNT: 2, ESCALATEV4PREFIX: 24})
+	defer cleanup()
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Escalated)
+
+	// The escalated network is banned by hand too
+	assert.NoError(t, c.Ban("192.0.2.0/24", 0, "whole range"))
+
+	// Too few members are left, but the manual ban keeps the rule
+	assert.NoError(t, c.Unban("192.0.2.1"))
+	assert.Empty(t, c.State.Escalations())
+	assert.Contains(t, be.added, "192.0.2.0/24")
+	_, ok := c.State.ManualBan("192.0.2.0/24")
+	assert.True(t, ok)
+}
+
+func TestEscalateUnscored(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{ESCALATEV4COUNT: 2, ESCALATEV4PREFIX: 24, SCORETHRESHOLD: 2})
+	defer cleanup()
+
+	// The feed alone doesn't reach the threshold, so none of its entries
+	// is banned and the network is not escalated
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Unscored)
+	assert.Zero(t, res.Escalated)
+	assert.Empty(t, c.State.Escalations())
+	assert.Empty(t, be.added)
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// Explanation tells why an address is, or is not, blocked
+type Explanation struct {
+	Address string `json:"address"`
+
+	// Blocked reports whether a rule of the live firewall holds the
+	// address, and Paused whether enforcement is paused
+	Blocked bool `json:"blocked"`
+	Paused  bool `json:"paused"`
+
+	// Rules are the live rules holding the address; with AGGREGATE, a rule
+	// may hold several entries
+	Rules []ExplainedRule `json:"rules"`
+
+	// Entries are the banned entries sharing any address with it, and what
+	// banned them
+	Entries []ExplainedEntry `json:"entries"`
+
+	// Escalations are the escalated networks holding it
+	Escalations []state.Escalation `json:"escalations"`
+
+	// Allowed, Protected and Reserved are what keeps the address from
+	// being banned, if anything, and Quarantined the feed entries held
+	// back for review
+	Allowed     []Suppression       `json:"allowed"`
+	Protected   *Suppression        `json:"protected,omitempty"`
+	Reserved    *Suppression        `json:"reserved,omitempty"`
+	Quarantined []state.Quarantined `json:"quarantined"`
+
+	Score *Score `json:"score"`
+
+	// Check is what APIBAN.org says of the address now
+	Check *CheckResult `json:"check,omitempty"`
+}
+
+// ExplainedRule is a live firewall rule
+type ExplainedRule struct {
+	Chain   string   `json:"chain,omitempty"`
+	Network string   `json:"network"`
+	Rule    string   `json:"rule,omitempty"`
+	Members []string `json:"members,omitempty"`
+
+	// Shadow is set for a rule of the shadow chain, which only observes
+	Shadow bool `json:"shadow,omitempty"`
+}
+
+// ExplainedEntry is a banned entry and where it came from
+type ExplainedEntry struct {
+	Entry   string   `json:"entry"`
+	Sources []string `json:"sources"`
+
+	// Since is when the current ban started, and FeedID the APIBAN ID it
+	// came with, as far as the history knows
+	Since  *time.Time `json:"since,omitempty"`
+	FeedID string     `json:"feed_id,omitempty"`
+
+	// Reason and Until describe a manual ban
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// Suppression is what keeps an address from being banned
+type Suppression struct {
+	Network string `json:"network"`
+	Source  string `json:"source"`
+
+	// Overridden is set for a reserved range which RESERVED_OVERRIDE lets
+	// the feed ban
+	Overridden bool `json:"overridden,omitempty"`
+}
+
+// CheckResult is the answer of APIBAN.org's check API
+type CheckResult struct {
+	Listed bool   `json:"listed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Explain gathers what the firewall, the state, the configuration and the
+// history know of an address or CIDR.  If check is set, APIBAN.org is asked
+// about it too.
+func (c *Client) Explain(addr string, check bool) (*Explanation, error) {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := c.explain(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Asked without the lock, so a slow APIBAN.org holds up no sync
+	if check {
+		e.Check = new(CheckResult)
+		if ones, bits := n.Mask.Size(); ones != bits {
+			e.Check.Error = "only single addresses can be checked"
+		} else if e.Check.Listed, err = c.API.Check(c.Config.APIKEY, n.IP.String()); err != nil {
+			e.Check.Error = err.Error()
+		}
+	}
+
+	return e, nil
+}
+
+func (c *Client) explain(n *net.IPNet) (*Explanation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addr := canonical(n)
+	e := &Explanation{
+		Address:     addr,
+		Paused:      c.paused,
+		Rules:       []ExplainedRule{},
+		Entries:     []ExplainedEntry{},
+		Escalations: []state.Escalation{},
+		Allowed:     []Suppression{},
+		Quarantined: []state.Quarantined{},
+		Score:       c.score(addr),
+	}
+
+	rules, err := c.liveRules(addr)
+	if err != nil {
+		return nil, err
+	}
+	e.Rules = append(e.Rules, rules...)
+	for _, r := range rules {
+		e.Blocked = e.Blocked || !r.Shadow
+	}
+
+	h := c.openHistory()
+	if h != nil {
+		defer h.Close()
+	}
+	for _, entry := range c.applied() {
+		if !overlaps(entry, n) {
+			continue
+		}
+		x := ExplainedEntry{Entry: entry, Sources: c.provenance(entry)}
+		if m, ok := c.State.ManualBan(entry); ok {
+			since := m.Since
+			x.Since, x.Reason, x.Until = &since, m.Reason, m.Until
+		}
+		if h != nil {
+			if r, err := h.Get(entry); err == nil && r != nil && r.Active() {
+				since := r.Since
+				x.Since, x.FeedID = &since, r.FeedID
+			}
+		}
+		e.Entries = append(e.Entries, x)
+	}
+
+	for _, esc := range c.State.Escalations() {
+		if overlaps(esc.Network, n) {
+			e.Escalations = append(e.Escalations, esc)
+		}
+	}
+
+	for _, a := range c.allow.Entries() {
+		if netlist.Overlaps(a.Net, n) {
+			e.Allowed = append(e.Allowed, Suppression{Network: a.Net.String(), Source: a.Source})
+		}
+	}
+	for _, l := range c.lists {
+		if a, ok := l.allow.Match(n); ok {
+			e.Allowed = append(e.Allowed, Suppression{Network: a.Net.String(), Source: a.Source + " (" + l.spec.Name + " only)"})
+		}
+	}
+	if p, ok := c.isProtected(addr); ok {
+		e.Protected = &Suppression{Network: p.Net.String(), Source: p.Source}
+	}
+	if r, ok := netlist.Reserved().Match(n); ok {
+		e.Reserved = &Suppression{Network: r.Net.String(), Source: r.Source}
+		if override, err := c.Config.ReservedOverride(); err == nil {
+			_, e.Reserved.Overridden = override.Covers(n)
+		}
+	}
+	for _, q := range c.State.Quarantined() {
+		if overlaps(q.Address, n) {
+			e.Quarantined = append(e.Quarantined, q)
+		}
+	}
+
+	return e, nil
+}
+
+// liveRules returns the rules of the firewall holding addr.  Backends which
+// cannot look rules up are asked for their list instead.
+func (c *Client) liveRules(addr string) ([]ExplainedRule, error) {
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	be := c.Backend
+	if a, ok := be.(*aggregator); ok {
+		be = a.Backend
+	}
+	backends := []Backend{be}
+	if t, ok := be.(tee); ok {
+		backends = t
+	}
+
+	var out []ExplainedRule
+	for _, b := range backends {
+		shadow := c.shadow != nil && b == c.shadow
+		if l, ok := b.(lookup); ok {
+			ms, err := l.Lookup(addr)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range ms {
+				out = append(out, ExplainedRule{Chain: m.Chain, Network: m.Source, Rule: m.Rule, Members: c.members(m.Source), Shadow: shadow})
+			}
+			continue
+		}
+
+		list, err := b.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range list {
+			if overlaps(r, n) {
+				out = append(out, ExplainedRule{Network: r, Members: c.members(r), Shadow: shadow})
+			}
+		}
+	}
+	return out, nil
+}
+
+// members returns the entries held by a rule AGGREGATE merged, or nil if
+// the rule is an entry
+func (c *Client) members(rule string) []string {
+	if _, ok := c.Backend.(*aggregator); !ok {
+		return nil
+	}
+	r, err := netlist.ParseNet(rule)
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for _, entry := range c.applied() {
+		if n, err := netlist.ParseNet(entry); err == nil && within(n, r) {
+			out = append(out, entry)
+		}
+	}
+	if len(out) == 1 && out[0] == canonical(r) {
+		return nil
+	}
+	sort.Strings(out)
+	return out
+}
+
+// openHistory opens the history for reading, or returns nil if there is
+// none
+func (c *Client) openHistory() *history.DB {
+	if !c.Config.HISTORY {
+		return nil
+	}
+	h, err := history.OpenReadOnly(c.HistoryFile())
+	if err != nil {
+		if err != history.ErrNoHistory {
+			logging.Warning("reading the history failed", "error", err)
+		}
+		return nil
+	}
+	return h
+}
+
+// lookup is implemented by Backends which can find the rules holding an
+// address, such as *firewall.Firewall
+type lookup interface {
+	Lookup(addr string) ([]firewall.Match, error)
+}
+
+// overlaps reports whether the network addr shares any address with n
+func overlaps(addr string, n *net.IPNet) bool {
+	a, err := netlist.ParseNet(addr)
+	return err == nil && netlist.Overlaps(a, n)
+}
@@ -0,0 +1,134 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExplain(t *testing.T) {
+	c, _, cleanup := newTestClient(t, &ApibanConfig{HISTORY: true, RESERVEDACTION: ReservedQuarantine, ESCALATEV4COUNT: 2, ESCALATEV4PREFIX: 24})
+	defer cleanup()
+	c.allow = new(netlist.List)
+	assert.NoError(t, c.allow.Add("203.0.113.0/24", "config"))
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Ban("198.51.100.7", time.Hour, "SIP scan"))
+
+	testCases := map[string]struct {
+		addr        string
+		blocked     bool
+		rules       []string
+		entries     map[string][]string
+		escalations []string
+		allowed     []string
+		reserved    string
+		quarantined []string
+	}{
+		"feed entry": {
+			addr:        "192.0.2.1",
+			blocked:     true,
+			rules:       []string{"192.0.2.1", "192.0.2.0/24"},
+			entries:     map[string][]string{"192.0.2.1": {"apiban"}},
+			escalations: []string{"192.0.2.0/24"},
+			reserved:    "192.0.2.0/24 overridden",
+		},
+		"escalated only": {
+			addr:        "192.0.2.9",
+			blocked:     true,
+			rules:       []string{"192.0.2.0/24"},
+			entries:     map[string][]string{},
+			escalations: []string{"192.0.2.0/24"},
+			reserved:    "192.0.2.0/24 overridden",
+		},
+		"manual": {
+			addr:     "198.51.100.7",
+			blocked:  true,
+			rules:    []string{"198.51.100.7"},
+			entries:  map[string][]string{"198.51.100.7": {"manual"}},
+			reserved: "198.51.100.0/24 overridden",
+		},
+		"allowlisted": {
+			addr:     "203.0.113.5",
+			entries:  map[string][]string{},
+			allowed:  []string{"203.0.113.0/24"},
+			reserved: "203.0.113.0/24 overridden",
+		},
+		"quarantined": {
+			addr:        "10.1.2.3",
+			entries:     map[string][]string{},
+			reserved:    "10.0.0.0/8",
+			quarantined: []string{"10.0.0.0/8"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			e, err := c.Explain(tc.addr, false)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tc.blocked, e.Blocked)
+			assert.Nil(t, e.Check)
+
+			var rules []string
+			for _, r := range e.Rules {
+				rules = append(rules, r.Network)
+			}
+			assert.Equal(t, tc.rules, rules)
+
+			entries := map[string][]string{}
+			for _, x := range e.Entries {
+				entries[x.Entry] = x.Sources
+				assert.NotNil(t, x.Since, x.Entry)
+			}
+			assert.Equal(t, tc.entries, entries)
+
+			var escalations []string
+			for _, x := range e.Escalations {
+				escalations = append(escalations, x.Network)
+			}
+			assert.Equal(t, tc.escalations, escalations)
+
+			var allowed []string
+			for _, a := range e.Allowed {
+				allowed = append(allowed, a.Network)
+			}
+			assert.Equal(t, tc.allowed, allowed)
+
+			if tc.reserved == "" {
+				assert.Nil(t, e.Reserved)
+			} else if assert.NotNil(t, e.Reserved) {
+				reserved := e.Reserved.Network
+				if e.Reserved.Overridden {
+					reserved += " overridden"
+				}
+				assert.Equal(t, tc.reserved, reserved)
+			}
+
+			var quarantined []string
+			for _, q := range e.Quarantined {
+				quarantined = append(quarantined, q.Address)
+			}
+			assert.Equal(t, tc.quarantined, quarantined)
+		})
+	}
+
+	// APIBAN.org is asked about single addresses only
+	e, err := c.Explain("192.0.2.0/24", true)
+	assert.NoError(t, err)
+	if assert.NotNil(t, e.Check) {
+		assert.Equal(t, "only single addresses can be checked", e.Check.Error)
+	}
+	e, err = c.Explain("192.0.2.1", true)
+	assert.NoError(t, err)
+	if assert.NotNil(t, e.Check) {
+		assert.NotEmpty(t, e.Check.Error)
+	}
+
+	_, err = c.Explain("bad", false)
+	assert.EqualError(t, err, `invalid address "bad"`)
+}
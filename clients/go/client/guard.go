@@ -0,0 +1,103 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// GuardError reports a feed which failed a sanity check.  Nothing was
+// applied; ForceSync applies it anyway.
+type GuardError struct {
+
+	// Check is the threshold exceeded: adds, change or prefix
+	Check string
+
+	// Reason describes what was found
+	Reason string
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("feed failed the sanity check: %s; keeping the current rules (run with -force to apply it anyway)", e.Reason)
+}
+
+// checkFeed compares the entries about to be added with the thresholds of
+// the configuration.  applied is the current set; if replace is set the
+// entries replace it rather than add to it.
+func (cfg *ApibanConfig) checkFeed(adds []string, applied []string, replace bool) error {
+	for _, addr := range adds {
+		n, err := netlist.ParseNet(addr)
+		if err != nil {
+			continue
+		}
+
+		ones, bits := n.Mask.Size()
+		min := cfg.MINPREFIXV4
+		if bits == 128 {
+			min = cfg.MINPREFIXV6
+		}
+		if ones < min {
+			return &GuardError{Check: "prefix", Reason: fmt.Sprintf("%s is wider than /%d", addr, min)}
+		}
+	}
+
+	// Entries which are already applied don't change anything
+	current := make(map[string]bool, len(applied))
+	for _, a := range applied {
+		current[a] = true
+	}
+
+	added := 0
+	incoming := make(map[string]bool, len(adds))
+	for _, a := range adds {
+		if !current[a] && !incoming[a] {
+			added++
+		}
+		incoming[a] = true
+	}
+
+	if cfg.MAXADDS > 0 && added > cfg.MAXADDS {
+		return &GuardError{Check: "adds", Reason: fmt.Sprintf("%d new entries, more than MAX_ADDS (%d)", added, cfg.MAXADDS)}
+	}
+
+	removed := 0
+	if replace {
+		for a := range current {
+			if !incoming[a] {
+				removed++
+			}
+		}
+	}
+
+	// There is nothing to compare a first run with
+	if cfg.MAXCHANGE > 0 && len(current) > 0 {
+		change := (added + removed) * 100 / len(current)
+		if change > cfg.MAXCHANGE {
+			return &GuardError{Check: "change", Reason: fmt.Sprintf("%d added and %d removed would change %d%% of the %d current entries, more than MAX_CHANGE (%d%%)",
+				added, removed, change, len(current), cfg.MAXCHANGE)}
+		}
+	}
+
+	return nil
+}
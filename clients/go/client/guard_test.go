@@ -0,0 +1,88 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFeed(t *testing.T) {
+	current := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+
+	testCases := map[string]struct {
+		cfg     ApibanConfig
+		adds    []string
+		applied []string
+		replace bool
+		check   string
+	}{
+		"no limits": {
+			adds: []string{"0.0.0.0/1", "192.0.2.5", "192.0.2.6"},
+		},
+		"too many adds": {
+			cfg:   ApibanConfig{MAXADDS: 1},
+			adds:  []string{"192.0.2.5", "192.0.2.6"},
+			check: "adds",
+		},
+		"known entries are not adds": {
+			cfg:     ApibanConfig{MAXADDS: 1},
+			adds:    []string{"192.0.2.1", "192.0.2.5", "192.0.2.5"},
+			applied: current,
+		},
+		"change": {
+			cfg:     ApibanConfig{MAXCHANGE: 25},
+			adds:    []string{"192.0.2.5", "192.0.2.6"},
+			applied: current,
+			check:   "change",
+		},
+		"change within limit": {
+			cfg:     ApibanConfig{MAXCHANGE: 25},
+			adds:    []string{"192.0.2.5"},
+			applied: current,
+		},
+		"replacement drops entries": {
+			cfg:     ApibanConfig{MAXCHANGE: 25},
+			adds:    []string{"192.0.2.1", "192.0.2.5"},
+			applied: current,
+			replace: true,
+			check:   "change",
+		},
+		"same list after flush": {
+			cfg:     ApibanConfig{MAXCHANGE: 25},
+			adds:    current,
+			applied: current,
+			replace: true,
+		},
+		"first run": {
+			cfg:  ApibanConfig{MAXCHANGE: 10},
+			adds: current,
+		},
+		"wide ipv4": {
+			cfg:   ApibanConfig{MINPREFIXV4: 16, MINPREFIXV6: 32},
+			adds:  []string{"192.0.2.1", "45.0.0.0/8"},
+			check: "prefix",
+		},
+		"wide ipv6": {
+			cfg:   ApibanConfig{MINPREFIXV4: 16, MINPREFIXV6: 32},
+			adds:  []string{"2001:db8::1", "2000::/3"},
+			check: "prefix",
+		},
+		"narrow enough": {
+			cfg:  ApibanConfig{MINPREFIXV4: 16, MINPREFIXV6: 32},
+			adds: []string{"45.1.0.0/16", "2001:db8::/32", "2001:db8::1"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.cfg.checkFeed(tc.adds, tc.applied, tc.replace)
+			if tc.check == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.IsType(t, &GuardError{}, err) {
+				assert.Equal(t, tc.check, err.(*GuardError).Check)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Exit codes, following the monitoring plugin (Nagios/Icinga) conventions
+const (
+	ExitOK       = 0
+	ExitWarning  = 1
+	ExitCritical = 2
+	ExitUnknown  = 3
+)
+
+var stateNames = map[int]string{
+	ExitOK:       "OK",
+	ExitWarning:  "WARNING",
+	ExitCritical: "CRITICAL",
+	ExitUnknown:  "UNKNOWN",
+}
+
+// HealthThresholds are the limits used by the health checks
+type HealthThresholds struct {
+
+	// WarnAge and CritAge are the maximum times since the last successful
+	// sync
+	WarnAge time.Duration
+	CritAge time.Duration
+
+	// WarnRules and CritRules are the minimum numbers of banned networks
+	WarnRules int
+	CritRules int
+}
+
+// DefaultHealthThresholds suit the default 5 minute sync interval
+var DefaultHealthThresholds = HealthThresholds{
+	WarnAge:   30 * time.Minute,
+	CritAge:   time.Hour,
+	WarnRules: 1,
+	CritRules: 0,
+}
+
+// Health is the result of a health check
+type Health struct {
+	Code        int           `json:"code"`
+	State       string        `json:"state"`
+	Message     string        `json:"message"`
+	LastSuccess time.Time     `json:"last_success"`
+	Age         time.Duration `json:"-"`
+	Rules       int           `json:"rules"`
+	Paused      bool          `json:"paused"`
+
+	thresholds HealthThresholds
+}
+
+// CheckHealth rates the given state against the thresholds
+func CheckHealth(lastSuccess time.Time, rules int, paused bool, now time.Time, t HealthThresholds) *Health {
+	h := &Health{
+		Code:        ExitOK,
+		LastSuccess: lastSuccess,
+		Rules:       rules,
+		Paused:      paused,
+		thresholds:  t,
+	}
+
+	var problems []string
+	raise := func(code int, msg string) {
+		if code > h.Code {
+			h.Code = code
+		}
+		problems = append(problems, msg)
+	}
+
+	if lastSuccess.IsZero() {
+		raise(ExitCritical, "no successful sync recorded")
+	} else {
+		h.Age = now.Sub(lastSuccess)
+		switch {
+		case t.CritAge > 0 && h.Age > t.CritAge:
+			raise(ExitCritical, fmt.Sprintf("last successful sync %s ago", h.Age.Round(time.Second)))
+		case t.WarnAge > 0 && h.Age > t.WarnAge:
+			raise(ExitWarning, fmt.Sprintf("last successful sync %s ago", h.Age.Round(time.Second)))
+		}
+	}
+
+	switch {
+	case rules < t.CritRules:
+		raise(ExitCritical, fmt.Sprintf("only %d rules", rules))
+	case rules < t.WarnRules:
+		raise(ExitWarning, fmt.Sprintf("only %d rules", rules))
+	}
+
+	if paused {
+		raise(ExitWarning, "enforcement paused")
+	}
+
+	h.State = stateNames[h.Code]
+	if len(problems) == 0 {
+		h.Message = fmt.Sprintf("last successful sync %s ago, %d rules", h.Age.Round(time.Second), rules)
+	} else {
+		h.Message = strings.Join(problems, ", ")
+	}
+
+	return h
+}
+
+// String formats the check as a monitoring plugin status line with perfdata
+func (h *Health) String() string {
+	t := h.thresholds
+	return fmt.Sprintf("APIBAN %s - %s | age=%ds;%s;%s;0; rules=%d;%s;%s;0;",
+		h.State, h.Message,
+		int64(h.Age.Seconds()), seconds(t.WarnAge), seconds(t.CritAge),
+		h.Rules, below(t.WarnRules), below(t.CritRules))
+}
+
+// seconds formats a perfdata threshold in seconds
+func seconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprint(int64(d.Seconds()))
+}
+
+// below formats a perfdata threshold which alerts below n
+func below(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d:", n)
+}
+
+// Health checks the running client
+func (c *Client) Health(t HealthThresholds) (*Health, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list, err := c.Backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	return CheckHealth(c.lastOK, len(list), c.paused, time.Now(), t), nil
+}
+
+// healthHandler serves the health check as JSON, with a 503 status when it
+// is not OK
+func (c *Client) healthHandler(t HealthThresholds) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		h, err := c.Health(t)
+		if err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]string{"state": stateNames[ExitUnknown], "message": err.Error()})
+			return
+		}
+
+		if h.Code != ExitOK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(h)
+	})
+}
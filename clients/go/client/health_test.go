@@ -0,0 +1,79 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckHealth(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+
+	testCases := map[string]struct {
+		lastSuccess time.Time
+		rules       int
+		paused      bool
+		code        int
+		line        string
+	}{
+		"ok": {
+			lastSuccess: now.Add(-3 * time.Minute),
+			rules:       1234,
+			code:        ExitOK,
+			line:        "APIBAN OK - last successful sync 3m0s ago, 1234 rules | age=180s;1800;3600;0; rules=1234;1:;;0;",
+		},
+		"stale": {
+			lastSuccess: now.Add(-45 * time.Minute),
+			rules:       1234,
+			code:        ExitWarning,
+			line:        "APIBAN WARNING - last successful sync 45m0s ago | age=2700s;1800;3600;0; rules=1234;1:;;0;",
+		},
+		"very stale and empty": {
+			lastSuccess: now.Add(-2 * time.Hour),
+			code:        ExitCritical,
+			line:        "APIBAN CRITICAL - last successful sync 2h0m0s ago, only 0 rules | age=7200s;1800;3600;0; rules=0;1:;;0;",
+		},
+		"never synced": {
+			rules: 10,
+			code:  ExitCritical,
+			line:  "APIBAN CRITICAL - no successful sync recorded | age=0s;1800;3600;0; rules=10;1:;;0;",
+		},
+		"paused": {
+			lastSuccess: now.Add(-time.Minute),
+			rules:       10,
+			paused:      true,
+			code:        ExitWarning,
+			line:        "APIBAN WARNING - enforcement paused | age=60s;1800;3600;0; rules=10;1:;;0;",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h := CheckHealth(tc.lastSuccess, tc.rules, tc.paused, now, DefaultHealthThresholds)
+			assert.Equal(t, tc.code, h.Code)
+			assert.Equal(t, tc.line, h.String())
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	be := &fakeBackend{added: []string{"192.0.2.1"}}
+	c := &Client{Backend: be, lastOK: time.Now()}
+
+	rec := httptest.NewRecorder()
+	c.healthHandler(DefaultHealthThresholds).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 200, rec.Code)
+
+	h := new(Health)
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(h))
+	assert.Equal(t, "OK", h.State)
+	assert.Equal(t, 1, h.Rules)
+
+	c.lastOK = time.Now().Add(-2 * time.Hour)
+	rec = httptest.NewRecorder()
+	c.healthHandler(DefaultHealthThresholds).ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	assert.Equal(t, 503, rec.Code)
+}
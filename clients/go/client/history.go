@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// statePath returns the location of the state file
+func (c *Client) statePath() string {
+	if c.opts.StateFile == "" {
+		return state.DefaultFile
+	}
+	return c.opts.StateFile
+}
+
+// HistoryFile returns the location of the history database
+func (c *Client) HistoryFile() string {
+	return history.Path(c.statePath())
+}
+
+// record notes a change to the bans, to be written to the history by
+// writeHistory
+func (c *Client) record(e history.Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if n, err := netlist.ParseNet(e.Address); err == nil {
+		e.Address = canonical(n)
+	}
+	c.journal = append(c.journal, e)
+}
+
+// banned notes that source banned addr
+func (c *Client) banned(addr, source string) {
+	c.record(history.Event{Action: history.Banned, Address: addr, Source: source})
+}
+
+// lifted notes that the ban on addr was lifted, and why
+func (c *Client) lifted(addr, reason string) {
+	c.record(history.Event{Action: history.Lifted, Address: addr, Reason: reason})
+}
+
+// hits returns the counters of the enforcing rules, by banned entry.  The
+// rules of the shadow chain are left out; those which AGGREGATE merged match
+// no entry, and are ignored by the history.
+func (c *Client) hits() []firewall.Counter {
+	if c.Config == nil || !c.Config.HISTORY {
+		return nil
+	}
+
+	be := c.Backend
+	if a, ok := be.(*aggregator); ok {
+		be = a.Backend
+	}
+	backends := []Backend{be}
+	if t, ok := be.(tee); ok {
+		backends = t
+	}
+
+	total := make(map[string]firewall.Counter)
+	var order []string
+	for _, b := range backends {
+		cb, ok := b.(counter)
+		if !ok || b == c.shadow {
+			continue
+		}
+		counters, err := cb.Counters()
+		if err != nil {
+			logging.Debug("reading the firewall counters failed", "error", err)
+			continue
+		}
+		for _, n := range counters {
+			ipnet, err := netlist.ParseNet(n.Source)
+			if err != nil {
+				continue
+			}
+			key := canonical(ipnet)
+			t, ok := total[key]
+			if !ok {
+				order = append(order, key)
+			}
+			t.Source = key
+			t.Packets += n.Packets
+			t.Bytes += n.Bytes
+			total[key] = t
+		}
+	}
+
+	out := make([]firewall.Counter, 0, len(order))
+	for _, key := range order {
+		out = append(out, total[key])
+	}
+	return out
+}
+
+// writeHistory writes the changes noted since the last call, and the
+// counters, to the history.  The database is only held open while writing,
+// so the history command can read it meanwhile.
+func (c *Client) writeHistory(counters []firewall.Counter) {
+	events := c.journal
+	c.journal = nil
+
+	if !c.Config.HISTORY || (len(events) == 0 && len(counters) == 0) {
+		return
+	}
+
+	h, err := history.Open(c.HistoryFile())
+	if err != nil {
+		logging.Error("opening the history failed", "error", err)
+		return
+	}
+	defer h.Close()
+
+	if err := h.Apply(events, counters); err != nil {
+		logging.Error("writing the history failed", "events", len(events), "error", err)
+	}
+}
+
+// liftMissing notes that the entries of before which the Backend no longer
+// lists were lifted, such as after a flush
+func (c *Client) liftMissing(before []string, reason string) {
+	if len(before) == 0 {
+		return
+	}
+	after, err := c.Backend.List()
+	if err != nil {
+		return
+	}
+
+	banned := make(map[string]bool, len(after))
+	for _, a := range after {
+		if n, err := netlist.ParseNet(a); err == nil {
+			banned[canonical(n)] = true
+		}
+	}
+	for _, b := range before {
+		if n, err := netlist.ParseNet(b); err == nil && !banned[canonical(n)] {
+			c.lifted(b, reason)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistory(t *testing.T) {
+	c, _, cleanup := newTestClient(t, &ApibanConfig{HISTORY: true})
+	defer cleanup()
+	be := &countingBackend{hits: map[string]uint64{}}
+	c.Backend = be
+
+	start := time.Now()
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+
+	be.hits["192.0.2.1"] = 5
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Ban("198.51.100.7", time.Hour, "brute force"))
+	assert.NoError(t, c.Unban("192.0.2.1"))
+
+	h, err := history.OpenReadOnly(c.HistoryFile())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer h.Close()
+
+	r, err := h.Get("192.0.2.1")
+	if assert.NoError(t, err) && assert.NotNil(t, r) {
+		assert.Equal(t, 1, r.Bans)
+		assert.Equal(t, "300", r.FeedID)
+		assert.Equal(t, []string{"apiban"}, r.Sources)
+		assert.False(t, r.Active())
+		assert.Equal(t, "unbanned by hand", r.RemovalReason)
+		assert.Equal(t, uint64(5), r.Packets)
+		assert.Equal(t, uint64(300), r.Bytes)
+	}
+
+	r, err = h.Get("198.51.100.7")
+	if assert.NoError(t, err) && assert.NotNil(t, r) {
+		assert.True(t, r.Active())
+		assert.Equal(t, []string{"manual"}, r.Sources)
+		assert.NotNil(t, r.Expires)
+	}
+
+	bans, err := h.Between(start, time.Now().Add(time.Second), history.Banned)
+	assert.NoError(t, err)
+	assert.Len(t, bans, 3)
+
+	lifts, err := h.Between(start, time.Now().Add(time.Second), history.Lifted)
+	assert.NoError(t, err)
+	if assert.Len(t, lifts, 1) {
+		assert.Equal(t, "192.0.2.1", lifts[0].Address)
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palner/apiban/clients/go/firewall"
+)
+
+// target is a verdict setting
+type target struct {
+	key, value string
+
+	// hook is the hook it applies to, or empty for all
+	hook string
+}
+
+// targets returns the verdict settings, TARGET first
+func (cfg *ApibanConfig) targets() []target {
+	return []target{
+		{key: "TARGET", value: cfg.TARGET},
+		{key: "TARGET_IN", value: cfg.TARGETIN, hook: "INPUT"},
+		{key: "TARGET_FORWARD", value: cfg.TARGETFORWARD, hook: "FORWARD"},
+		{key: "TARGET_OUT", value: cfg.TARGETOUT, hook: "OUTPUT"},
+	}
+}
+
+// verdictFor returns the verdict for hook: its own setting if there is one,
+// otherwise def
+func (cfg *ApibanConfig) verdictFor(hook, def string) (firewall.Verdict, error) {
+	key, value := "TARGET", def
+	for _, t := range cfg.targets() {
+		if t.hook == hook && t.value != "" {
+			key, value = t.key, t.value
+		}
+	}
+
+	v, err := firewall.ParseVerdict(value)
+	if err != nil {
+		return v, fmt.Errorf("%s: %w", key, err)
+	}
+	return v, nil
+}
+
+// firewallConfigs lays out the chains for the hooks of base.  The hooks in
+// shadow mode (see SHADOW) share the shadow chain, and the others a chain per
+// verdict: the main chain for the verdict of base (or TARGET), and a chain
+// named after the first hook for any other (APIBAN_FORWARD).  Each chain is
+// unhooked from the hooks of the others, and the chains of other layouts are
+// retired.
+func (cfg *ApibanConfig) firewallConfigs(base firewall.Config) ([]firewall.Config, error) {
+	if base.Chain == "" {
+		base.Chain = "APIBAN"
+	}
+
+	hooks := base.Hooks
+	if len(hooks) == 0 {
+		hooks = firewall.DefaultHooks
+	}
+
+	def := base.Target
+	if def == "" {
+		def = cfg.TARGET
+	}
+	main, err := firewall.ParseVerdict(def)
+	if err != nil {
+		return nil, fmt.Errorf("TARGET: %w", err)
+	}
+
+	all := false
+	for _, h := range cfg.SHADOW {
+		if h == "all" {
+			all = true
+		} else if !contains(hooks, h) {
+			return nil, fmt.Errorf("SHADOW: %s is not one of the hooks (%s)", h, strings.Join(hooks, ", "))
+		}
+	}
+
+	base.Target = ""
+	var fcs []firewall.Config
+	var shadow []string
+	for _, h := range hooks {
+		if all || contains(cfg.SHADOW, h) {
+			shadow = append(shadow, h)
+			continue
+		}
+
+		v, err := cfg.verdictFor(h, def)
+		if err != nil {
+			return nil, err
+		}
+
+		found := false
+		for i := range fcs {
+			if fcs[i].Verdict == v {
+				fcs[i].Hooks = append(fcs[i].Hooks, h)
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		fc := base
+		fc.Verdict = v
+		fc.Hooks = []string{h}
+		if v != main {
+			fc.Chain = base.Chain + "_" + h
+		}
+		fcs = append(fcs, fc)
+	}
+
+	if len(shadow) > 0 {
+		// The shadow chain never changes the fate of a packet, so
+		// allowlisted packets carry on too
+		sc := base
+		sc.Chain = base.Chain + shadowSuffix
+		sc.Target, sc.TargetArgs = cfg.shadowTarget()
+		sc.Matches = cfg.shadowMatches()
+		sc.AllowTarget = "RETURN"
+		sc.Hooks = shadow
+		fcs = append(fcs, sc)
+	}
+
+	var used []string
+	for _, fc := range fcs {
+		used = append(used, fc.Chain)
+	}
+
+	var retire []string
+	for _, c := range append([]string{base.Chain, base.Chain + shadowSuffix}, prefixed(base.Chain+"_", hooks)...) {
+		if !contains(used, c) {
+			retire = append(retire, c)
+		}
+	}
+
+	for i := range fcs {
+		for _, h := range hooks {
+			if !contains(fcs[i].Hooks, h) {
+				fcs[i].Unhook = append(fcs[i].Unhook, h)
+			}
+		}
+		fcs[i].Retire = retire
+	}
+
+	return fcs, nil
+}
+
+// prefixed returns the names with prefix prepended
+func prefixed(prefix string, names []string) []string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = prefix + n
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirewallConfigs(t *testing.T) {
+	log := []string{"--log-prefix", "APIBAN-SHADOW "}
+	limit := []string{"-m", "limit", "--limit", "10/minute", "--limit-burst", "20"}
+	drop := firewall.Verdict{Target: "DROP"}
+	reject := firewall.Verdict{Target: "REJECT"}
+
+	testCases := map[string]struct {
+		shadow  []string
+		action  string
+		hooks   []string
+		in, out string
+		want    []firewall.Config
+		err     string
+	}{
+		"default": {
+			want: []firewall.Config{
+				{Chain: "APIBAN", Verdict: reject, Hooks: []string{"INPUT", "FORWARD"}, Retire: []string{"APIBAN_SHADOW", "APIBAN_INPUT", "APIBAN_FORWARD"}},
+			},
+		},
+		"same verdict": {
+			in: "reject",
+			want: []firewall.Config{
+				{Chain: "APIBAN", Verdict: reject, Hooks: []string{"INPUT", "FORWARD"}, Retire: []string{"APIBAN_SHADOW", "APIBAN_INPUT", "APIBAN_FORWARD"}},
+			},
+		},
+		"per direction": {
+			hooks: []string{"INPUT", "FORWARD", "OUTPUT"},
+			in:    "DROP",
+			out:   "DROP",
+			want: []firewall.Config{
+				{Chain: "APIBAN_INPUT", Verdict: drop, Hooks: []string{"INPUT", "OUTPUT"}, Unhook: []string{"FORWARD"}, Retire: []string{"APIBAN_SHADOW", "APIBAN_FORWARD", "APIBAN_OUTPUT"}},
+				{Chain: "APIBAN", Verdict: reject, Hooks: []string{"FORWARD"}, Unhook: []string{"INPUT", "OUTPUT"}, Retire: []string{"APIBAN_SHADOW", "APIBAN_FORWARD", "APIBAN_OUTPUT"}},
+			},
+		},
+		"bad verdict": {
+			hooks: []string{"INPUT", "OUTPUT"},
+			out:   "TARPIT:now",
+			err:   "TARGET_OUT: TARPIT takes no argument",
+		},
+		"one hook in shadow mode": {
+			shadow: []string{"FORWARD"},
+			want: []firewall.Config{
+				{Chain: "APIBAN", Verdict: reject, Hooks: []string{"INPUT"}, Unhook: []string{"FORWARD"}, Retire: []string{"APIBAN_INPUT", "APIBAN_FORWARD"}},
+				{Chain: "APIBAN_SHADOW", Target: "LOG", TargetArgs: log, Matches: limit, AllowTarget: "RETURN", Hooks: []string{"FORWARD"}, Unhook: []string{"INPUT"}, Retire: []string{"APIBAN_INPUT", "APIBAN_FORWARD"}},
+			},
+		},
+		"all in shadow mode": {
+			shadow: []string{"all"},
+			action: ShadowNflog,
+			hooks:  []string{"INPUT", "FORWARD", "OUTPUT"},
+			want: []firewall.Config{
+				{Chain: "APIBAN_SHADOW", Target: "NFLOG", TargetArgs: []string{"--nflog-group", "5", "--nflog-prefix", "APIBAN-SHADOW"}, Matches: limit, AllowTarget: "RETURN", Hooks: []string{"INPUT", "FORWARD", "OUTPUT"}, Retire: []string{"APIBAN", "APIBAN_INPUT", "APIBAN_FORWARD", "APIBAN_OUTPUT"}},
+			},
+		},
+		"counting": {
+			shadow: []string{"INPUT", "FORWARD"},
+			action: ShadowCount,
+			want: []firewall.Config{
+				{Chain: "APIBAN_SHADOW", Target: firewall.Count, AllowTarget: "RETURN", Hooks: []string{"INPUT", "FORWARD"}, Retire: []string{"APIBAN", "APIBAN_INPUT", "APIBAN_FORWARD"}},
+			},
+		},
+		"unknown shadow hook": {
+			shadow: []string{"OUTPUT"},
+			err:    "SHADOW: OUTPUT is not one of the hooks (INPUT, FORWARD)",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.SHADOW = tc.shadow
+			if tc.action != "" {
+				cfg.SHADOWACTION = tc.action
+			}
+			cfg.SHADOWNFLOGGROUP = 5
+			cfg.TARGETIN = tc.in
+			cfg.TARGETOUT = tc.out
+
+			fcs, err := cfg.firewallConfigs(firewall.Config{Hooks: tc.hooks})
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, fcs)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/palner/apiban/clients/go/history"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// Ban blocks an address or CIDR by hand, for d or, if d is 0, until it is
+// unbanned.  Manual bans are kept in the state apart from the feed entries,
+// so they survive flushes, and are lifted by the first sync after they
+// expire.
+func (c *Client) Ban(addr string, d time.Duration, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if d < 0 {
+		return fmt.Errorf("the duration of a ban must not be negative")
+	}
+
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return err
+	}
+
+	if e, ok := c.allowed(addr); ok {
+		return fmt.Errorf("%s is allowlisted (%s from %s)", addr, e.Net, e.Source)
+	}
+
+	created, err := c.Backend.Init()
+	if err != nil {
+		return fmt.Errorf("failed to initialize IPTables: %w", err)
+	}
+	if created {
+		// The rest of the state is put back by the next sync, as after a
+		// Restore
+		logging.Info("APIBAN chain was created, the next sync restores the bans")
+		c.State.Restored = time.Now()
+	}
+
+	c.refreshProtected()
+	if e, ok := c.isProtected(addr); ok {
+		return fmt.Errorf("%s is protected (%s is a %s)", addr, e.Net, e.Source)
+	}
+
+	if err := c.Backend.Add(canonical(n)); err != nil {
+		return err
+	}
+
+	m := state.Manual{Address: canonical(n), Reason: reason, Since: time.Now()}
+	if d > 0 {
+		until := m.Since.Add(d)
+		m.Until = &until
+	}
+	c.State.Ban(m)
+	c.record(history.Event{Action: history.Banned, Address: m.Address, Source: source.ManualName, Reason: reason, Expires: m.Until})
+	c.escalate(new(Result))
+	err = c.State.Save()
+	c.writeHistory(nil)
+	if err != nil {
+		return err
+	}
+	c.takeSnapshot()
+
+	c.Metrics.observeManual(true)
+
+	kv := []interface{}{"ip", m.Address}
+	if m.Until != nil {
+		kv = append(kv, "until", *m.Until)
+	}
+	if reason != "" {
+		kv = append(kv, "reason", reason)
+	}
+	logging.Info("blocking (manual)", kv...)
+	return nil
+}
+
+// Unban lifts a ban by hand, whether it came from the feed, another list or
+// Ban.  An entry of a list comes back when the list next changes, or with
+// the next full list of the feed.
+func (c *Client) Unban(addr string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.opts.ReadOnly {
+		return ErrReadOnly
+	}
+
+	n, err := netlist.ParseNet(addr)
+	if err != nil {
+		return err
+	}
+
+	manual := c.State.Unban(canonical(n))
+	c.State.Unlist(canonical(n))
+	if err := c.Backend.Remove(canonical(n)); err != nil && !manual {
+		return err
+	}
+
+	if key, ok := c.feedEntry(n); ok {
+		c.State.SetApplied(key, false)
+	}
+	c.State.Deescalate(canonical(n))
+	c.lifted(canonical(n), "unbanned by hand")
+	c.escalate(new(Result))
+	err = c.State.Save()
+	c.writeHistory(nil)
+	if err != nil {
+		return err
+	}
+	c.takeSnapshot()
+
+	c.Metrics.observeManual(false)
+
+	logging.Info("unblocking (manual)", "ip", canonical(n))
+	return nil
+}
+
+// expireManual lifts the manual bans which have expired.  The rule stays if
+// the sources listing the same network score enough to ban it.
+func (c *Client) expireManual(res *Result, now time.Time) {
+	for _, m := range c.State.Manual() {
+		if !m.Expired(now) {
+			continue
+		}
+
+		c.State.Unban(m.Address)
+		res.Expired++
+		logging.Info("manual ban expired", "ip", m.Address, "since", m.Since)
+
+		if c.passes(m.Address) {
+			continue
+		}
+		if err := c.Backend.Remove(m.Address); err != nil {
+			logging.Warning("removing expired manual ban failed", "ip", m.Address, "error", err)
+			continue
+		}
+		c.lifted(m.Address, "manual ban expired")
+	}
+}
+
+// applyManual puts the manual bans back after the chain was created or
+// flushed
+func (c *Client) applyManual() {
+	for _, m := range c.State.Manual() {
+		if _, ok := c.allowed(m.Address); ok {
+			continue
+		}
+		if _, ok := c.isProtected(m.Address); ok {
+			continue
+		}
+		if err := c.Backend.Add(m.Address); err != nil {
+			logging.Error("applying manual ban failed", "ip", m.Address, "error", err)
+		}
+	}
+}
+
+// canonical returns n the way the feed writes it: a bare address for a
+// single host, CIDR notation otherwise
+func canonical(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
+
+// feedEntry returns the feed entry recorded for n, which may have been
+// given as a bare address
+func (c *Client) feedEntry(n *net.IPNet) (string, bool) {
+	if c.State.IsApplied(n.String()) {
+		return n.String(), true
+	}
+	if ones, bits := n.Mask.Size(); ones == bits && c.State.IsApplied(n.IP.String()) {
+		return n.IP.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManual(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{LKID: "300", FLUSH: "200"})
+	defer cleanup()
+
+	assert.NoError(t, c.Ban("198.51.100.7/32", time.Hour, "brute force"))
+	assert.NoError(t, c.Ban("198.51.100.64/26", 0, ""))
+	assert.EqualError(t, c.Ban("bad", 0, ""), `invalid address "bad"`)
+	assert.EqualError(t, c.Ban("198.51.100.8", -time.Hour, ""), "the duration of a ban must not be negative")
+	assert.Equal(t, []string{"198.51.100.7", "198.51.100.64/26"}, be.added)
+
+	if ms := c.State.Manual(); assert.Len(t, ms, 2) {
+		assert.Equal(t, "198.51.100.64/26", ms[0].Address)
+		assert.Nil(t, ms[0].Until)
+		assert.Equal(t, "198.51.100.7", ms[1].Address)
+		assert.Equal(t, "brute force", ms[1].Reason)
+		if assert.NotNil(t, ms[1].Until) {
+			assert.WithinDuration(t, time.Now().Add(time.Hour), *ms[1].Until, time.Minute)
+		}
+	}
+
+	// Manual bans survive a flush but are not feed entries
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.True(t, res.Flushed)
+	assert.Subset(t, be.added, []string{"192.0.2.1", "192.0.2.2", "198.51.100.7", "198.51.100.64/26"})
+	assert.False(t, c.State.IsApplied("198.51.100.7"))
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	assert.Len(t, st.Manual, 2)
+
+	// An expired ban is lifted by the next sync
+	m := c.State.Manual()[1]
+	past := time.Now().Add(-time.Minute)
+	m.Until = &past
+	c.State.Ban(m)
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Expired)
+	assert.NotContains(t, be.added, "198.51.100.7")
+	assert.Len(t, c.State.Manual(), 1)
+
+	// An expired ban on a feed entry leaves the rule
+	past = time.Now().Add(-time.Minute)
+	c.State.Ban(state.Manual{Address: "192.0.2.1", Since: past, Until: &past})
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Expired)
+	assert.Contains(t, be.added, "192.0.2.1")
+
+	// Unban takes the manual ban away for good
+	assert.NoError(t, c.Unban("198.51.100.64/26"))
+	assert.NotContains(t, be.added, "198.51.100.64/26")
+	assert.Empty(t, c.State.Manual())
+	assert.EqualError(t, c.Unban("198.51.100.64/26"), "198.51.100.64/26 is not blocked")
+}
+
+func TestBanRecreated(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, be.added)
+
+	// After a reboot, a ban by hand creates the chain again
+	be.added = nil
+	be.created = true
+	assert.NoError(t, c.Ban("198.51.100.7", 0, "brute force"))
+	assert.Equal(t, []string{"198.51.100.7"}, be.added)
+
+	// The next sync puts back the entries applied before
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2", "198.51.100.7"}, be.added)
+	assert.True(t, c.State.Restored.IsZero())
+}
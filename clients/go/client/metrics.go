@@ -0,0 +1,240 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palner/apiban/clients/go/apiban"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/metrics"
+)
+
+// Metrics are the instruments of a Client.  All methods are safe to call on
+// a nil *Metrics.
+type Metrics struct {
+	Registry *metrics.Registry
+
+	lastSync      *metrics.Gauge
+	lastSuccess   *metrics.Gauge
+	syncs         *metrics.Counter
+	lkid          *metrics.Gauge
+	banned        *metrics.Gauge
+	rules         *metrics.Gauge
+	runAdded      *metrics.Gauge
+	runRemoved    *metrics.Gauge
+	runFailed     *metrics.Gauge
+	added         *metrics.Counter
+	removed       *metrics.Counter
+	suppressed    *metrics.Counter
+	guardTrips    *metrics.Counter
+	apiDuration   *metrics.Histogram
+	apiErrors     *metrics.Counter
+	pages         *metrics.Counter
+	flushes       *metrics.Counter
+	applyDuration *metrics.Histogram
+}
+
+// NewMetrics registers the client metrics in a new Registry
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		Registry: r,
+
+		lastSync:      r.NewGauge("apiban_last_sync_timestamp_seconds", "Time of the last sync attempt."),
+		lastSuccess:   r.NewGauge("apiban_last_success_timestamp_seconds", "Time of the last successful sync."),
+		syncs:         r.NewCounter("apiban_syncs_total", "Syncs by result.", "result"),
+		lkid:          r.NewGauge("apiban_lkid", "Last known ID received from APIBAN.org."),
+		banned:        r.NewGauge("apiban_banned_addresses", "Banned networks in the firewall, by address family.", "family"),
+		rules:         r.NewGauge("apiban_rules", "Rules in the firewall, by address family; fewer than the banned networks when AGGREGATE is set.", "family"),
+		runAdded:      r.NewGauge("apiban_last_run_added", "Addresses added by the last sync."),
+		runRemoved:    r.NewGauge("apiban_last_run_removed", "Addresses removed by the last sync."),
+		runFailed:     r.NewGauge("apiban_last_run_failed", "Addresses which could not be added by the last sync."),
+		added:         r.NewCounter("apiban_added_total", "Addresses added to the firewall."),
+		removed:       r.NewCounter("apiban_removed_total", "Addresses removed from the firewall."),
+		suppressed:    r.NewCounter("apiban_suppressed_total", "Addresses from the feed which were not banned, by reason.", "reason"),
+		guardTrips:    r.NewCounter("apiban_guard_trips_total", "Feeds which were not applied because they failed a sanity check, by check.", "check"),
+		apiDuration:   r.NewHistogram("apiban_api_request_duration_seconds", "APIBAN.org request latency.", metrics.DefaultBuckets, "kind"),
+		apiErrors:     r.NewCounter("apiban_api_errors_total", "Failed APIBAN.org requests, by type of error.", "type"),
+		pages:         r.NewCounter("apiban_pages_fetched_total", "Pages of the banned list fetched from APIBAN.org."),
+		flushes:       r.NewCounter("apiban_flushes_total", "Flushes of the APIBAN chain."),
+		applyDuration: r.NewHistogram("apiban_rule_apply_duration_seconds", "Time taken to apply the rules of a sync.", metrics.DefaultBuckets),
+	}
+}
+
+// observeRequest records a request to APIBAN.org
+func (m *Metrics) observeRequest(ri apiban.RequestInfo) {
+	if m == nil {
+		return
+	}
+	m.apiDuration.Observe(ri.Duration.Seconds(), ri.Kind)
+	if ri.Err != nil {
+		m.apiErrors.Inc(apiErrorType(ri))
+	} else if ri.Kind == "banned" && ri.StatusCode == http.StatusOK {
+		m.pages.Inc()
+	}
+}
+
+// observeSync records the outcome of a sync
+func (m *Metrics) observeSync(at time.Time, res *Result, err error) {
+	if m == nil {
+		return
+	}
+	m.lastSync.Set(float64(at.Unix()))
+	if err != nil {
+		m.syncs.Inc("failure")
+	} else {
+		m.syncs.Inc("success")
+		m.lastSuccess.Set(float64(at.Unix()))
+	}
+
+	if res == nil {
+		return
+	}
+
+	if id, perr := strconv.ParseFloat(res.ID, 64); perr == nil {
+		m.lkid.Set(id)
+	}
+	m.runAdded.Set(float64(res.Added))
+	m.runRemoved.Set(float64(res.Removed))
+	m.runFailed.Set(float64(res.Failed))
+	m.added.Add(float64(res.Added))
+	m.removed.Add(float64(res.Removed))
+	m.suppressed.Add(float64(res.Suppressed), "allowlist")
+	m.suppressed.Add(float64(res.Protected), "protected")
+	m.suppressed.Add(float64(res.Rejected), "reserved")
+	m.suppressed.Add(float64(res.Invalid), "invalid")
+	if res.Flushed {
+		m.flushes.Inc()
+	}
+}
+
+// observeBanned records the networks currently banned and the rules in the
+// firewall
+func (m *Metrics) observeBanned(list, rules []string) {
+	if m == nil {
+		return
+	}
+	v4, v6 := countFamilies(list)
+	m.banned.Set(float64(v4), "ipv4")
+	m.banned.Set(float64(v6), "ipv6")
+
+	v4, v6 = countFamilies(rules)
+	m.rules.Set(float64(v4), "ipv4")
+	m.rules.Set(float64(v6), "ipv6")
+}
+
+// countFamilies counts the IPv4 and IPv6 networks in list
+func countFamilies(list []string) (v4, v6 int) {
+	for _, n := range list {
+		if strings.Contains(n, ":") {
+			v6++
+		} else {
+			v4++
+		}
+	}
+	return v4, v6
+}
+
+// observeApply records the time taken to apply the rules of a sync
+func (m *Metrics) observeApply(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.applyDuration.Observe(d.Seconds())
+}
+
+// observeGuard records a feed which failed a sanity check
+func (m *Metrics) observeGuard(check string) {
+	if m == nil {
+		return
+	}
+	m.guardTrips.Inc(check)
+}
+
+// observeManual records a manual ban (or unban)
+func (m *Metrics) observeManual(added bool) {
+	if m == nil {
+		return
+	}
+	if added {
+		m.added.Inc()
+	} else {
+		m.removed.Inc()
+	}
+}
+
+// apiErrorType classifies a failed request
+func apiErrorType(ri apiban.RequestInfo) string {
+	switch {
+	case ri.StatusCode == 0:
+		return "network"
+	case ri.StatusCode == http.StatusUnauthorized ||
+		ri.StatusCode == http.StatusForbidden ||
+		ri.Err.Error() == "unauthorized":
+		return "unauthorized"
+	case ri.StatusCode == http.StatusTooManyRequests ||
+		ri.Err.Error() == "rate limit exceeded":
+		return "rate_limit"
+	case ri.StatusCode >= 500:
+		return "server"
+	case ri.StatusCode >= 400:
+		return "client"
+	default:
+		return "decode"
+	}
+}
+
+// ServeMonitoring starts an HTTP listener on addr serving /metrics and
+// /healthz
+func (c *Client) ServeMonitoring(addr string, t HealthThresholds) (*http.Server, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.Metrics.Registry.Handler())
+	mux.Handle("/healthz", c.healthHandler(t))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	srv := &http.Server{
+		Addr:         l.Addr().String(),
+		Handler:      mux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			logging.Error("monitoring listener failed", "error", err)
+		}
+	}()
+
+	logging.Info("serving metrics and health", "address", l.Addr())
+	return srv, nil
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/apiban"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	c, _, cleanup := newTestClient(t, &ApibanConfig{LKID: "300", FLUSH: "200"})
+	defer cleanup()
+	be := c.Backend.(*fakeBackend)
+	be.added = []string{"198.51.100.1", "2001:db8::1"}
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	_, err = c.Metrics.Registry.WriteTo(&buf)
+	assert.NoError(t, err)
+	out := buf.String()
+
+	for _, line := range []string{
+		`apiban_syncs_total{result="success"} 1`,
+		`apiban_lkid 300`,
+		`apiban_banned_addresses{family="ipv4"} 2`,
+		`apiban_banned_addresses{family="ipv6"} 0`,
+		`apiban_last_run_added 2`,
+		`apiban_last_run_removed 2`,
+		`apiban_last_run_failed 1`,
+		`apiban_flushes_total 1`,
+		`apiban_pages_fetched_total 2`,
+		`apiban_api_request_duration_seconds_count{kind="banned"} 3`,
+		`apiban_rule_apply_duration_seconds_count 1`,
+	} {
+		assert.Contains(t, out, line+"\n")
+	}
+
+	// A failed sync is counted but leaves the last success alone
+	c.Config.APIKEY = "otherKey"
+	_, err = c.Sync(false)
+	assert.Error(t, err)
+
+	buf.Reset()
+	_, err = c.Metrics.Registry.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `apiban_syncs_total{result="failure"} 1`+"\n")
+	assert.Contains(t, buf.String(), `apiban_api_errors_total{type="server"} 1`+"\n")
+}
+
+func TestAPIErrorType(t *testing.T) {
+	testCases := map[string]struct {
+		status int
+		err    error
+	}{
+		"network":      {0, errors.New("Query Error: connection refused")},
+		"unauthorized": {http.StatusBadRequest, errors.New("unauthorized")},
+		"rate_limit":   {http.StatusTooManyRequests, errors.New("client error (429)")},
+		"server":       {http.StatusBadGateway, errors.New("server error (502)")},
+		"client":       {http.StatusBadRequest, apiban.ErrBadRequest},
+		"decode":       {http.StatusOK, errors.New("failed to decode server response: EOF")},
+	}
+
+	for want, tc := range testCases {
+		got := apiErrorType(apiban.RequestInfo{StatusCode: tc.status, Err: tc.err})
+		assert.Equal(t, want, got)
+	}
+}
+
+func TestServeMonitoring(t *testing.T) {
+	c := &Client{Metrics: NewMetrics()}
+	c.Metrics.observeSync(time.Unix(1600000000, 0), &Result{ID: "42"}, nil)
+
+	srv, err := c.ServeMonitoring("127.0.0.1:0", DefaultHealthThresholds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/metrics", srv.Addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "apiban_last_success_timestamp_seconds 1.6e+09\n")
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// ResolvConf is the resolver configuration read for the DNS servers
+const ResolvConf = "/etc/resolv.conf"
+
+// Reasons an address is protected
+const (
+	ProtectSSH       = "ssh client"
+	ProtectUser      = "logged-in user"
+	ProtectInterface = "local interface"
+	ProtectGateway   = "default gateway"
+	ProtectResolver  = "dns resolver"
+)
+
+// Protection is an address which is never banned, because blocking it could
+// cut the host off from its own management path
+type Protection struct {
+	Address string `json:"address"`
+	Reason  string `json:"reason"`
+}
+
+// DetectProtected finds the addresses which must never be banned: the
+// client of the SSH session the client runs in, the sources of logged-in
+// users, the local interface addresses, the default gateways and the DNS
+// resolvers.  Sources which can't be read are skipped.
+func DetectProtected() *netlist.List {
+	l := new(netlist.List)
+	add := func(addrs []string, reason string) {
+		for _, a := range addrs {
+			// Scoped addresses (fe80::1%eth0) are kept without the zone
+			if i := strings.IndexByte(a, '%'); i >= 0 {
+				a = a[:i]
+			}
+			_ = l.Add(a, reason)
+		}
+	}
+
+	add(sshClient(os.Getenv("SSH_CONNECTION")), ProtectSSH)
+	add(loggedInUsers(), ProtectUser)
+	add(interfaceAddrs(), ProtectInterface)
+	add(defaultGateways(), ProtectGateway)
+	add(readResolvers(ResolvConf), ProtectResolver)
+
+	return l
+}
+
+// Protections lists the entries of a protected list
+func Protections(l *netlist.List) []Protection {
+	var out []Protection
+	for _, e := range l.Entries() {
+		out = append(out, Protection{Address: e.Net.String(), Reason: e.Source})
+	}
+	return out
+}
+
+// sshClient returns the client address from SSH_CONNECTION ("client port
+// server port")
+func sshClient(conn string) []string {
+	f := strings.Fields(conn)
+	if len(f) == 0 {
+		return nil
+	}
+	return f[:1]
+}
+
+// interfaceAddrs returns the addresses of the local interfaces
+func interfaceAddrs() []string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			out = append(out, n.IP.String())
+		}
+	}
+	return out
+}
+
+// readResolvers returns the nameservers listed in a resolv.conf file
+func readResolvers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			out = append(out, fields[1])
+		}
+	}
+	return out
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+// Files read for the protected addresses
+const (
+	UtmpFile   = "/var/run/utmp"
+	routeFile  = "/proc/net/route"
+	route6File = "/proc/net/ipv6_route"
+)
+
+// Layout of a glibc utmp record, the same on 32 and 64 bit Linux
+const (
+	utmpSize        = 384
+	utmpUserProcess = 7
+	utmpHostOffset  = 76
+	utmpHostSize    = 256
+	utmpAddrOffset  = 348
+)
+
+func loggedInUsers() []string {
+	return readUtmp(UtmpFile)
+}
+
+func defaultGateways() []string {
+	return append(readRoutes(routeFile), readRoutes6(route6File)...)
+}
+
+// readUtmp returns the remote addresses of the user sessions in a utmp file
+func readUtmp(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var out []string
+	for ; len(data) >= utmpSize; data = data[utmpSize:] {
+		rec := data[:utmpSize]
+		if binary.LittleEndian.Uint16(rec) != utmpUserProcess {
+			continue
+		}
+
+		addr := rec[utmpAddrOffset : utmpAddrOffset+net.IPv6len]
+		switch {
+		case isZero(addr[4:]) && !isZero(addr[:4]):
+			out = append(out, net.IP(addr[:4]).String())
+		case !isZero(addr):
+			out = append(out, net.IP(addr).String())
+		default:
+			// Older programs only fill in the host name
+			host := rec[utmpHostOffset : utmpHostOffset+utmpHostSize]
+			if i := strings.IndexByte(string(host), 0); i >= 0 {
+				host = host[:i]
+			}
+			if ip := net.ParseIP(string(host)); ip != nil {
+				out = append(out, ip.String())
+			}
+		}
+	}
+	return out
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// readRoutes returns the gateways of the IPv4 default routes in
+// /proc/net/route
+func readRoutes(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Iface Destination Gateway Flags ..., in host byte order
+		fields := strings.Fields(s.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != net.IPv4len || isZero(gw) {
+			continue
+		}
+		out = append(out, net.IPv4(gw[3], gw[2], gw[1], gw[0]).String())
+	}
+	return out
+}
+
+// readRoutes6 returns the gateways of the IPv6 default routes in
+// /proc/net/ipv6_route
+func readRoutes6(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// Destination PrefixLen Source PrefixLen NextHop ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 5 || fields[1] != "00" || strings.Trim(fields[0], "0") != "" {
+			continue
+		}
+		gw, err := hex.DecodeString(fields[4])
+		if err != nil || len(gw) != net.IPv6len || isZero(gw) {
+			continue
+		}
+		out = append(out, net.IP(gw).String())
+	}
+	return out
+}
@@ -0,0 +1,64 @@
+package client
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// utmpRecord builds a glibc utmp record
+func utmpRecord(typ uint16, host string, addr net.IP) []byte {
+	rec := make([]byte, utmpSize)
+	binary.LittleEndian.PutUint16(rec, typ)
+	copy(rec[utmpHostOffset:], host)
+	if ip4 := addr.To4(); ip4 != nil {
+		copy(rec[utmpAddrOffset:], ip4)
+	} else {
+		copy(rec[utmpAddrOffset:], addr)
+	}
+	return rec
+}
+
+func TestProcFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	route := write("route", []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+			"eth0\t00000000\t010200C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n"+
+			"eth0\t000200C0\t00000000\t0001\t0\t0\t100\t00FFFFFF\t0\t0\t0\n"))
+	assert.Equal(t, []string{"192.0.2.1"}, readRoutes(route))
+
+	route6 := write("ipv6_route", []byte(
+		"00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0\n"+
+			"20010db8000000000000000000000000 40 00000000000000000000000000000000 00 00000000000000000000000000000000 00000100 00000001 00000000 00000001 eth0\n"+
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 00000000000000000000000000000000 ffffffff 00000001 00000000 00200200 lo\n"))
+	assert.Equal(t, []string{"fe80::1"}, readRoutes6(route6))
+
+	var utmp []byte
+	utmp = append(utmp, utmpRecord(2, "5.10.0", nil)...)
+	utmp = append(utmp, utmpRecord(utmpUserProcess, "", nil)...)
+	utmp = append(utmp, utmpRecord(utmpUserProcess, "198.51.100.20", net.ParseIP("198.51.100.20"))...)
+	utmp = append(utmp, utmpRecord(utmpUserProcess, "", net.ParseIP("2001:db8::20"))...)
+	utmp = append(utmp, utmpRecord(utmpUserProcess, "203.0.113.9", nil)...)
+	utmp = append(utmp, utmpRecord(utmpUserProcess, "admin.example.com", nil)...)
+	assert.Equal(t, []string{"198.51.100.20", "2001:db8::20", "203.0.113.9"}, readUtmp(write("utmp", utmp)))
+
+	assert.Empty(t, readRoutes(filepath.Join(dir, "missing")))
+}
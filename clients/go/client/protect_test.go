@@ -0,0 +1,42 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSHClient(t *testing.T) {
+	assert.Equal(t, []string{"198.51.100.20"}, sshClient("198.51.100.20 51234 192.0.2.10 22"))
+	assert.Equal(t, []string{"2001:db8::20"}, sshClient("2001:db8::20 51234 2001:db8::10 22"))
+	assert.Empty(t, sshClient(""))
+}
+
+func TestReadResolvers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "resolv.conf")
+	data := "# generated\nsearch example.com\nnameserver 192.0.2.53\nnameserver 2001:db8::53\noptions edns0\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"192.0.2.53", "2001:db8::53"}, readResolvers(path))
+	assert.Empty(t, readResolvers(filepath.Join(dir, "missing")))
+}
+
+func TestDetectProtected(t *testing.T) {
+	os.Setenv("SSH_CONNECTION", "198.51.100.20 51234 192.0.2.10 22")
+	defer os.Unsetenv("SSH_CONNECTION")
+
+	got := Protections(DetectProtected())
+	assert.Contains(t, got, Protection{Address: "198.51.100.20/32", Reason: ProtectSSH})
+	assert.Contains(t, got, Protection{Address: "127.0.0.1/32", Reason: ProtectInterface})
+}
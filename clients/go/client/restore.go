@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// SnapshotFile returns the location of the snapshot of the bans
+func (c *Client) SnapshotFile() string {
+	return state.SnapshotFile(c.statePath())
+}
+
+// takeSnapshot records the entries the firewall holds, for Restore
+func (c *Client) takeSnapshot() {
+	list, err := c.Backend.List()
+	if err != nil {
+		logging.Error("reading the bans for the snapshot failed", "error", err)
+		return
+	}
+
+	s := &state.Snapshot{Taken: time.Now(), LKID: c.State.LKID, Entries: canonicalAll(list)}
+	if err := s.Save(c.SnapshotFile()); err != nil {
+		logging.Error("saving the snapshot failed", "error", err)
+	}
+}
+
+// Restore puts back the bans of the last snapshot without reaching
+// APIBAN.org or the other sources, such as at boot before the network is up.
+// Allowlisted and protected entries are skipped.  The next sync reconciles
+// the rules with the state.
+func (c *Client) Restore() (*Result, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := &Result{ID: c.State.LKID}
+	if c.opts.ReadOnly {
+		return res, ErrReadOnly
+	}
+
+	s, err := state.LoadSnapshot(c.SnapshotFile())
+	if err == state.ErrNoSnapshot {
+		logging.Info("no snapshot to restore", "snapshot", c.SnapshotFile())
+		return res, nil
+	}
+	if err != nil {
+		return res, err
+	}
+
+	if _, err := c.Backend.Init(); err != nil {
+		return res, fmt.Errorf("failed to initialize IPTables: %w", err)
+	}
+	c.refreshProtected()
+
+	for _, addr := range s.Entries {
+		if c.admit(addr, res) {
+			c.add(addr, res)
+		}
+	}
+
+	c.State.Restored = time.Now()
+	if err := c.State.Save(); err != nil {
+		return res, err
+	}
+
+	logging.Info("snapshot restored", "taken", s.Taken, "lkid", s.LKID, "entries", len(s.Entries), "added", res.Added, "failed", res.Failed,
+		"suppressed", res.Suppressed, "protected", res.Protected)
+	return res, nil
+}
+
+// reconcile makes the rules match the state after a Restore: the entries
+// the snapshot lacked are added and those the state no longer bans removed
+func (c *Client) reconcile(res *Result) {
+	list, err := c.Backend.List()
+	if err != nil {
+		logging.Error("reading the bans to reconcile failed", "error", err)
+		return
+	}
+
+	want := c.desired()
+	have := canonicalAll(list)
+
+	added, removed := 0, 0
+	for _, addr := range want {
+		if !containsEntry(have, addr) && c.add(addr, res) {
+			added++
+		}
+	}
+	for _, addr := range have {
+		if containsEntry(want, addr) {
+			continue
+		}
+		if err := c.Backend.Remove(addr); err != nil {
+			logging.Warning("removing rule failed", "ip", addr, "error", err)
+			continue
+		}
+		c.lifted(addr, "not in the state after a restore")
+		removed++
+	}
+	res.Removed += removed
+
+	logging.Info("restored bans reconciled", "restored", c.State.Restored, "added", added, "removed", removed)
+}
+
+// desired returns the entries to be banned, sorted: the feed entries, list
+// entries and manual bans which score enough and are neither allowlisted
+// nor protected, and the escalated networks
+func (c *Client) desired() []string {
+	var out []string
+	for _, addr := range c.applied() {
+		if _, ok := c.allowed(addr); ok {
+			continue
+		}
+		if _, ok := c.isProtected(addr); ok {
+			continue
+		}
+		if c.passes(addr) {
+			out = append(out, addr)
+		}
+	}
+	for _, e := range c.State.Escalations() {
+		out = append(out, e.Network)
+	}
+	return canonicalAll(out)
+}
+
+// canonicalAll returns the entries in canonical form, sorted and each once
+func canonicalAll(entries []string) []string {
+	seen := make(map[string]bool, len(entries))
+	out := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if n, err := netlist.ParseNet(e); err == nil {
+			e = canonical(n)
+		}
+		if !seen[e] {
+			seen[e] = true
+			out = append(out, e)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
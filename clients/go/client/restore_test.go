@@ -0,0 +1,56 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestore(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+
+	// Nothing to restore before the first sync
+	res, err := c.Restore()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Added)
+	assert.True(t, c.State.Restored.IsZero())
+
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	s, err := state.LoadSnapshot(c.SnapshotFile())
+	if assert.NoError(t, err) {
+		assert.Equal(t, "300", s.LKID)
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, s.Entries)
+	}
+
+	// After a reboot the chain is back before any sync; what the
+	// allowlist now covers stays out
+	be.added = nil
+	be.created = true
+	c.allow = new(netlist.List)
+	assert.NoError(t, c.allow.Add("192.0.2.2", "test"))
+	res, err = c.Restore()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Added)
+	assert.Equal(t, 1, res.Suppressed)
+	assert.Equal(t, []string{"192.0.2.1"}, be.added)
+	assert.False(t, c.State.Restored.IsZero())
+
+	saved, err := state.Load(c.State.Path())
+	assert.NoError(t, err)
+	assert.False(t, saved.Restored.IsZero())
+
+	// The next sync reconciles the rules with the state
+	c.allow = nil
+	be.added = append(be.added, "198.51.100.9")
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.False(t, res.Flushed)
+	assert.Equal(t, 1, res.Added)
+	assert.Equal(t, 1, res.Removed)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2"}, be.added)
+	assert.True(t, c.State.Restored.IsZero())
+}
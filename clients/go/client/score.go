@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+)
+
+// Score explains whether an address is banned: the sources listing it, what
+// each weighs and how the total compares with SCORE_THRESHOLD
+type Score struct {
+	Address string        `json:"address"`
+	Sources []SourceScore `json:"sources"`
+	Total   int           `json:"total"`
+
+	// Threshold is SCORE_THRESHOLD; with 0, any source bans
+	Threshold int `json:"threshold"`
+
+	// Manual indicates a manual ban, which applies whatever the score
+	Manual bool `json:"manual"`
+
+	// Ban reports whether the address is to be banned
+	Ban bool `json:"ban"`
+}
+
+// SourceScore is what a source adds to a Score
+type SourceScore struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Score returns the score of an address or CIDR.  Sources are matched by
+// entry, so a list banning 192.0.2.0/24 does not count towards 192.0.2.1.
+func (c *Client) Score(addr string) (*Score, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := netlist.ParseNet(addr); err != nil {
+		return nil, err
+	}
+	return c.score(addr), nil
+}
+
+func (c *Client) score(addr string) *Score {
+	s := &Score{Address: addr, Sources: []SourceScore{}, Threshold: c.Config.SCORETHRESHOLD}
+	for _, name := range c.provenance(addr) {
+		if name == source.ManualName {
+			s.Manual = true
+			continue
+		}
+		w := c.weight(name)
+		s.Sources = append(s.Sources, SourceScore{Name: name, Weight: w})
+		s.Total += w
+	}
+
+	if s.Threshold == 0 {
+		s.Ban = s.Manual || len(s.Sources) > 0
+	} else {
+		s.Ban = s.Manual || s.Total >= s.Threshold
+	}
+	return s
+}
+
+// passes reports whether addr is to be banned
+func (c *Client) passes(addr string) bool {
+	return c.score(addr).Ban
+}
+
+// weight returns the weight of a source; one no longer configured weighs
+// nothing
+func (c *Client) weight(name string) int {
+	if name == source.APIBANName {
+		return c.Config.FEEDWEIGHT
+	}
+	if l := c.list(name); l != nil {
+		return l.spec.Weight
+	}
+	return 0
+}
+
+// scoring describes the threshold and weights, to tell when they change
+func (c *Client) scoring() string {
+	if c.Config.SCORETHRESHOLD == 0 {
+		return ""
+	}
+
+	parts := []string{
+		fmt.Sprintf("threshold=%d", c.Config.SCORETHRESHOLD),
+		fmt.Sprintf("%s=%d", source.APIBANName, c.Config.FEEDWEIGHT),
+	}
+	for _, l := range c.lists {
+		parts = append(parts, fmt.Sprintf("%s=%d", l.spec.Name, l.spec.Weight))
+	}
+	return strings.Join(parts, " ")
+}
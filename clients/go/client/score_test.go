@@ -0,0 +1,86 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScore(t *testing.T) {
+	lists := map[string]string{
+		"/drop.txt":    "192.0.2.1\n198.51.100.1\n",
+		"/trusted.txt": "203.0.113.9\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(lists[r.URL.Path]))
+	}))
+	defer srv.Close()
+
+	c, be, cleanup := newTestClient(t, &ApibanConfig{
+		SCORETHRESHOLD: 2,
+		FEEDWEIGHT:     1,
+		SOURCES: []string{
+			"drop=" + srv.URL + "/drop.txt",
+			"trusted=" + srv.URL + "/trusted.txt;weight=2",
+		},
+	})
+	defer cleanup()
+	var err error
+	c.lists, err = openLists(c.Config, srv.Client())
+	assert.NoError(t, err)
+
+	// Only the entries listed by both the feed and drop, or by trusted,
+	// reach the threshold
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, res.Unscored)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "203.0.113.9"}, be.added)
+
+	s, err := c.Score("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, &Score{
+		Address:   "192.0.2.1",
+		Sources:   []SourceScore{{Name: "apiban", Weight: 1}, {Name: "drop", Weight: 1}},
+		Total:     2,
+		Threshold: 2,
+		Ban:       true,
+	}, s)
+
+	s, err = c.Score("192.0.2.2")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.Total)
+	assert.False(t, s.Ban)
+
+	_, err = c.Score("bad")
+	assert.EqualError(t, err, `invalid address "bad"`)
+
+	// A manual ban applies whatever the score, and when it expires the rule
+	// goes unless the score holds it
+	assert.NoError(t, c.Ban("198.51.100.1", time.Hour, ""))
+	s, err = c.Score("198.51.100.1")
+	assert.NoError(t, err)
+	assert.True(t, s.Manual)
+	assert.True(t, s.Ban)
+	m, _ := c.State.ManualBan("198.51.100.1")
+	past := time.Now().Add(-time.Minute)
+	m.Until = &past
+	c.State.Ban(m)
+
+	// drop no longer backs 192.0.2.1
+	lists["/drop.txt"] = "198.51.100.1\n"
+	res, err = c.Sync(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Expired)
+	assert.ElementsMatch(t, []string{"203.0.113.9"}, be.added)
+
+	// Changing the threshold replaces the rules
+	c.Config.SCORETHRESHOLD = 1
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.True(t, res.Flushed)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2", "198.51.100.1", "203.0.113.9"}, be.added)
+	assert.Equal(t, "threshold=1 apiban=1 drop=1 trusted=2", c.State.Scoring)
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CredentialName is the name of the systemd credential holding the API key
+// (LoadCredential=apikey:/path/to/file)
+const CredentialName = "apikey"
+
+// checkSecretFile refuses a file holding a secret which other users can read
+// or anyone but its owner can change, and warns if its group can read it
+func checkSecretFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	mode := fi.Mode().Perm()
+	if mode&0022 != 0 {
+		return "", fmt.Errorf("%s is writable by other users (mode %04o); run chmod 600 %s", path, mode, path)
+	}
+	if mode&0004 != 0 {
+		return "", fmt.Errorf("%s is readable by all users (mode %04o); run chmod 600 %s", path, mode, path)
+	}
+	if mode&0040 != 0 {
+		return fmt.Sprintf("%s is readable by its group (mode %04o); consider chmod 600 %s", path, mode, path), nil
+	}
+	return "", nil
+}
+
+// readSecret reads a secret from a file, which must be private.  Surrounding
+// white space is dropped.
+func readSecret(path string) (secret, warning string, err error) {
+	warning, err = checkSecretFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret = strings.TrimSpace(string(data))
+	if secret == "" {
+		return "", "", fmt.Errorf("%s is empty", path)
+	}
+	return secret, warning, nil
+}
+
+// loadKey reads the API key from APIKEY_FILE or the systemd credential, which
+// take precedence over APIKEY, and checks that a key kept in the
+// configuration file is not exposed
+func (cfg *ApibanConfig) loadKey() error {
+	path, source := cfg.APIKEYFILE, cfg.sources["APIKEY_FILE"]
+	if path == "" {
+		if dir := os.Getenv("CREDENTIALS_DIRECTORY"); dir != "" {
+			cred := filepath.Join(dir, CredentialName)
+			if _, err := os.Stat(cred); err == nil {
+				path, source = cred, "systemd credential "+CredentialName
+			}
+		}
+	}
+
+	if path != "" {
+		key, warning, err := readSecret(path)
+		if err != nil {
+			return fmt.Errorf("failed to read API key: %w", err)
+		}
+		if warning != "" {
+			cfg.Warnings = append(cfg.Warnings, warning)
+		}
+
+		cfg.APIKEY = key
+		cfg.sources["APIKEY"] = source
+		return nil
+	}
+
+	// The key is in the configuration file itself
+	if cfg.APIKEY != "" && cfg.sourceFile != "" && cfg.sources["APIKEY"] == cfg.sourceFile {
+		if _, err := checkSecretFile(cfg.sourceFile); err != nil {
+			cfg.Warnings = append(cfg.Warnings, fmt.Sprintf("the API key is exposed: %v, or move the key to APIKEY_FILE", err))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+)
+
+// shadowSuffix is appended to the main chain to name the chain of the hooks
+// in shadow mode (APIBAN_SHADOW)
+const shadowSuffix = "_SHADOW"
+
+// shadowPrefix marks the packets logged in shadow mode
+const shadowPrefix = "APIBAN-SHADOW "
+
+// shadowTarget returns the target and its options for the rules of the
+// shadow chain
+func (cfg *ApibanConfig) shadowTarget() (string, []string) {
+	switch cfg.SHADOWACTION {
+	case ShadowNflog:
+		return "NFLOG", []string{"--nflog-group", strconv.Itoa(cfg.SHADOWNFLOGGROUP), "--nflog-prefix", strings.TrimSpace(shadowPrefix)}
+	case ShadowCount:
+		return firewall.Count, nil
+	default:
+		return "LOG", []string{"--log-prefix", shadowPrefix}
+	}
+}
+
+// shadowMatches returns the rate limit of what the shadow chain logs or
+// passes on, which keeps a busy host from flooding the logs
+func (cfg *ApibanConfig) shadowMatches() []string {
+	if l := cfg.SHADOWLOGLIMIT; l != "" && l != "0" && cfg.SHADOWACTION != ShadowCount {
+		return []string{"-m", "limit", "--limit", l, "--limit-burst", strconv.Itoa(cfg.SHADOWLOGBURST)}
+	}
+	return nil
+}
+
+// isShadow reports whether fc is the shadow chain
+func isShadow(fc firewall.Config) bool {
+	return strings.HasSuffix(fc.Chain, shadowSuffix)
+}
+
+// tee is a Backend which applies the bans to a Backend per chain.  It
+// reports the bans of the first.
+type tee []Backend
+
+func (t tee) Init() (bool, error) {
+	var created bool
+	for _, be := range t {
+		c, err := be.Init()
+		if err != nil {
+			return created, err
+		}
+		created = created || c
+	}
+	return created, nil
+}
+
+func (t tee) Add(addr string) error {
+	return t.each(func(be Backend) error { return be.Add(addr) })
+}
+
+// Remove lifts the ban from every chain holding it
+func (t tee) Remove(addr string) error {
+	var first error
+	removed := false
+	for _, be := range t {
+		if err := be.Remove(addr); err != nil {
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		removed = true
+	}
+	if removed {
+		return nil
+	}
+	return first
+}
+
+func (t tee) List() ([]string, error) {
+	return t[0].List()
+}
+
+func (t tee) SetPaused(paused bool) error {
+	return t.each(func(be Backend) error { return be.SetPaused(paused) })
+}
+
+func (t tee) SetAllowed(addrs []string) error {
+	return t.each(func(be Backend) error { return be.SetAllowed(addrs) })
+}
+
+func (t tee) Flush() error {
+	return t.each(Backend.Flush)
+}
+
+func (t tee) Teardown() error {
+	return t.each(Backend.Teardown)
+}
+
+// each calls fn for every Backend, returning the first error
+func (t tee) each(fn func(Backend) error) error {
+	var first error
+	for _, be := range t {
+		if err := fn(be); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// counter is implemented by Backends which count the packets matched by
+// each ban, such as *firewall.Firewall
+type counter interface {
+	Counters() ([]firewall.Counter, error)
+}
+
+// ShadowReport summarises the traffic from banned sources seen by the hooks
+// in shadow mode: the packets which would have been dropped
+type ShadowReport struct {
+
+	// Since is the start of the observation window; the counters restart
+	// whenever the chain is rebuilt or flushed
+	Since time.Time `json:"since"`
+
+	// Hooks are the hooks in shadow mode and Action what their rules do
+	Hooks  []string `json:"hooks"`
+	Action string   `json:"action"`
+
+	// Banned is the number of banned entries in the shadow chain, and
+	// Rules the number of rules holding them (fewer with AGGREGATE)
+	Banned int `json:"banned"`
+	Rules  int `json:"rules"`
+
+	// Hits are the rules which matched traffic, busiest first
+	Hits []ShadowHit `json:"hits"`
+}
+
+// ShadowHit is the traffic matched by a rule of the shadow chain
+type ShadowHit struct {
+	firewall.Counter
+
+	// Entries are the banned entries of a rule AGGREGATE merged.  Traffic
+	// is counted by rule, so it can't be told apart between them.
+	Entries []string `json:"entries,omitempty"`
+
+	// Sources are the sources banning the rule or its entries
+	Sources []string `json:"sources"`
+}
+
+// ShadowReport reads the counters of the shadow chain
+func (c *Client) ShadowReport() (*ShadowReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shadow == nil {
+		return nil, fmt.Errorf("no hooks are in shadow mode (see SHADOW)")
+	}
+
+	cb, ok := c.shadow.(counter)
+	if !ok {
+		return nil, fmt.Errorf("the firewall does not count packets")
+	}
+
+	counters, err := cb.Counters()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ShadowReport{
+		Since:  c.State.ShadowSince,
+		Hooks:  c.shadowHooks,
+		Action: c.Config.SHADOWACTION,
+		Rules:  len(counters),
+		Hits:   []ShadowHit{},
+	}
+	for _, n := range counters {
+		entries := c.members(n.Source)
+		held := entries
+		if held == nil {
+			held = []string{n.Source}
+		}
+		r.Banned += len(held)
+		if n.Packets == 0 {
+			continue
+		}
+
+		h := ShadowHit{Counter: n, Entries: entries, Sources: []string{}}
+		for _, e := range held {
+			for _, name := range c.provenance(e) {
+				if !contains(h.Sources, name) {
+					h.Sources = append(h.Sources, name)
+				}
+			}
+		}
+		r.Hits = append(r.Hits, h)
+	}
+	sort.SliceStable(r.Hits, func(i, j int) bool { return r.Hits[i].Packets > r.Hits[j].Packets })
+
+	return r, nil
+}
+
+// observeShadow moves the start of the observation window to now if the
+// counters were reset, and clears it when no hooks are in shadow mode
+func (c *Client) observeShadow(now time.Time, reset bool) {
+	switch {
+	case c.shadow == nil:
+		c.State.ShadowSince = time.Time{}
+	case reset || c.State.ShadowSince.IsZero():
+		c.State.ShadowSince = now
+	}
+}
+
+// contains reports whether list holds value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/stretchr/testify/assert"
+)
+
+// countingBackend is a fakeBackend which counts a packet per ban
+type countingBackend struct {
+	fakeBackend
+	hits map[string]uint64
+}
+
+func (b *countingBackend) Counters() ([]firewall.Counter, error) {
+	var out []firewall.Counter
+	for _, a := range b.added {
+		out = append(out, firewall.Counter{Source: a, Packets: b.hits[a], Bytes: 60 * b.hits[a]})
+	}
+	return out, nil
+}
+
+func TestShadowReport(t *testing.T) {
+	c, be, done := newTestClient(t, DefaultConfig())
+	defer done()
+
+	_, err := c.ShadowReport()
+	assert.EqualError(t, err, "no hooks are in shadow mode (see SHADOW)")
+
+	shadow := &countingBackend{hits: map[string]uint64{"192.0.2.1": 2, "192.0.2.2": 7}}
+	c.Backend = tee{be, shadow}
+	c.shadow = shadow
+	c.shadowHooks = []string{"FORWARD"}
+
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	since := c.State.ShadowSince
+	assert.WithinDuration(t, time.Now(), since, time.Minute)
+	assert.Equal(t, be.added, shadow.added)
+
+	r, err := c.ShadowReport()
+	assert.NoError(t, err)
+	assert.Equal(t, &ShadowReport{
+		Since:  since,
+		Hooks:  []string{"FORWARD"},
+		Action: ShadowLog,
+		Banned: 2,
+		Rules:  2,
+		Hits: []ShadowHit{
+			{Counter: firewall.Counter{Source: "192.0.2.2", Packets: 7, Bytes: 420}, Sources: []string{"apiban"}},
+			{Counter: firewall.Counter{Source: "192.0.2.1", Packets: 2, Bytes: 120}, Sources: []string{"apiban"}},
+		},
+	}, r)
+
+	// The window carries on until the counters restart
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, since, c.State.ShadowSince)
+}
+
+func TestShadowReportAggregated(t *testing.T) {
+	c, be, done := newTestClient(t, DefaultConfig())
+	defer done()
+
+	shadow := &countingBackend{hits: map[string]uint64{"192.0.2.2/31": 5}}
+	c.Backend = newAggregator(tee{be, shadow}, c.applied)
+	c.shadow = shadow
+	c.shadowHooks = []string{"FORWARD"}
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Ban("192.0.2.3", 0, ""))
+
+	r, err := c.ShadowReport()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, r.Banned)
+	assert.Equal(t, 2, r.Rules)
+	assert.Equal(t, []ShadowHit{{
+		Counter: firewall.Counter{Source: "192.0.2.2/31", Packets: 5, Bytes: 300},
+		Entries: []string{"192.0.2.2", "192.0.2.3"},
+		Sources: []string{"apiban", "manual"},
+	}}, r.Hits)
+}
@@ -0,0 +1,386 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/palner/apiban/clients/go/apiban"
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// list is a source merged with the APIBAN feed (see SOURCES)
+type list struct {
+	spec  *source.Spec
+	src   source.Source
+	allow *netlist.List
+
+	// err is the error of the last sync of the list, if it failed
+	err error
+}
+
+// openLists returns the lists of the configuration; hc fetches the remote
+// ones
+func openLists(cfg *ApibanConfig, hc *http.Client) ([]*list, error) {
+	specs, err := cfg.Sources()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*list
+	for _, spec := range specs {
+		allow, err := spec.Allowlist()
+		if err != nil {
+			return nil, fmt.Errorf("SOURCES: %v", err)
+		}
+		out = append(out, &list{spec: spec, src: spec.Open(hc), allow: allow})
+	}
+	return out, nil
+}
+
+// syncLists fetches the lists which are due, or all of them if full is set,
+// and applies what changed.  A list which fails is logged and keeps its
+// entries; the others and the feed carry on.
+func (c *Client) syncLists(res *Result, now time.Time, full, force bool) {
+	c.retireLists(res)
+
+	for _, l := range c.lists {
+		prev, _ := c.State.Source(l.spec.Name)
+		if !full && now.Sub(prev.Fetched) < l.spec.Refresh {
+			continue
+		}
+
+		l.err = c.syncList(l, prev, res, now, full, force)
+		if l.err != nil {
+			logging.Error("syncing source failed", "source", l.spec.Name, "error", l.err)
+		}
+	}
+}
+
+// syncList fetches a list, bans the entries whose score it lifts to the
+// threshold and lifts those whose score falls below it
+func (c *Client) syncList(l *list, prev state.Source, res *Result, now time.Time, full, force bool) error {
+	name := l.spec.Name
+
+	cursor := prev.Cursor
+	if full {
+		cursor = ""
+	}
+	b, err := l.src.Fetch(cursor)
+	if err != nil {
+		return err
+	}
+
+	if b.Unchanged() {
+		logging.Debug("source unchanged", "source", name)
+		prev.Name = name
+		prev.Fetched = now
+		c.State.SetSource(prev)
+		return nil
+	}
+
+	entries := b.Entries
+	if !b.Full {
+		entries = append(append([]string(nil), prev.Entries...), b.Entries...)
+	}
+	keep := c.screenList(l, entries, res)
+	sort.Strings(keep)
+
+	if err := c.Config.checkFeed(keep, prev.Entries, b.Full); err != nil {
+		if !force {
+			c.Metrics.observeGuard(err.(*GuardError).Check)
+			return err
+		}
+		logging.Warning("applying the source despite the sanity check", "source", name, "reason", err.(*GuardError).Reason)
+	}
+
+	// Only the entries the list gained or dropped change their score
+	next := state.Source{Name: name, Cursor: b.Cursor, Fetched: now, Entries: keep}
+	banned := make(map[string]bool)
+	gained := make(map[string]bool)
+	for _, ip := range keep {
+		if !prev.Lists(ip) {
+			gained[ip] = true
+			banned[ip] = c.passes(ip)
+		}
+	}
+	var dropped []string
+	for _, ip := range prev.Entries {
+		if !gained[ip] && !containsEntry(keep, ip) {
+			dropped = append(dropped, ip)
+			banned[ip] = c.passes(ip)
+		}
+	}
+	c.State.SetSource(next)
+
+	added := 0
+	var failed []string
+	for _, ip := range keep {
+		if !gained[ip] || banned[ip] {
+			continue
+		}
+		if !c.passes(ip) {
+			logging.Debug("not blocking address below the score threshold", "ip", ip, "source", name, "score", c.score(ip).Total)
+			res.Unscored++
+			continue
+		}
+		if c.add(ip, res) {
+			added++
+		} else {
+			failed = append(failed, ip)
+		}
+	}
+
+	// Note that the list still bans the entries it kept, or bans those it
+	// gained which something else already banned
+	for _, ip := range keep {
+		if !containsEntry(failed, ip) && c.passes(ip) {
+			c.banned(ip, name)
+		}
+	}
+	if len(failed) > 0 {
+		next.Entries = nil
+		for _, ip := range keep {
+			if !containsEntry(failed, ip) {
+				next.Entries = append(next.Entries, ip)
+			}
+		}
+		c.State.SetSource(next)
+	}
+
+	removed := 0
+	for _, ip := range dropped {
+		if !banned[ip] || c.passes(ip) {
+			continue
+		}
+		if err := c.Backend.Remove(ip); err != nil {
+			logging.Warning("removing rule failed", "ip", ip, "source", name, "error", err)
+			continue
+		}
+		logging.Debug("unblocking", "ip", ip, "source", name)
+		c.lifted(ip, "no longer listed by "+name)
+		removed++
+	}
+	res.Removed += removed
+
+	next, _ = c.State.Source(name)
+	logging.Info("source synced", "source", name, "entries", len(next.Entries), "added", added, "removed", removed)
+	return nil
+}
+
+// screenList drops the entries of a list which are invalid, reserved,
+// allowlisted (for all sources or for this one) or protected, and returns
+// the rest, each once and in the form the feed uses
+func (c *Client) screenList(l *list, entries []string, res *Result) []string {
+	reserved := netlist.Reserved()
+	override, err := c.Config.ReservedOverride()
+	if err != nil {
+		override = new(netlist.List)
+	}
+
+	seen := make(map[string]bool, len(entries))
+	var out []string
+	for _, e := range entries {
+		n, err := netlist.ParseNet(e)
+		if err != nil {
+			logging.Debug("skipping invalid entry", "entry", e, "source", l.spec.Name)
+			res.Invalid++
+			continue
+		}
+
+		ip := canonical(n)
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+
+		if r, ok := isReserved(reserved, override, e); ok {
+			logging.Warning("rejecting reserved address", "ip", ip, "range", r.Net, "kind", r.Source, "source", l.spec.Name)
+			res.Rejected++
+			continue
+		}
+
+		if a, ok := l.allow.Match(n); ok {
+			logging.Info("not blocking allowlisted address", "ip", ip, "match", a.Net, "source", a.Source)
+			res.Suppressed++
+			continue
+		}
+
+		if c.admit(ip, res) {
+			out = append(out, ip)
+		}
+	}
+	return out
+}
+
+// applyLists puts the entries of the lists back after the chain was created
+// or flushed
+func (c *Client) applyLists() {
+	for _, l := range c.lists {
+		src, ok := c.State.Source(l.spec.Name)
+		if !ok {
+			continue
+		}
+
+		for _, ip := range src.Entries {
+			if _, ok := match(l.allow, ip); ok {
+				continue
+			}
+			if _, ok := c.allowed(ip); ok {
+				continue
+			}
+			if _, ok := c.isProtected(ip); ok {
+				continue
+			}
+			if !c.passes(ip) {
+				continue
+			}
+			if err := c.Backend.Add(ip); err != nil {
+				logging.Error("applying source entry failed", "ip", ip, "source", l.spec.Name, "error", err)
+			}
+		}
+	}
+}
+
+// retireLists lifts the entries of the lists no longer configured
+func (c *Client) retireLists(res *Result) {
+	for _, src := range c.State.Sources() {
+		if c.list(src.Name) != nil {
+			continue
+		}
+
+		banned := make(map[string]bool, len(src.Entries))
+		for _, ip := range src.Entries {
+			banned[ip] = c.passes(ip)
+		}
+
+		c.State.DropSource(src.Name)
+		removed := 0
+		for _, ip := range src.Entries {
+			if !banned[ip] || c.passes(ip) {
+				continue
+			}
+			if err := c.Backend.Remove(ip); err != nil {
+				logging.Warning("removing rule failed", "ip", ip, "source", src.Name, "error", err)
+				continue
+			}
+			c.lifted(ip, "source "+src.Name+" removed")
+			removed++
+		}
+		res.Removed += removed
+		logging.Info("source removed", "source", src.Name, "removed", removed)
+	}
+}
+
+// list returns the list of the given name, if it is configured
+func (c *Client) list(name string) *list {
+	for _, l := range c.lists {
+		if l.spec.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Provenance returns what bans an address or CIDR: source.APIBANName for
+// the feed, the names of the other lists and source.ManualName for a manual
+// ban
+func (c *Client) Provenance(addr string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.provenance(addr)
+}
+
+func (c *Client) provenance(addr string) []string {
+	key := addr
+	var out []string
+	if n, err := netlist.ParseNet(addr); err == nil {
+		key = canonical(n)
+		if _, ok := c.feedEntry(n); ok {
+			out = append(out, source.APIBANName)
+		}
+	} else if c.State.IsApplied(addr) {
+		out = append(out, source.APIBANName)
+	}
+
+	out = append(out, c.State.Listed(key)...)
+	if _, ok := c.State.ManualBan(key); ok {
+		out = append(out, source.ManualName)
+	}
+	return out
+}
+
+// containsEntry reports whether sorted holds entry
+func containsEntry(sorted []string, entry string) bool {
+	i := sort.SearchStrings(sorted, entry)
+	return i < len(sorted) && sorted[i] == entry
+}
+
+// SourceStatus describes a source of bans
+type SourceStatus struct {
+	Name     string    `json:"name"`
+	Location string    `json:"location"`
+	Entries  int       `json:"entries"`
+	Fetched  time.Time `json:"fetched"`
+	Refresh  string    `json:"refresh,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// sourceStatus describes the feed and the lists
+func (c *Client) sourceStatus() []SourceStatus {
+	root := ""
+	if c.API != nil {
+		root = c.API.RootURL
+	}
+	if root == "" {
+		root = apiban.RootURL
+	}
+	out := []SourceStatus{{
+		Name:     source.APIBANName,
+		Location: root,
+		Entries:  len(c.State.Applied()),
+		Fetched:  c.State.LastSuccess,
+	}}
+
+	for _, l := range c.lists {
+		src, _ := c.State.Source(l.spec.Name)
+		st := SourceStatus{
+			Name:     l.spec.Name,
+			Location: l.spec.Location,
+			Entries:  len(src.Entries),
+			Fetched:  src.Fetched,
+			Refresh:  l.spec.Refresh.String(),
+		}
+		if l.err != nil {
+			st.Error = l.err.Error()
+		}
+		out = append(out, st)
+	}
+	return out
+}
@@ -0,0 +1,138 @@
+package client
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/palner/apiban/clients/go/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSources(t *testing.T) {
+	drop := "192.0.2.1 ; SBL1\n198.51.100.0/24 ; SBL2\n"
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		_, _ = w.Write([]byte(drop))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "local.csv")
+	assert.NoError(t, ioutil.WriteFile(local, []byte("when,ip\n2020-01-01,203.0.113.5\n2020-01-01,203.0.113.6\n2020-01-01,bad\n"), 0644))
+
+	c, be, cleanup := newTestClient(t, &ApibanConfig{
+		MINPREFIXV4: 24,
+		SOURCES: []string{
+			"drop=" + srv.URL + "/drop.txt;refresh=1h",
+			"local=" + local + ";column=2;allow=203.0.113.6",
+		},
+	})
+	defer cleanup()
+	c.lists, err = openLists(c.Config, srv.Client())
+	assert.NoError(t, err)
+
+	res, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, res.Added)
+	assert.Equal(t, 1, res.Failed)
+	assert.Equal(t, 1, res.Invalid)
+	assert.Equal(t, 1, res.Suppressed)
+	assert.ElementsMatch(t, []string{"192.0.2.1", "192.0.2.2", "198.51.100.0/24", "203.0.113.5"}, be.added)
+	assert.Equal(t, []string{source.APIBANName, "drop"}, c.Provenance("192.0.2.1/32"))
+	assert.Equal(t, []string{"local"}, c.Provenance("203.0.113.5"))
+	assert.Empty(t, c.Provenance("203.0.113.6"))
+	assert.Equal(t, 1, fetches)
+
+	// The lists are only fetched again when due
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// An entry dropped by a list is lifted unless another source bans it
+	drop = "198.51.100.0/24 ; SBL2\n"
+	res, err = c.Sync(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, fetches)
+	assert.Zero(t, res.Removed)
+	assert.Contains(t, be.added, "192.0.2.1")
+	assert.Equal(t, []string{source.APIBANName}, c.Provenance("192.0.2.1"))
+
+	drop = ""
+	res, err = c.Sync(true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Removed)
+	assert.NotContains(t, be.added, "198.51.100.0/24")
+
+	// A recreated chain gets the entries of the lists back
+	be.added = nil
+	be.created = true
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Contains(t, be.added, "203.0.113.5")
+
+	st, err := c.Status()
+	assert.NoError(t, err)
+	if assert.Len(t, st.Sources, 3) {
+		assert.Equal(t, SourceStatus{Name: "local", Location: local, Entries: 1, Fetched: st.Sources[2].Fetched, Refresh: "1h0m0s"}, st.Sources[2])
+		assert.Equal(t, 0, st.Sources[1].Entries)
+	}
+
+	// A failing list keeps its entries
+	assert.NoError(t, os.Remove(local))
+	_, err = c.Sync(true)
+	assert.NoError(t, err)
+	assert.Contains(t, be.added, "203.0.113.5")
+	st, err = c.Status()
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(st.Sources[2].Error, "no such file or directory"))
+
+	// A list taken out of the configuration is lifted
+	c.lists = c.lists[:1]
+	res, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, res.Removed)
+	assert.NotContains(t, be.added, "203.0.113.5")
+	_, ok := c.State.Source("local")
+	assert.False(t, ok)
+}
+
+func TestSourceGuard(t *testing.T) {
+	c, be, cleanup := newTestClient(t, &ApibanConfig{LKID: "300", FLUSH: "9999999999", MAXADDS: 3})
+	defer cleanup()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("203.0.113.1\n203.0.113.2\n203.0.113.3\n203.0.113.4\n"))
+	}))
+	defer srv.Close()
+
+	c.Config.SOURCES = []string{"drop=" + srv.URL}
+	var err error
+	c.lists, err = openLists(c.Config, srv.Client())
+	assert.NoError(t, err)
+	c.State.SetSource(state.Source{Name: "drop", Fetched: time.Now()})
+
+	// The list is not due
+	_, err = c.Sync(false)
+	assert.NoError(t, err)
+	assert.Empty(t, be.added)
+
+	_, err = c.Sync(true)
+	assert.NoError(t, err)
+	assert.NotContains(t, be.added, "203.0.113.1")
+	assert.EqualError(t, c.lists[0].err, "feed failed the sanity check: 4 new entries, more than MAX_ADDS (3); keeping the current rules (run with -force to apply it anyway)")
+
+	_, err = c.ForceSync(true)
+	assert.NoError(t, err)
+	assert.Contains(t, be.added, "203.0.113.2")
+}
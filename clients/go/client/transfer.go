@@ -0,0 +1,163 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/palner/apiban/clients/go/logging"
+	"github.com/palner/apiban/clients/go/netlist"
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/palner/apiban/clients/go/state"
+)
+
+// ImportFile returns the location of the last file imported, kept with the
+// state so the import list survives restarts and flushes
+func (c *Client) ImportFile() string {
+	return filepath.Join(filepath.Dir(c.statePath()), "import.json")
+}
+
+// importList returns the list of the last file imported, if any.  The file
+// holds what the exporting client decided to ban, so the list bans on its
+// own whatever SCORE_THRESHOLD is.
+func (c *Client) importList(cfg *ApibanConfig) *list {
+	path := c.ImportFile()
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	weight := cfg.SCORETHRESHOLD
+	if weight == 0 {
+		weight = 1
+	}
+	spec := &source.Spec{
+		Name:     source.ImportName,
+		Location: path,
+		Format:   source.FormatExport,
+		Column:   1,
+		Refresh:  source.DefaultRefresh,
+		Weight:   weight,
+	}
+	return &list{spec: spec, src: spec.Open(nil), allow: new(netlist.List)}
+}
+
+// Export returns the entries to be banned, with what banned them and the
+// LKID, for Import on another host
+func (c *Client) Export() (*source.Export, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	host, _ := os.Hostname()
+	e := &source.Export{Exported: time.Now(), Host: host, LKID: c.State.LKID, Entries: []source.ExportEntry{}}
+	for _, addr := range c.desired() {
+		x := source.ExportEntry{Address: addr, Sources: c.provenance(addr)}
+		if m, ok := c.State.ManualBan(addr); ok {
+			x.Reason, x.Until = m.Reason, m.Until
+		}
+		if esc, ok := c.State.Escalation(addr); ok {
+			x.Sources = append(x.Sources, escalationSource)
+			x.Reason = esc.Reason
+		}
+		e.Entries = append(e.Entries, x)
+	}
+	return e, nil
+}
+
+// Import applies a file written by Export in place of the last one.  Its
+// entries go through the checks of any other list (see SOURCES): reserved,
+// allowlisted and protected entries are dropped and, unless force is set,
+// the sanity checks apply.  Entries the previous file held but this one
+// doesn't are lifted.
+func (c *Client) Import(r io.Reader, force bool) (*Result, error) {
+	if c.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	e, err := source.ReadExport(r)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := &Result{ID: c.State.LKID}
+	now := time.Now()
+
+	// Keep the file, uncompressed, for the import list to read; the
+	// previous one is put back if this one is refused
+	path := c.ImportFile()
+	old, oldErr := ioutil.ReadFile(path)
+	var buf bytes.Buffer
+	if err := e.Write(&buf, false); err != nil {
+		return res, err
+	}
+	if err := state.WriteFile(path, buf.Bytes()); err != nil {
+		return res, err
+	}
+	undo := func() {
+		if oldErr == nil {
+			_ = state.WriteFile(path, old)
+		} else {
+			os.Remove(path)
+		}
+	}
+
+	l := c.list(source.ImportName)
+	if l == nil {
+		l = c.importList(c.Config)
+		c.lists = append(c.lists, l)
+	}
+
+	created, err := c.Backend.Init()
+	if err != nil {
+		undo()
+		return res, fmt.Errorf("failed to initialize IPTables: %w", err)
+	}
+	c.refreshProtected()
+	if created {
+		c.recreated()
+	}
+
+	prev, _ := c.State.Source(source.ImportName)
+	if l.err = c.syncList(l, prev, res, now, true, force); l.err != nil {
+		undo()
+		return res, l.err
+	}
+
+	c.escalate(res)
+	err = c.State.Save()
+	if err == nil {
+		c.takeSnapshot()
+	}
+	c.writeHistory(nil)
+
+	logging.Info("import applied", "exported", e.Exported, "host", e.Host, "lkid", e.LKID, "entries", len(e.Entries), "added", res.Added,
+		"failed", res.Failed, "invalid", res.Invalid, "removed", res.Removed, "suppressed", res.Suppressed, "protected", res.Protected, "rejected", res.Rejected)
+	return res, err
+}
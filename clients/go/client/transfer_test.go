@@ -0,0 +1,72 @@
+package client
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/source"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransfer(t *testing.T) {
+	c, _, cleanup := newTestClient(t, &ApibanConfig{})
+	defer cleanup()
+
+	_, err := c.Sync(false)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Ban("198.51.100.7", time.Hour, "SIP scan"))
+
+	e, err := c.Export()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "300", e.LKID)
+	if assert.Len(t, e.Entries, 3) {
+		assert.Equal(t, source.ExportEntry{Address: "192.0.2.1", Sources: []string{"apiban"}}, e.Entries[0])
+		assert.Equal(t, "198.51.100.7", e.Entries[2].Address)
+		assert.Equal(t, []string{"manual"}, e.Entries[2].Sources)
+		assert.Equal(t, "SIP scan", e.Entries[2].Reason)
+		assert.NotNil(t, e.Entries[2].Until)
+	}
+
+	var file bytes.Buffer
+	assert.NoError(t, e.Write(&file, true))
+
+	// The isolated host applies the file like any other list
+	isolated, be, done := newTestClient(t, &ApibanConfig{MAXADDS: 2})
+	defer done()
+
+	_, err = isolated.Import(bytes.NewReader(file.Bytes()), false)
+	if assert.IsType(t, &GuardError{}, err) {
+		assert.Equal(t, "adds", err.(*GuardError).Check)
+	}
+	assert.Empty(t, be.added)
+	_, err = os.Stat(isolated.ImportFile())
+	assert.True(t, os.IsNotExist(err))
+
+	res, err := isolated.Import(bytes.NewReader(file.Bytes()), true)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, res.Added)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "198.51.100.7"}, be.added)
+	assert.Equal(t, []string{source.ImportName}, isolated.provenance("192.0.2.1"))
+
+	// The import list is kept, to be reopened with the configuration
+	assert.NotNil(t, isolated.importList(isolated.Config))
+
+	// A newer file replaces the last one
+	e.Entries = e.Entries[:1]
+	file.Reset()
+	assert.NoError(t, e.Write(&file, false))
+	res, err = isolated.Import(&file, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, res.Added)
+	assert.Equal(t, 2, res.Removed)
+	assert.Equal(t, []string{"192.0.2.1"}, be.added)
+
+	_, err = isolated.Import(strings.NewReader("192.0.2.1\n"), false)
+	assert.Error(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, be.added)
+}
@@ -0,0 +1,1127 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package firewall
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+const table = "filter"
+
+// Count is the Target of entries which only count matching packets: their
+// rules have no -j and the packets carry on through the chain
+const Count = "COUNT"
+
+// verdictSuffix is appended to the chain holding the entries to name the
+// chain of a Verdict which takes more than a target (APIBAN_VERDICT)
+const verdictSuffix = "_VERDICT"
+
+// probeSuffix is appended to the main chain to name the scratch chain
+// CheckVerdict tries the Verdict in
+const probeSuffix = "_PROBE"
+
+// outSuffix is appended to the main chain to name the chain of the OUTPUT
+// hook when it shares a Config with inbound hooks (APIBAN_OUT)
+const outSuffix = "_OUT"
+
+// outputHook is the built-in chain of the packets the host sends.  Their
+// source is the host itself, so its entries match the destination.
+const outputHook = "OUTPUT"
+
+// DefaultHooks are the built-in chains which jump to the main chain unless
+// Config.Hooks says otherwise
+var DefaultHooks = []string{"INPUT", "FORWARD"}
+
+// ErrNoIPv6 indicates an IPv6 address was supplied but ip6tables is not
+// available on this host
+var ErrNoIPv6 = errors.New("ip6tables is not available")
+
+// IPTables is the subset of the go-iptables API used by the Firewall
+type IPTables interface {
+	ListChains(table string) ([]string, error)
+	List(table, chain string) ([]string, error)
+	ListWithCounters(table, chain string) ([]string, error)
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Delete(table, chain string, rulespec ...string) error
+}
+
+// Config describes the chain layout managed by the Firewall
+type Config struct {
+
+	// Chain is the name of the main chain (normally APIBAN)
+	Chain string
+
+	// Hooks are the built-in chains which jump to Chain (e.g. INPUT and
+	// FORWARD).  The entries of OUTPUT match the destination rather than the
+	// source, so along with other hooks it jumps to a chain of its own,
+	// named after Chain (APIBAN_OUT).
+	Hooks []string
+
+	// Target is the target for matching entries (e.g. REJECT, DROP, LOG or
+	// Count)
+	Target string
+
+	// TargetArgs are the options of Target (e.g. --log-prefix APIBAN)
+	TargetArgs []string
+
+	// Matches, if set, are options which a packet must also match for
+	// Target to apply (e.g. -m limit --limit 10/minute).  The entries then
+	// jump to a chain of their own holding Target, so that their counters
+	// still count every packet.  They don't apply to Count.
+	Matches []string
+
+	// Verdict, if set, replaces Target.  A Verdict which takes more than a
+	// target gets a chain of its own, which the entries jump to.
+	Verdict Verdict
+
+	// Sharded spreads the entries over sub-chains, keyed by the first octet
+	// of an IPv4 address or the first 16 bits of an IPv6 address.  Chain
+	// then only contains the jumps into those sub-chains, along with the
+	// entries too wide to fit in one.
+	Sharded bool
+
+	// AllowTarget is the target of the allow rules placed ahead of the
+	// entries (RETURN or ACCEPT)
+	AllowTarget string
+
+	// Unhook are built-in chains which must not jump to Chain, normally
+	// because they were moved to another chain.  Init removes any such
+	// jumps.
+	Unhook []string
+
+	// Retire are chains left behind by another configuration.  Init removes
+	// them, along with their shards and the jumps into them from Hooks and
+	// Unhook.
+	Retire []string
+}
+
+// Counter is the traffic matched by an entry
+type Counter struct {
+	Source  string `json:"source"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Match is the rule of an entry holding an address, as iptables -S prints
+// it
+type Match struct {
+	Chain  string `json:"chain"`
+	Source string `json:"source"`
+	Rule   string `json:"rule"`
+}
+
+// Firewall manages the APIBAN chains in iptables and, when available,
+// ip6tables
+type Firewall struct {
+	cfg     Config
+	ipv4    IPTables
+	ipv6    IPTables
+	paused  bool
+	allowed []*net.IPNet
+
+	// shards are the shard chains known to exist and be dispatched to, per
+	// table.  They are forgotten by Init and whenever the shards are
+	// deleted, so iptables is read once per sync rather than once per Add.
+	shards map[IPTables]map[string]bool
+}
+
+// New returns a Firewall using the system iptables and ip6tables commands.
+// ip6tables is optional; if it cannot be found, IPv6 entries are refused with
+// ErrNoIPv6.
+func New(cfg Config) (*Firewall, error) {
+	ipv4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return nil, err
+	}
+
+	fw := NewWithTables(cfg, ipv4, nil)
+
+	ipv6, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+	if err == nil {
+		fw.ipv6 = ipv6
+	}
+
+	return fw, nil
+}
+
+// NewWithTables returns a Firewall using the supplied tables.  ipv6 may be
+// nil.
+func NewWithTables(cfg Config, ipv4 IPTables, ipv6 IPTables) *Firewall {
+	if cfg.Chain == "" {
+		cfg.Chain = "APIBAN"
+	}
+	if len(cfg.Hooks) == 0 {
+		cfg.Hooks = DefaultHooks
+	}
+	if cfg.Verdict.Target != "" {
+		cfg.Target = cfg.Verdict.Target
+		if cfg.Verdict.chained() {
+			cfg.Target = cfg.Chain + verdictSuffix
+		}
+	}
+	if cfg.Target == "" {
+		cfg.Target = "REJECT"
+	}
+	if cfg.AllowTarget == "" {
+		cfg.AllowTarget = "RETURN"
+	}
+
+	return &Firewall{
+		cfg:  cfg,
+		ipv4: ipv4,
+		ipv6: ipv6,
+	}
+}
+
+// HasIPv6 indicates whether ip6tables is being managed
+func (fw *Firewall) HasIPv6() bool {
+	return fw.ipv6 != nil
+}
+
+// tables returns the managed tables, IPv4 first
+func (fw *Firewall) tables() []IPTables {
+	if fw.ipv6 == nil {
+		return []IPTables{fw.ipv4}
+	}
+	return []IPTables{fw.ipv4, fw.ipv6}
+}
+
+// Init makes sure the chain layout exists and is hooked into the built-in
+// chains.  It returns true if the chain had to be (re)built, in which case the
+// caller should pull the full list again.
+func (fw *Firewall) Init() (bool, error) {
+	var created bool
+	fw.shards = nil
+
+	for _, ipt := range fw.tables() {
+		c, err := fw.initTable(ipt)
+		if err != nil {
+			return created, err
+		}
+		created = created || c
+	}
+
+	return created, nil
+}
+
+func (fw *Firewall) initTable(ipt IPTables) (bool, error) {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return false, fmt.Errorf("failed to read iptables: %w", err)
+	}
+
+	for _, hook := range fw.cfg.Hooks {
+		if !contains(chains, hook) {
+			return false, fmt.Errorf("iptables does not contain expected %s chain", hook)
+		}
+	}
+
+	for _, old := range fw.cfg.Retire {
+		if contains(chains, old) && old != fw.cfg.Chain {
+			if err := fw.retire(ipt, old); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	// The OUTPUT chain is no longer needed once OUTPUT is the only hook,
+	// or no hook at all
+	if out := fw.cfg.Chain + outSuffix; contains(chains, out) && !fw.hasSide(out) {
+		if err := fw.retire(ipt, out); err != nil {
+			return false, err
+		}
+	}
+
+	created := false
+	for _, s := range fw.sides() {
+		if !contains(chains, s.chain) {
+			// Add the chain
+			if err := ipt.ClearChain(table, s.chain); err != nil {
+				return false, fmt.Errorf("failed to clear %s chain: %w", s.chain, err)
+			}
+			created = true
+			continue
+		}
+
+		ok, err := fw.layoutMatches(ipt, chains, s)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			// The chain was built for another layout or target; start over
+			if err := fw.flushChain(ipt, s.chain); err != nil {
+				return false, err
+			}
+			created = true
+		}
+	}
+
+	for _, s := range fw.sides() {
+		if err := fw.setVerdict(ipt, s); err != nil {
+			return false, err
+		}
+		if err := fw.setAllowRules(ipt, s); err != nil {
+			return false, err
+		}
+	}
+
+	return created, fw.setHooks(ipt, !fw.paused)
+}
+
+// side is a chain holding the entries, which match the banned addresses as
+// the source of packets, or as their destination for the OUTPUT hook
+type side struct {
+	chain string
+	match string
+}
+
+// sides returns the chains holding the entries: the main chain, matching
+// sources unless OUTPUT is the only hook, and the OUTPUT chain if OUTPUT
+// shares the Config with other hooks
+func (fw *Firewall) sides() []side {
+	var in, out bool
+	for _, h := range fw.cfg.Hooks {
+		if h == outputHook {
+			out = true
+		} else {
+			in = true
+		}
+	}
+
+	switch {
+	case !out:
+		return []side{{fw.cfg.Chain, "-s"}}
+	case !in:
+		return []side{{fw.cfg.Chain, "-d"}}
+	}
+	return []side{{fw.cfg.Chain, "-s"}, {fw.cfg.Chain + outSuffix, "-d"}}
+}
+
+// sideOf returns the side hook jumps to
+func (fw *Firewall) sideOf(hook string) side {
+	sides := fw.sides()
+	if hook == outputHook {
+		return sides[len(sides)-1]
+	}
+	return sides[0]
+}
+
+// chained reports whether the entries jump to a verdict chain, for a
+// Verdict which takes more than a target or for Matches
+func (fw *Firewall) chained() bool {
+	return fw.cfg.Verdict.chained() || len(fw.cfg.Matches) > 0 && fw.cfg.Target != Count
+}
+
+// target returns the target of the entries of s: their verdict chain, or
+// the configured target
+func (fw *Firewall) target(s side) string {
+	if fw.chained() {
+		return s.chain + verdictSuffix
+	}
+	return fw.cfg.Target
+}
+
+// verdictRules returns the rules of the verdict chain of s, in the table
+// for IPv6 if v6 is set
+func (fw *Firewall) verdictRules(s side, v6 bool) [][]string {
+	if fw.cfg.Verdict.chained() {
+		return fw.cfg.Verdict.rules(s.chain, v6, s.match == "-d")
+	}
+
+	r := append(append([]string(nil), fw.cfg.Matches...), "-j", fw.cfg.Target)
+	return [][]string{append(r, fw.cfg.TargetArgs...)}
+}
+
+// hasSide reports whether chain is one of the sides
+func (fw *Firewall) hasSide(chain string) bool {
+	for _, s := range fw.sides() {
+		if s.chain == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// setVerdict makes the verdict chain of s hold the rules of the Verdict, or
+// of Target with Matches, or removes it if there is no need for one
+func (fw *Firewall) setVerdict(ipt IPTables, s side) error {
+	name := s.chain + verdictSuffix
+	if !fw.chained() {
+		return dropChain(ipt, name)
+	}
+
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return fmt.Errorf("failed to read iptables: %w", err)
+	}
+
+	want := fw.verdictRules(s, ipt == fw.ipv6)
+	if contains(chains, name) {
+		rules, err := ipt.List(table, name)
+		if err != nil {
+			return fmt.Errorf("failed to list %s chain: %w", name, err)
+		}
+
+		same := countRules(rules) == len(want)
+		for _, r := range want {
+			ok, err := ipt.Exists(table, name, r...)
+			if err != nil {
+				return fmt.Errorf("failed to check %s chain: %w", name, err)
+			}
+			same = same && ok
+		}
+		if same {
+			return nil
+		}
+	}
+
+	if err := ipt.ClearChain(table, name); err != nil {
+		return fmt.Errorf("failed to clear %s chain: %w", name, err)
+	}
+	for _, r := range want {
+		if err := ipt.AppendUnique(table, name, r...); err != nil {
+			return fmt.Errorf("failed to set up the %s verdict in %s chain: %w", fw.verdict(), name, err)
+		}
+	}
+
+	return nil
+}
+
+// CheckVerdict tries the rules of the verdict chain in a scratch chain,
+// which is then removed, to tell whether iptables has the targets and
+// matches they need, such as TARPIT from xtables-addons
+func (fw *Firewall) CheckVerdict() error {
+	if !fw.chained() {
+		return nil
+	}
+
+	name := fw.cfg.Chain + probeSuffix
+	for _, ipt := range fw.tables() {
+		if err := ipt.ClearChain(table, name); err != nil {
+			return fmt.Errorf("failed to clear %s chain: %w", name, err)
+		}
+
+		var err error
+		for _, r := range fw.verdictRules(side{name, "-s"}, ipt == fw.ipv6) {
+			if err = ipt.AppendUnique(table, name, r...); err != nil {
+				break
+			}
+		}
+
+		if derr := dropChain(ipt, name); derr != nil {
+			return derr
+		}
+		if err != nil {
+			return fmt.Errorf("iptables does not support the %s verdict: %w", fw.verdict(), err)
+		}
+	}
+
+	return nil
+}
+
+// verdict describes the verdict chain for errors
+func (fw *Firewall) verdict() string {
+	if fw.cfg.Verdict.chained() {
+		return fw.cfg.Verdict.String()
+	}
+	return strings.Join(append(append(append([]string(nil), fw.cfg.Matches...), "-j", fw.cfg.Target), fw.cfg.TargetArgs...), " ")
+}
+
+// dropChain removes chain, if present.  Nothing may jump to it.
+func dropChain(ipt IPTables, chain string) error {
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return fmt.Errorf("failed to read iptables: %w", err)
+	}
+	if !contains(chains, chain) {
+		return nil
+	}
+
+	if err := ipt.ClearChain(table, chain); err != nil {
+		return fmt.Errorf("failed to flush %s chain: %w", chain, err)
+	}
+	if err := ipt.DeleteChain(table, chain); err != nil {
+		return fmt.Errorf("failed to delete %s chain: %w", chain, err)
+	}
+	return nil
+}
+
+// countRules counts the rules in the output of List
+func countRules(rules []string) int {
+	n := 0
+	for _, r := range rules {
+		if strings.HasPrefix(r, "-A ") {
+			n++
+		}
+	}
+	return n
+}
+
+// SetAllowed replaces the networks which are let through ahead of the
+// entries.  The allow rules are updated now if the chain exists, and
+// otherwise when it is created.
+func (fw *Firewall) SetAllowed(addrs []string) error {
+	var allowed []*net.IPNet
+	for _, addr := range addrs {
+		n, err := ParseNet(addr)
+		if err != nil {
+			return err
+		}
+		if n.IP.To4() == nil && fw.ipv6 == nil {
+			continue
+		}
+		allowed = append(allowed, n)
+	}
+	fw.allowed = allowed
+
+	for _, ipt := range fw.tables() {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return fmt.Errorf("failed to read iptables: %w", err)
+		}
+		for _, s := range fw.sides() {
+			if !contains(chains, s.chain) {
+				continue
+			}
+			if err := fw.setAllowRules(ipt, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// setAllowRules makes the allow rules at the top of the chain of s match the
+// allowed networks of the table's family
+func (fw *Firewall) setAllowRules(ipt IPTables, s side) error {
+	v4 := ipt == fw.ipv4
+
+	var want []string
+	for _, n := range fw.allowed {
+		if (n.IP.To4() != nil) == v4 {
+			want = append(want, n.String())
+		}
+	}
+
+	rules, err := ipt.List(table, s.chain)
+	if err != nil {
+		return fmt.Errorf("failed to list %s chain: %w", s.chain, err)
+	}
+
+	var have []string
+	for _, r := range rules {
+		if !strings.HasPrefix(r, "-A ") || ruleTarget(r) != fw.cfg.AllowTarget {
+			continue
+		}
+		// A rule matching the other way is left from another set of hooks
+		addr := ruleAddr(r, s.match)
+		if addr == "" || !contains(want, addr) {
+			if err := ipt.Delete(table, s.chain, strings.Fields(r)[2:]...); err != nil {
+				return fmt.Errorf("failed to remove allow rule %q: %w", r, err)
+			}
+			continue
+		}
+		have = append(have, addr)
+	}
+
+	// Insert in reverse, so new rules keep their configured order
+	for i := len(want) - 1; i >= 0; i-- {
+		if contains(have, want[i]) {
+			continue
+		}
+		if err := ipt.Insert(table, s.chain, 1, s.match, want[i], "-j", fw.cfg.AllowTarget); err != nil {
+			return fmt.Errorf("failed to add allow rule for %s: %w", want[i], err)
+		}
+	}
+
+	return nil
+}
+
+// retire removes a chain left behind by another configuration, along with
+// its OUTPUT chain
+func (fw *Firewall) retire(ipt IPTables, chain string) error {
+	hooks := append(append([]string(nil), fw.cfg.Hooks...), fw.cfg.Unhook...)
+	for _, hook := range append(hooks, outputHook) {
+		if err := unhook(ipt, hook, chain); err != nil {
+			return err
+		}
+	}
+
+	// Its entries may jump to the verdict chain
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return fmt.Errorf("failed to read iptables: %w", err)
+	}
+	if contains(chains, chain+outSuffix) {
+		if err := fw.retire(ipt, chain+outSuffix); err != nil {
+			return err
+		}
+	}
+
+	if err := fw.flushChain(ipt, chain); err != nil {
+		return err
+	}
+	if err := ipt.DeleteChain(table, chain); err != nil {
+		return fmt.Errorf("failed to delete %s chain: %w", chain, err)
+	}
+	return dropChain(ipt, chain+verdictSuffix)
+}
+
+// unhook removes the jump from hook into chain, if present
+func unhook(ipt IPTables, hook, chain string) error {
+	ok, err := ipt.Exists(table, hook, "-j", chain)
+	if err != nil {
+		return fmt.Errorf("failed to check %s chain: %w", hook, err)
+	}
+	if !ok {
+		return nil
+	}
+	if err := ipt.Delete(table, hook, "-j", chain); err != nil {
+		return fmt.Errorf("failed to remove %s chain from %s chain: %w", chain, hook, err)
+	}
+	return nil
+}
+
+// setHooks adds or removes the jumps from the built-in chains into the
+// chains of their sides.  Jumps are inserted at position 1.  Jumps from the
+// Unhook chains, and into the other side, are always removed.
+func (fw *Firewall) setHooks(ipt IPTables, on bool) error {
+	own := []string{fw.cfg.Chain, fw.cfg.Chain + outSuffix}
+	for _, hook := range fw.cfg.Unhook {
+		for _, chain := range own {
+			if err := unhook(ipt, hook, chain); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, hook := range fw.cfg.Hooks {
+		chain := fw.sideOf(hook).chain
+		for _, other := range own {
+			if other == chain {
+				continue
+			}
+			if err := unhook(ipt, hook, other); err != nil {
+				return err
+			}
+		}
+
+		ok, err := ipt.Exists(table, hook, "-j", chain)
+		if err != nil {
+			return fmt.Errorf("failed to check %s chain: %w", hook, err)
+		}
+
+		switch {
+		case on && !ok:
+			if err := ipt.Insert(table, hook, 1, "-j", chain); err != nil {
+				return fmt.Errorf("failed to add %s chain to %s chain: %w", chain, hook, err)
+			}
+		case !on && ok:
+			if err := ipt.Delete(table, hook, "-j", chain); err != nil {
+				return fmt.Errorf("failed to remove %s chain from %s chain: %w", chain, hook, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetPaused stops (or resumes) enforcement by removing (or restoring) the
+// jumps into the main chain.  The entries themselves are kept, and Add and
+// Remove keep working while paused.
+func (fw *Firewall) SetPaused(paused bool) error {
+	fw.paused = paused
+
+	for _, ipt := range fw.tables() {
+		if err := fw.setHooks(ipt, !paused); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// layoutMatches reports whether the existing chain of s is laid out as
+// configured (sharded or flat) and its entries have the configured target
+// and match the addresses the way s does
+func (fw *Firewall) layoutMatches(ipt IPTables, chains []string, s side) (bool, error) {
+	shards := shardsOf(s.chain, chains)
+	if !fw.cfg.Sharded && len(shards) > 0 {
+		return false, nil
+	}
+
+	target := fw.target(s)
+	if target == Count {
+		target = ""
+	}
+
+	for _, chain := range append([]string{s.chain}, shards...) {
+		rules, err := ipt.List(table, chain)
+		if err != nil {
+			return false, fmt.Errorf("failed to list %s chain: %w", chain, err)
+		}
+
+		for _, r := range rules {
+			if !strings.HasPrefix(r, "-A ") {
+				continue
+			}
+
+			t := ruleTarget(r)
+			switch {
+			case chain == s.chain && t == fw.cfg.AllowTarget:
+				continue
+			case chain == s.chain && fw.cfg.Sharded && strings.HasPrefix(t, s.chain+"-"):
+				// The jumps into the shards
+				continue
+			case t != target:
+				return false, nil
+			}
+
+			n, err := ParseNet(ruleAddr(r, s.match))
+			if err != nil {
+				return false, nil
+			}
+			// Only the entries too wide for any shard are kept in the
+			// chain itself
+			if fw.cfg.Sharded && chain == s.chain && fw.sharded(n) {
+				return false, nil
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Teardown removes the chains, along with the jumps into them from the
+// built-in chains
+func (fw *Firewall) Teardown() error {
+	for _, ipt := range fw.tables() {
+		if err := fw.setHooks(ipt, false); err != nil {
+			return err
+		}
+
+		for _, s := range fw.sides() {
+			if err := fw.flushChain(ipt, s.chain); err != nil {
+				return err
+			}
+			if err := ipt.DeleteChain(table, s.chain); err != nil {
+				return fmt.Errorf("failed to delete %s chain: %w", s.chain, err)
+			}
+			if err := dropChain(ipt, s.chain+verdictSuffix); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Add blocks the given address or CIDR
+func (fw *Firewall) Add(addr string) error {
+	ipt, n, err := fw.tableFor(addr)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range fw.sides() {
+		chain := s.chain
+		if fw.sharded(n) {
+			if chain, err = fw.ensureShard(ipt, s, n); err != nil {
+				return err
+			}
+		}
+
+		if err := ipt.AppendUnique(table, chain, fw.rule(s, n)...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Remove unblocks the given address or CIDR
+func (fw *Firewall) Remove(addr string) error {
+	ipt, n, err := fw.tableFor(addr)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, s := range fw.sides() {
+		chain := s.chain
+		if fw.sharded(n) {
+			chain, _ = shardFor(s.chain, n)
+		}
+
+		rule := fw.rule(s, n)
+
+		ok, err := ipt.Exists(table, chain, rule...)
+		if err != nil {
+			return fmt.Errorf("failed to check %s chain: %w", chain, err)
+		}
+		if !ok {
+			continue
+		}
+		found = true
+
+		if err := ipt.Delete(table, chain, rule...); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("%s is not blocked", addr)
+	}
+	return nil
+}
+
+// List returns the blocked networks, IPv4 first
+func (fw *Firewall) List() ([]string, error) {
+	var out []string
+
+	// Every side holds the same entries
+	err := fw.eachEntry(IPTables.List, fw.sides()[:1], func(rule, addr string) {
+		out = append(out, addr)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Counters returns the packets and bytes matched by each entry since its rule
+// was added, IPv4 first.  The traffic to an entry from the OUTPUT hook adds
+// to the traffic from it.  The counters restart when the chain is flushed.
+func (fw *Firewall) Counters() ([]Counter, error) {
+	var out []Counter
+	index := make(map[string]int)
+
+	err := fw.eachEntry(IPTables.ListWithCounters, fw.sides(), func(rule, addr string) {
+		c := Counter{Source: addr}
+		fields := strings.Fields(rule)
+		for i := 0; i < len(fields)-2; i++ {
+			if fields[i] == "-c" {
+				c.Packets, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				c.Bytes, _ = strconv.ParseUint(fields[i+2], 10, 64)
+				break
+			}
+		}
+
+		if i, ok := index[addr]; ok {
+			out[i].Packets += c.Packets
+			out[i].Bytes += c.Bytes
+			return
+		}
+		index[addr] = len(out)
+		out = append(out, c)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// Lookup returns the rules of the entries sharing any address with addr,
+// IPv4 first
+func (fw *Firewall) Lookup(addr string) ([]Match, error) {
+	n, err := ParseNet(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Match
+	err = fw.eachEntry(IPTables.List, fw.sides(), func(rule, addr string) {
+		src, err := ParseNet(addr)
+		if err != nil || !netlist.Overlaps(src, n) {
+			return
+		}
+		fields := strings.Fields(rule)
+		out = append(out, Match{Chain: fields[1], Source: src.String(), Rule: rule})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// eachEntry calls fn with the rule and address of every entry of sides, as
+// listed by list
+func (fw *Firewall) eachEntry(list func(IPTables, string, string) ([]string, error), sides []side, fn func(string, string)) error {
+	for _, ipt := range fw.tables() {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return fmt.Errorf("failed to read iptables: %w", err)
+		}
+
+		for _, s := range sides {
+			if !contains(chains, s.chain) {
+				continue
+			}
+
+			target := fw.target(s)
+			if target == Count {
+				target = ""
+			}
+
+			for _, chain := range append([]string{s.chain}, shardsOf(s.chain, chains)...) {
+				rules, err := list(ipt, table, chain)
+				if err != nil {
+					return fmt.Errorf("failed to list %s chain: %w", chain, err)
+				}
+
+				for _, r := range rules {
+					if !strings.HasPrefix(r, "-A ") || ruleTarget(r) != target {
+						continue
+					}
+					if addr := ruleAddr(r, s.match); addr != "" {
+						fn(r, addr)
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Flush removes all entries, along with any shard chains.  The allow rules
+// are kept.
+func (fw *Firewall) Flush() error {
+	for _, ipt := range fw.tables() {
+		for _, s := range fw.sides() {
+			if err := fw.flushChain(ipt, s.chain); err != nil {
+				return err
+			}
+			if err := fw.setAllowRules(ipt, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// flushChain empties chain and deletes its shards
+func (fw *Firewall) flushChain(ipt IPTables, chain string) error {
+	// Clearing the main chain first drops the jumps into the shards, which
+	// must be gone before the shards can be deleted
+	if err := ipt.ClearChain(table, chain); err != nil {
+		return fmt.Errorf("failed to flush %s chain: %w", chain, err)
+	}
+	delete(fw.shards, ipt)
+
+	chains, err := ipt.ListChains(table)
+	if err != nil {
+		return fmt.Errorf("failed to read iptables: %w", err)
+	}
+
+	for _, shard := range shardsOf(chain, chains) {
+		if err := ipt.ClearChain(table, shard); err != nil {
+			return fmt.Errorf("failed to flush %s chain: %w", shard, err)
+		}
+		if err := ipt.DeleteChain(table, shard); err != nil {
+			return fmt.Errorf("failed to delete %s chain: %w", shard, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureShard creates the shard chain of s for n, if needed, and makes sure
+// the chain of s dispatches to it
+func (fw *Firewall) ensureShard(ipt IPTables, s side, n *net.IPNet) (string, error) {
+	name, prefix := shardFor(s.chain, n)
+
+	known, ok := fw.shards[ipt]
+	if !ok {
+		chains, err := ipt.ListChains(table)
+		if err != nil {
+			return "", fmt.Errorf("failed to read iptables: %w", err)
+		}
+		known = map[string]bool{}
+		for _, sd := range fw.sides() {
+			for _, c := range shardsOf(sd.chain, chains) {
+				known[c] = false
+			}
+		}
+		if fw.shards == nil {
+			fw.shards = map[IPTables]map[string]bool{}
+		}
+		fw.shards[ipt] = known
+	}
+
+	// known maps the existing shards to whether the jump into them is
+	// known to be in place
+	if known[name] {
+		return name, nil
+	}
+
+	if _, ok := known[name]; !ok {
+		if err := ipt.ClearChain(table, name); err != nil {
+			return "", fmt.Errorf("failed to create %s chain: %w", name, err)
+		}
+	}
+
+	if err := ipt.AppendUnique(table, s.chain, s.match, prefix, "-j", name); err != nil {
+		return "", fmt.Errorf("failed to add %s chain to %s chain: %w", name, s.chain, err)
+	}
+	known[name] = true
+
+	return name, nil
+}
+
+// sharded reports whether the entry for n goes in a shard.  Entries wider
+// than a shard prefix (e.g. a /4) stay in the main chain, where all traffic
+// of their family is matched against them.
+func (fw *Firewall) sharded(n *net.IPNet) bool {
+	if !fw.cfg.Sharded {
+		return false
+	}
+	ones, _ := n.Mask.Size()
+	if n.IP.To4() != nil {
+		return ones >= 8
+	}
+	return ones >= 16
+}
+
+// shardFor returns the name of the shard of chain for n, and its dispatch
+// prefix.  IPv4 shards are keyed by the first octet (APIBAN-045 for
+// 45.0.0.0/8) and IPv6 shards by the first 16 bits (APIBAN-2001 for
+// 2001::/16).
+func shardFor(chain string, n *net.IPNet) (string, string) {
+	if ip4 := n.IP.To4(); ip4 != nil {
+		return fmt.Sprintf("%s-%03d", chain, ip4[0]), fmt.Sprintf("%d.0.0.0/8", ip4[0])
+	}
+
+	key := uint16(n.IP[0])<<8 | uint16(n.IP[1])
+	return fmt.Sprintf("%s-%04x", chain, key), fmt.Sprintf("%x::/16", key)
+}
+
+// shardsOf returns the shard chains of main among chains
+func shardsOf(main string, chains []string) []string {
+	var out []string
+	for _, c := range chains {
+		if strings.HasPrefix(c, main+"-") {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// tableFor parses addr and returns the table for its family
+func (fw *Firewall) tableFor(addr string) (IPTables, *net.IPNet, error) {
+	n, err := ParseNet(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if n.IP.To4() != nil {
+		return fw.ipv4, n, nil
+	}
+	if fw.ipv6 == nil {
+		return nil, nil, ErrNoIPv6
+	}
+	return fw.ipv6, n, nil
+}
+
+// ParseNet parses an address or CIDR into a network.  A bare address is
+// treated as a host route (/32 or /128).
+func ParseNet(addr string) (*net.IPNet, error) {
+	return netlist.ParseNet(addr)
+}
+
+// rule returns the rulespec of the entry for n in the chain of s
+func (fw *Firewall) rule(s side, n *net.IPNet) []string {
+	spec := []string{"-s", n.String(), "-d", anyNet(n)}
+	if s.match == "-d" {
+		spec = []string{"-s", anyNet(n), "-d", n.String()}
+	}
+	if fw.cfg.Target == Count {
+		return spec
+	}
+	spec = append(spec, "-j", fw.target(s))
+	if fw.chained() {
+		return spec
+	}
+	return append(spec, fw.cfg.TargetArgs...)
+}
+
+// anyNet returns the "any" destination for the family of n
+func anyNet(n *net.IPNet) string {
+	if n.IP.To4() != nil {
+		return "0/0"
+	}
+	return "::/0"
+}
+
+// ruleTarget returns the -j target of a rule as printed by iptables -S
+func ruleTarget(rule string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] == "-j" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// ruleAddr returns the address matched by opt (-s or -d) in a rule as
+// printed by iptables -S, or "" if the rule matches any address there
+func ruleAddr(rule, opt string) string {
+	fields := strings.Fields(rule)
+	for i := 0; i < len(fields)-1; i++ {
+		if fields[i] != opt {
+			continue
+		}
+		switch fields[i+1] {
+		case "0/0", "0.0.0.0/0", "::/0":
+			return ""
+		}
+		return fields[i+1]
+	}
+	return ""
+}
+
+// Function to see if string within string
+func contains(list []string, value string) bool {
+	for _, val := range list {
+		if val == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,603 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTables is an in-memory stand-in for iptables
+type fakeTables struct {
+	chains map[string][]string
+	order  []string
+
+	// hits are the packet counts of rules, keyed like chains
+	hits map[string]int
+
+	// missing are the targets iptables lacks, such as TARPIT
+	missing []string
+}
+
+func newFakeTables() *fakeTables {
+	f := &fakeTables{chains: map[string][]string{}}
+	for _, c := range []string{"INPUT", "FORWARD", "OUTPUT"} {
+		f.chains[c] = nil
+		f.order = append(f.order, c)
+	}
+	return f
+}
+
+func (f *fakeTables) ListChains(table string) ([]string, error) {
+	return append([]string(nil), f.order...), nil
+}
+
+func (f *fakeTables) List(table, chain string) ([]string, error) {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return nil, fmt.Errorf("no chain %s", chain)
+	}
+	out := []string{"-N " + chain}
+	for _, r := range rules {
+		out = append(out, "-A "+chain+" "+r)
+	}
+	return out, nil
+}
+
+func (f *fakeTables) ListWithCounters(table, chain string) ([]string, error) {
+	rules, err := f.List(table, chain)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range rules[1:] {
+		n := f.hits[chain+" "+f.chains[chain][i]]
+		rules[i+1] = fmt.Sprintf("%s -c %d %d", r, n, n*60)
+	}
+	return rules, nil
+}
+
+func (f *fakeTables) ClearChain(table, chain string) error {
+	if _, ok := f.chains[chain]; !ok {
+		f.order = append(f.order, chain)
+	}
+	f.chains[chain] = nil
+	return nil
+}
+
+func (f *fakeTables) DeleteChain(table, chain string) error {
+	if len(f.chains[chain]) > 0 {
+		return fmt.Errorf("chain %s not empty", chain)
+	}
+	for _, rules := range f.chains {
+		for _, r := range rules {
+			if strings.HasSuffix(r, "-j "+chain) {
+				return fmt.Errorf("chain %s is referenced", chain)
+			}
+		}
+	}
+	delete(f.chains, chain)
+	for i, c := range f.order {
+		if c == chain {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	f.chains[chain] = append([]string{strings.Join(rulespec, " ")}, rules...)
+	return nil
+}
+
+func (f *fakeTables) AppendUnique(table, chain string, rulespec ...string) error {
+	if _, ok := f.chains[chain]; !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	if t := ruleTarget(strings.Join(rulespec, " ")); contains(f.missing, t) {
+		return fmt.Errorf("Couldn't load target `%s'", t)
+	}
+	if ok, _ := f.Exists(table, chain, rulespec...); ok {
+		return nil
+	}
+	f.chains[chain] = append(f.chains[chain], strings.Join(rulespec, " "))
+	return nil
+}
+
+func (f *fakeTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	r := strings.Join(rulespec, " ")
+	for _, rule := range f.chains[chain] {
+		if rule == r {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeTables) Delete(table, chain string, rulespec ...string) error {
+	r := strings.Join(rulespec, " ")
+	for i, rule := range f.chains[chain] {
+		if rule == r {
+			f.chains[chain] = append(f.chains[chain][:i], f.chains[chain][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such rule in %s", chain)
+}
+
+func TestInit(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{}, ipt, nil)
+
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["FORWARD"])
+	assert.Empty(t, ipt.chains["OUTPUT"])
+
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+}
+
+func TestInitMissingHook(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Hooks: []string{"INPUT", "PREROUTING"}}, ipt, nil)
+
+	_, err := fw.Init()
+	assert.EqualError(t, err, "iptables does not contain expected PREROUTING chain")
+}
+
+func TestAdd(t *testing.T) {
+	testCases := map[string]struct {
+		cfg    Config
+		addrs  []string
+		chains map[string][]string
+		err    error
+	}{
+		"flat": {
+			addrs: []string{"45.1.2.3", "45.1.2.3", "192.0.2.0/24"},
+			chains: map[string][]string{
+				"APIBAN": {
+					"-s 45.1.2.3/32 -d 0/0 -j REJECT",
+					"-s 192.0.2.0/24 -d 0/0 -j REJECT",
+				},
+			},
+		},
+		"sharded": {
+			cfg:   Config{Sharded: true, Target: "DROP"},
+			addrs: []string{"45.1.2.3", "45.9.9.9", "5.6.7.8"},
+			chains: map[string][]string{
+				"APIBAN": {
+					"-s 45.0.0.0/8 -j APIBAN-045",
+					"-s 5.0.0.0/8 -j APIBAN-005",
+				},
+				"APIBAN-045": {
+					"-s 45.1.2.3/32 -d 0/0 -j DROP",
+					"-s 45.9.9.9/32 -d 0/0 -j DROP",
+				},
+				"APIBAN-005": {
+					"-s 5.6.7.8/32 -d 0/0 -j DROP",
+				},
+			},
+		},
+		"sharded wide": {
+			cfg:   Config{Sharded: true, Target: "DROP"},
+			addrs: []string{"32.0.0.0/4", "45.1.2.3", "45.0.0.0/8"},
+			chains: map[string][]string{
+				"APIBAN": {
+					"-s 32.0.0.0/4 -d 0/0 -j DROP",
+					"-s 45.0.0.0/8 -j APIBAN-045",
+				},
+				"APIBAN-045": {
+					"-s 45.1.2.3/32 -d 0/0 -j DROP",
+					"-s 45.0.0.0/8 -d 0/0 -j DROP",
+				},
+			},
+		},
+		"invalid": {
+			addrs: []string{"45.1.2.300"},
+			err:   fmt.Errorf("invalid address %q", "45.1.2.300"),
+		},
+		"no ip6tables": {
+			addrs: []string{"2001:db8::1"},
+			err:   ErrNoIPv6,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ipt := newFakeTables()
+			fw := NewWithTables(tc.cfg, ipt, nil)
+			_, err := fw.Init()
+			assert.NoError(t, err)
+
+			for _, addr := range tc.addrs {
+				err = fw.Add(addr)
+			}
+			assert.Equal(t, tc.err, err)
+
+			for chain, rules := range tc.chains {
+				assert.Equal(t, rules, ipt.chains[chain], chain)
+			}
+		})
+	}
+}
+
+func TestAddIPv6Sharded(t *testing.T) {
+	ipv4 := newFakeTables()
+	ipv6 := newFakeTables()
+	fw := NewWithTables(Config{Sharded: true}, ipv4, ipv6)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+
+	assert.NoError(t, fw.Add("2001:db8::1"))
+	assert.Equal(t, []string{"-s 2001::/16 -j APIBAN-2001"}, ipv6.chains["APIBAN"])
+	assert.Equal(t, []string{"-s 2001:db8::1/128 -d ::/0 -j REJECT"}, ipv6.chains["APIBAN-2001"])
+	assert.Empty(t, ipv4.chains["APIBAN"])
+}
+
+// countingTables counts the calls to ListChains
+type countingTables struct {
+	*fakeTables
+	listChains int
+}
+
+func (c *countingTables) ListChains(table string) ([]string, error) {
+	c.listChains++
+	return c.fakeTables.ListChains(table)
+}
+
+func TestShardCache(t *testing.T) {
+	ipt := &countingTables{fakeTables: newFakeTables()}
+	fw := NewWithTables(Config{Sharded: true}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+
+	ipt.listChains = 0
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, fw.Add(fmt.Sprintf("45.1.2.%d", i)))
+		assert.NoError(t, fw.Add(fmt.Sprintf("77.1.2.%d", i)))
+	}
+	assert.Equal(t, 1, ipt.listChains)
+	assert.Equal(t, []string{"-s 45.0.0.0/8 -j APIBAN-045", "-s 77.0.0.0/8 -j APIBAN-077"}, ipt.chains["APIBAN"])
+
+	// The shards are recreated after a flush
+	assert.NoError(t, fw.Flush())
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Equal(t, []string{"-s 45.0.0.0/8 -j APIBAN-045"}, ipt.chains["APIBAN"])
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j REJECT"}, ipt.chains["APIBAN-045"])
+}
+
+func TestFlushRemovesShards(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Sharded: true}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.NoError(t, fw.Add("77.1.2.3"))
+
+	assert.NoError(t, fw.Flush())
+	assert.Empty(t, ipt.chains["APIBAN"])
+	assert.NotContains(t, ipt.order, "APIBAN-045")
+	assert.NotContains(t, ipt.order, "APIBAN-077")
+}
+
+func TestInitLayoutChange(t *testing.T) {
+	ipt := newFakeTables()
+
+	// Start out flat
+	fw := NewWithTables(Config{}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// Switching to sharded rebuilds the chain
+	fw = NewWithTables(Config{Sharded: true}, ipt, nil)
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Empty(t, ipt.chains["APIBAN"])
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// Switching back removes the shards
+	fw = NewWithTables(Config{}, ipt, nil)
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.NotContains(t, ipt.order, "APIBAN-045")
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["INPUT"])
+}
+
+func TestTeardown(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Sharded: true}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	assert.NoError(t, fw.Teardown())
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+	assert.Empty(t, ipt.chains["INPUT"])
+	assert.Empty(t, ipt.chains["FORWARD"])
+}
+
+func TestRemoveAndList(t *testing.T) {
+	for _, sharded := range []bool{false, true} {
+		ipv4 := newFakeTables()
+		ipv6 := newFakeTables()
+		fw := NewWithTables(Config{Sharded: sharded}, ipv4, ipv6)
+		_, err := fw.Init()
+		assert.NoError(t, err)
+
+		for _, addr := range []string{"45.1.2.3", "77.1.2.0/24", "2001:db8::1", "2000::/3"} {
+			assert.NoError(t, fw.Add(addr))
+		}
+
+		list, err := fw.List()
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"45.1.2.3/32", "77.1.2.0/24", "2001:db8::1/128", "2000::/3"}, list)
+
+		assert.NoError(t, fw.Remove("45.1.2.3"))
+		assert.EqualError(t, fw.Remove("45.1.2.3"), "45.1.2.3 is not blocked")
+		assert.NoError(t, fw.Remove("2000::/3"))
+
+		list, err = fw.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"77.1.2.0/24", "2001:db8::1/128"}, list)
+
+		// A sharded chain holding wide entries is not a layout change
+		assert.NoError(t, fw.Add("2000::/3"))
+		created, err := fw.Init()
+		assert.NoError(t, err)
+		assert.False(t, created)
+	}
+}
+
+func TestSetPaused(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	assert.NoError(t, fw.SetPaused(true))
+	assert.Empty(t, ipt.chains["INPUT"])
+	assert.Empty(t, ipt.chains["FORWARD"])
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j REJECT"}, ipt.chains["APIBAN"])
+
+	// Syncing while paused must not restore the jumps
+	_, err = fw.Init()
+	assert.NoError(t, err)
+	assert.Empty(t, ipt.chains["INPUT"])
+
+	assert.NoError(t, fw.SetPaused(false))
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["FORWARD"])
+}
+
+func TestSetAllowed(t *testing.T) {
+	for _, sharded := range []bool{false, true} {
+		ipv4 := newFakeTables()
+		ipv6 := newFakeTables()
+		fw := NewWithTables(Config{Sharded: sharded}, ipv4, ipv6)
+
+		// Allowed before the chain exists
+		assert.NoError(t, fw.SetAllowed([]string{"192.0.2.10", "198.51.100.0/24", "2001:db8::1"}))
+		_, err := fw.Init()
+		assert.NoError(t, err)
+		assert.NoError(t, fw.Add("45.1.2.3"))
+
+		assert.Equal(t, []string{"-s 192.0.2.10/32 -j RETURN", "-s 198.51.100.0/24 -j RETURN"}, ipv4.chains["APIBAN"][:2])
+		assert.Equal(t, []string{"-s 2001:db8::1/128 -j RETURN"}, ipv6.chains["APIBAN"])
+
+		list, err := fw.List()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"45.1.2.3/32"}, list)
+
+		// The allow rules do not look like a layout change
+		created, err := fw.Init()
+		assert.NoError(t, err)
+		assert.False(t, created)
+
+		// Flushing keeps them
+		assert.NoError(t, fw.Flush())
+		assert.Equal(t, []string{"-s 192.0.2.10/32 -j RETURN", "-s 198.51.100.0/24 -j RETURN"}, ipv4.chains["APIBAN"])
+
+		// Changing the list updates the rules in place
+		assert.NoError(t, fw.SetAllowed([]string{"198.51.100.0/24", "203.0.113.5"}))
+		assert.Equal(t, []string{"-s 203.0.113.5/32 -j RETURN", "-s 198.51.100.0/24 -j RETURN"}, ipv4.chains["APIBAN"])
+		assert.Empty(t, ipv6.chains["APIBAN"])
+	}
+}
+
+func TestCounters(t *testing.T) {
+	ipt := newFakeTables()
+	ipt.hits = map[string]int{"APIBAN -s 45.1.2.3/32 -d 0/0": 3}
+	fw := NewWithTables(Config{Target: Count}, ipt, nil)
+	assert.NoError(t, fw.SetAllowed([]string{"192.0.2.1"}))
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.NoError(t, fw.Add("77.1.2.3"))
+	assert.Equal(t, []string{"-s 192.0.2.1/32 -j RETURN", "-s 45.1.2.3/32 -d 0/0", "-s 77.1.2.3/32 -d 0/0"}, ipt.chains["APIBAN"])
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32", "77.1.2.3/32"}, list)
+
+	counters, err := fw.Counters()
+	assert.NoError(t, err)
+	assert.Equal(t, []Counter{{Source: "45.1.2.3/32", Packets: 3, Bytes: 180}, {Source: "77.1.2.3/32"}}, counters)
+
+	assert.NoError(t, fw.Remove("45.1.2.3"))
+}
+
+func TestLookup(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Target: "DROP", Sharded: true}, ipt, nil)
+	assert.NoError(t, fw.SetAllowed([]string{"192.0.2.0/24"}))
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("192.0.2.1"))
+	assert.NoError(t, fw.Add("198.51.100.0/24"))
+
+	testCases := map[string]struct {
+		addr string
+		want []string
+	}{
+		"host":    {addr: "192.0.2.1", want: []string{"192.0.2.1/32"}},
+		"network": {addr: "198.51.100.7", want: []string{"198.51.100.0/24"}},
+		"wider":   {addr: "192.0.0.0/8", want: []string{"192.0.2.1/32"}},
+		"none":    {addr: "203.0.113.1", want: nil},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ms, err := fw.Lookup(tc.addr)
+			assert.NoError(t, err)
+			var got []string
+			for _, m := range ms {
+				got = append(got, m.Source)
+				assert.Contains(t, m.Rule, "-A "+m.Chain+" ")
+				assert.Contains(t, m.Rule, "-j DROP")
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestTargetArgs(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Target: "LOG", TargetArgs: []string{"--log-prefix", "APIBAN "}}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j LOG --log-prefix APIBAN "}, ipt.chains["APIBAN"])
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32"}, list)
+
+	assert.NoError(t, fw.Remove("45.1.2.3"))
+	assert.Empty(t, ipt.chains["APIBAN"])
+}
+
+func TestMoveHook(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Sharded: true}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// FORWARD moves to a chain of its own
+	fw = NewWithTables(Config{Sharded: true, Hooks: []string{"INPUT"}, Unhook: []string{"FORWARD"}}, ipt, nil)
+	other := NewWithTables(Config{Chain: "APIBAN_SHADOW", Target: "LOG", Hooks: []string{"FORWARD"}, Unhook: []string{"INPUT"}}, ipt, nil)
+	for _, f := range []*Firewall{fw, other} {
+		_, err = f.Init()
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN_SHADOW"}, ipt.chains["FORWARD"])
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j REJECT"}, ipt.chains["APIBAN-045"])
+
+	// Then INPUT follows, retiring the main chain and its shards
+	other = NewWithTables(Config{Chain: "APIBAN_SHADOW", Target: "LOG", Retire: []string{"APIBAN"}}, ipt, nil)
+	_, err = other.Init()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"-j APIBAN_SHADOW"}, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN_SHADOW"}, ipt.chains["FORWARD"])
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT", "APIBAN_SHADOW"}, ipt.order)
+}
+
+func TestOutputHook(t *testing.T) {
+	ipt := newFakeTables()
+	ipt.hits = map[string]int{
+		"APIBAN -s 45.1.2.3/32 -d 0/0 -j REJECT":     3,
+		"APIBAN_OUT -s 0/0 -d 45.1.2.3/32 -j REJECT": 2,
+	}
+
+	// An older client sent OUTPUT through the chain matching sources
+	assert.NoError(t, ipt.ClearChain(table, "APIBAN"))
+	assert.NoError(t, ipt.Insert(table, "OUTPUT", 1, "-j", "APIBAN"))
+
+	fw := NewWithTables(Config{Hooks: []string{"INPUT", "FORWARD", "OUTPUT"}}, ipt, nil)
+	assert.NoError(t, fw.SetAllowed([]string{"192.0.2.1"}))
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["FORWARD"])
+	assert.Equal(t, []string{"-j APIBAN_OUT"}, ipt.chains["OUTPUT"])
+
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Equal(t, []string{"-s 192.0.2.1/32 -j RETURN", "-s 45.1.2.3/32 -d 0/0 -j REJECT"}, ipt.chains["APIBAN"])
+	assert.Equal(t, []string{"-d 192.0.2.1/32 -j RETURN", "-s 0/0 -d 45.1.2.3/32 -j REJECT"}, ipt.chains["APIBAN_OUT"])
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32"}, list)
+
+	counters, err := fw.Counters()
+	assert.NoError(t, err)
+	assert.Equal(t, []Counter{{Source: "45.1.2.3/32", Packets: 5, Bytes: 300}}, counters)
+
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	assert.NoError(t, fw.Remove("45.1.2.3"))
+	assert.Equal(t, []string{"-d 192.0.2.1/32 -j RETURN"}, ipt.chains["APIBAN_OUT"])
+
+	// With OUTPUT alone, the main chain matches destinations
+	fw = NewWithTables(Config{Hooks: []string{"OUTPUT"}, Unhook: []string{"INPUT", "FORWARD"}}, ipt, nil)
+	_, err = fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Empty(t, ipt.chains["INPUT"])
+	assert.Equal(t, []string{"-j APIBAN"}, ipt.chains["OUTPUT"])
+	assert.Equal(t, []string{"-s 0/0 -d 45.1.2.3/32 -j REJECT"}, ipt.chains["APIBAN"])
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT", "APIBAN"}, ipt.order)
+
+	assert.NoError(t, fw.Teardown())
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+}
+
+func TestMatches(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Chain: "APIBAN_SHADOW", Target: "LOG", TargetArgs: []string{"--log-prefix", "APIBAN-SHADOW "}}, ipt, nil)
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// Rules without the rate limit are replaced
+	limit := []string{"-m", "limit", "--limit", "10/minute", "--limit-burst", "20"}
+	fw = NewWithTables(Config{Chain: "APIBAN_SHADOW", Target: "LOG", TargetArgs: []string{"--log-prefix", "APIBAN-SHADOW "}, Matches: limit}, ipt, nil)
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Empty(t, ipt.chains["APIBAN_SHADOW"])
+
+	// The entries count every packet; only their verdict chain is limited
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j APIBAN_SHADOW_VERDICT"}, ipt.chains["APIBAN_SHADOW"])
+	assert.Equal(t, []string{"-m limit --limit 10/minute --limit-burst 20 -j LOG --log-prefix APIBAN-SHADOW "}, ipt.chains["APIBAN_SHADOW_VERDICT"])
+	assert.NoError(t, fw.CheckVerdict())
+
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32"}, list)
+
+	assert.NoError(t, fw.Teardown())
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+}
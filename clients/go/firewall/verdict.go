@@ -0,0 +1,173 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package firewall
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Verdicts which take more than a target
+const (
+	// Tarpit holds TCP connections open at zero window (TARPIT, from
+	// xtables-addons) and drops other packets
+	Tarpit = "TARPIT"
+
+	// Limit drops the packets of each banned source above a rate, using
+	// hashlimit, and lets the rest through.  For the OUTPUT hook the rate
+	// is of each banned destination.
+	Limit = "LIMIT"
+)
+
+// rejectTypes maps the REJECT types to their --reject-with values for IPv4
+// and IPv6
+var rejectTypes = map[string][2]string{
+	"port-unreachable": {"icmp-port-unreachable", "icmp6-port-unreachable"},
+	"host-unreachable": {"icmp-host-unreachable", "icmp6-addr-unreachable"},
+	"net-unreachable":  {"icmp-net-unreachable", "icmp6-no-route"},
+	"admin-prohibited": {"icmp-admin-prohibited", "icmp6-adm-prohibited"},
+	"tcp-reset":        {"tcp-reset", "tcp-reset"},
+}
+
+// chainName matches the names iptables accepts as a target
+var chainName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,28}$`)
+
+// rate matches the rates hashlimit accepts
+var rate = regexp.MustCompile(`^[1-9][0-9]*/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+
+// IsRate reports whether s is a rate which the limit and hashlimit matches
+// accept, such as 10/minute
+func IsRate(s string) bool {
+	return rate.MatchString(s)
+}
+
+// IsChainName reports whether name is a valid target or chain name
+func IsChainName(name string) bool {
+	return chainName.MatchString(name)
+}
+
+// Verdict is what happens to the packets matching an entry
+type Verdict struct {
+
+	// Target is DROP, REJECT, Tarpit, Limit or the name of a chain
+	Target string
+
+	// Reject is the REJECT type: port-unreachable, host-unreachable,
+	// net-unreachable, admin-prohibited or tcp-reset.  TCP resets are only
+	// sent to TCP packets; others get port-unreachable.  Empty leaves the
+	// choice to iptables.
+	Reject string
+
+	// Rate is the Limit rate, such as 10/minute
+	Rate string
+}
+
+// ParseVerdict parses DROP, REJECT, REJECT:<type>, TARPIT, LIMIT:<rate> or
+// the name of a chain.  The keywords are not case sensitive; chain names
+// are.
+func ParseVerdict(s string) (Verdict, error) {
+	name, arg := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+
+	switch v := (Verdict{Target: strings.ToUpper(name)}); v.Target {
+	case "DROP", Tarpit:
+		if arg != "" {
+			return Verdict{}, fmt.Errorf("%s takes no argument", v.Target)
+		}
+		return v, nil
+	case "REJECT":
+		if _, ok := rejectTypes[arg]; arg != "" && !ok {
+			return Verdict{}, fmt.Errorf("unknown REJECT type %q (port-unreachable, host-unreachable, net-unreachable, admin-prohibited or tcp-reset)", arg)
+		}
+		v.Reject = arg
+		return v, nil
+	case Limit:
+		if !rate.MatchString(arg) {
+			return Verdict{}, fmt.Errorf("LIMIT needs a rate such as LIMIT:10/minute")
+		}
+		v.Rate = arg
+		return v, nil
+	}
+
+	if arg != "" || !IsChainName(s) {
+		return Verdict{}, fmt.Errorf("%q is not a valid verdict or chain name", s)
+	}
+	return Verdict{Target: s}, nil
+}
+
+// String returns the verdict as ParseVerdict reads it
+func (v Verdict) String() string {
+	switch {
+	case v.Reject != "":
+		return v.Target + ":" + v.Reject
+	case v.Rate != "":
+		return v.Target + ":" + v.Rate
+	}
+	return v.Target
+}
+
+// chained reports whether the verdict needs a chain of its own, rather than
+// being the target of the entries
+func (v Verdict) chained() bool {
+	return v.Reject != "" || v.Target == Tarpit || v.Target == Limit
+}
+
+// rules returns the rules of the verdict chain.  name names the hashlimit
+// table of Limit, which counts by destination if dst is set.
+func (v Verdict) rules(name string, v6, dst bool) [][]string {
+	family := 0
+	if v6 {
+		family = 1
+	}
+
+	switch v.Target {
+	case Tarpit:
+		return [][]string{
+			{"-p", "tcp", "-j", Tarpit},
+			{"-j", "DROP"},
+		}
+	case Limit:
+		if len(name) > 15 {
+			name = name[:15]
+		}
+		mode := "srcip"
+		if dst {
+			mode = "dstip"
+		}
+		return [][]string{
+			{"-m", "hashlimit", "--hashlimit-above", v.Rate, "--hashlimit-mode", mode, "--hashlimit-name", name, "-j", "DROP"},
+		}
+	}
+
+	if v.Reject == "tcp-reset" {
+		return [][]string{
+			{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"},
+			{"-j", "REJECT", "--reject-with", rejectTypes["port-unreachable"][family]},
+		}
+	}
+	return [][]string{
+		{"-j", "REJECT", "--reject-with", rejectTypes[v.Reject][family]},
+	}
+}
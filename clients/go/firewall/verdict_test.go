@@ -0,0 +1,151 @@
+package firewall
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseVerdict(t *testing.T) {
+	testCases := map[string]struct {
+		want Verdict
+		err  string
+	}{
+		"DROP":                {want: Verdict{Target: "DROP"}},
+		"reject":              {want: Verdict{Target: "REJECT"}},
+		"REJECT:tcp-reset":    {want: Verdict{Target: "REJECT", Reject: "tcp-reset"}},
+		"REJECT:host-unreach": {err: `unknown REJECT type "host-unreach" (port-unreachable, host-unreachable, net-unreachable, admin-prohibited or tcp-reset)`},
+		"tarpit":              {want: Verdict{Target: Tarpit}},
+		"TARPIT:5":            {err: "TARPIT takes no argument"},
+		"LIMIT:10/minute":     {want: Verdict{Target: Limit, Rate: "10/minute"}},
+		"LIMIT:fast":          {err: "LIMIT needs a rate such as LIMIT:10/minute"},
+		"MY-CHAIN":            {want: Verdict{Target: "MY-CHAIN"}},
+		"MY CHAIN":            {err: `"MY CHAIN" is not a valid verdict or chain name`},
+		"MY-CHAIN:port":       {err: `"MY-CHAIN:port" is not a valid verdict or chain name`},
+		"":                    {err: `"" is not a valid verdict or chain name`},
+	}
+
+	for s, tc := range testCases {
+		t.Run(s, func(t *testing.T) {
+			v, err := ParseVerdict(s)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, v)
+		})
+	}
+}
+
+func TestVerdictChain(t *testing.T) {
+	ipv4 := newFakeTables()
+	ipv6 := newFakeTables()
+	v, err := ParseVerdict("REJECT:tcp-reset")
+	assert.NoError(t, err)
+
+	fw := NewWithTables(Config{Verdict: v}, ipv4, ipv6)
+	_, err = fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.NoError(t, fw.Add("2001:db8::1"))
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j APIBAN_VERDICT"}, ipv4.chains["APIBAN"])
+	assert.Equal(t, []string{
+		"-p tcp -j REJECT --reject-with tcp-reset",
+		"-j REJECT --reject-with icmp-port-unreachable",
+	}, ipv4.chains["APIBAN_VERDICT"])
+	assert.Equal(t, []string{
+		"-p tcp -j REJECT --reject-with tcp-reset",
+		"-j REJECT --reject-with icmp6-port-unreachable",
+	}, ipv6.chains["APIBAN_VERDICT"])
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32", "2001:db8::1/128"}, list)
+
+	// Another chained verdict only replaces the verdict chain
+	v, _ = ParseVerdict("LIMIT:10/minute")
+	fw = NewWithTables(Config{Verdict: v}, ipv4, nil)
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, []string{"-m hashlimit --hashlimit-above 10/minute --hashlimit-mode srcip --hashlimit-name APIBAN -j DROP"}, ipv4.chains["APIBAN_VERDICT"])
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j APIBAN_VERDICT"}, ipv4.chains["APIBAN"])
+
+	// A plain target rebuilds the chain and removes the verdict chain
+	fw = NewWithTables(Config{Verdict: Verdict{Target: "DROP"}}, ipv4, nil)
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.Empty(t, ipv4.chains["APIBAN"])
+	assert.NotContains(t, ipv4.order, "APIBAN_VERDICT")
+
+	assert.NoError(t, fw.Add("45.1.2.3"))
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j DROP"}, ipv4.chains["APIBAN"])
+}
+
+func TestInitTargetChange(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Sharded: true}, ipt, nil)
+	assert.NoError(t, fw.SetAllowed([]string{"192.0.2.1"}))
+	_, err := fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// Same target: nothing to do
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	// The REJECT rules would otherwise stay behind, unseen by List
+	fw = NewWithTables(Config{Sharded: true, Target: "DROP"}, ipt, nil)
+	assert.NoError(t, fw.SetAllowed([]string{"192.0.2.1"}))
+	created, err = fw.Init()
+	assert.NoError(t, err)
+	assert.True(t, created)
+	assert.NotContains(t, ipt.order, "APIBAN-045")
+	assert.Equal(t, []string{"-s 192.0.2.1/32 -j RETURN"}, ipt.chains["APIBAN"])
+}
+
+func TestVerdictOutput(t *testing.T) {
+	ipt := newFakeTables()
+	v, err := ParseVerdict("LIMIT:10/minute")
+	assert.NoError(t, err)
+
+	fw := NewWithTables(Config{Verdict: v, Hooks: []string{"INPUT", "OUTPUT"}}, ipt, nil)
+	_, err = fw.Init()
+	assert.NoError(t, err)
+	assert.NoError(t, fw.Add("45.1.2.3"))
+
+	// Each side rates by the banned address
+	assert.Equal(t, []string{"-s 45.1.2.3/32 -d 0/0 -j APIBAN_VERDICT"}, ipt.chains["APIBAN"])
+	assert.Equal(t, []string{"-m hashlimit --hashlimit-above 10/minute --hashlimit-mode srcip --hashlimit-name APIBAN -j DROP"}, ipt.chains["APIBAN_VERDICT"])
+	assert.Equal(t, []string{"-s 0/0 -d 45.1.2.3/32 -j APIBAN_OUT_VERDICT"}, ipt.chains["APIBAN_OUT"])
+	assert.Equal(t, []string{"-m hashlimit --hashlimit-above 10/minute --hashlimit-mode dstip --hashlimit-name APIBAN_OUT -j DROP"}, ipt.chains["APIBAN_OUT_VERDICT"])
+
+	list, err := fw.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"45.1.2.3/32"}, list)
+
+	created, err := fw.Init()
+	assert.NoError(t, err)
+	assert.False(t, created)
+
+	assert.NoError(t, fw.Teardown())
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+}
+
+func TestCheckVerdict(t *testing.T) {
+	ipt := newFakeTables()
+	fw := NewWithTables(Config{Verdict: Verdict{Target: Tarpit}}, ipt, nil)
+	assert.NoError(t, fw.CheckVerdict())
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+
+	ipt.missing = []string{Tarpit}
+	assert.EqualError(t, fw.CheckVerdict(), "iptables does not support the TARPIT verdict: Couldn't load target `TARPIT'")
+	assert.Equal(t, []string{"INPUT", "FORWARD", "OUTPUT"}, ipt.order)
+
+	// Plain targets need no chain to check
+	fw = NewWithTables(Config{Verdict: Verdict{Target: "DROP"}}, ipt, nil)
+	assert.NoError(t, fw.CheckVerdict())
+}
@@ -3,6 +3,9 @@ module github.com/palner/apiban/clients/go
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/coreos/go-iptables v0.4.5
 	github.com/stretchr/testify v1.5.1
+	go.etcd.io/bbolt v1.3.5
+	gopkg.in/yaml.v2 v2.2.8
 )
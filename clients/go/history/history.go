@@ -0,0 +1,371 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package history keeps a record of every address the client has banned,
+// with where the ban came from, when it was lifted and why, and how much
+// traffic it stopped.  The records are kept in a bbolt database, apart from
+// the state, and survive flushes and reboots.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/palner/apiban/clients/go/source"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name is the name of the history file, kept next to the state file
+const Name = "history.db"
+
+// Actions of an Event
+const (
+	// Banned is an address banned, or listed again while banned
+	Banned = "ban"
+
+	// Lifted is a ban lifted
+	Lifted = "lift"
+)
+
+// maxEvents is the number of events kept with each Record; the events
+// bucket keeps them all
+const maxEvents = 50
+
+var (
+	addressBucket = []byte("addresses")
+	eventBucket   = []byte("events")
+)
+
+// Path returns the location of the history kept with the state file
+// stateFile
+func Path(stateFile string) string {
+	return filepath.Join(filepath.Dir(stateFile), Name)
+}
+
+// ErrNoHistory is returned by OpenReadOnly when there is no history yet
+var ErrNoHistory = errors.New("no history has been recorded yet")
+
+// Event is a change to the ban of an address
+type Event struct {
+	Time    time.Time `json:"time"`
+	Address string    `json:"address"`
+	Action  string    `json:"action"`
+
+	// Source is what banned the address, such as apiban, a list or manual
+	Source string `json:"source,omitempty"`
+
+	// FeedID is the APIBAN ID of the feed update which listed the address
+	FeedID string `json:"feed_id,omitempty"`
+
+	// Reason is the reason of a manual ban or escalation, or why the ban
+	// was lifted
+	Reason string `json:"reason,omitempty"`
+
+	// Expires is when a manual ban expires
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Record is everything known about an address
+type Record struct {
+	Address   string    `json:"address"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+
+	// Since is the start of the current, or last, ban and Bans the number
+	// of times the address was banned
+	Since time.Time `json:"since"`
+	Bans  int       `json:"bans"`
+
+	FeedID  string     `json:"feed_id,omitempty"`
+	Sources []string   `json:"sources"`
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Removed and RemovalReason tell when and why the ban was lifted, if
+	// it is no longer in force
+	Removed       *time.Time `json:"removed,omitempty"`
+	RemovalReason string     `json:"removal_reason,omitempty"`
+
+	// Packets and Bytes are the traffic dropped over all bans
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+
+	// CounterPackets and CounterBytes are the firewall counters last read,
+	// to tell how much they grew since
+	CounterPackets uint64 `json:"counter_packets,omitempty"`
+	CounterBytes   uint64 `json:"counter_bytes,omitempty"`
+
+	// Events are the latest bans and lifts of the address
+	Events []Event `json:"events"`
+}
+
+// Active reports whether the ban is in force
+func (r *Record) Active() bool {
+	return r.Removed == nil
+}
+
+// DB is the history database
+type DB struct {
+	db *bolt.DB
+}
+
+// Open opens the history at path for writing, creating it if needed.  Only
+// one process may have it open for writing.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{addressBucket, eventBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize history %s: %w", path, err)
+	}
+
+	return &DB{db: db}, nil
+}
+
+// OpenReadOnly opens the history at path for queries
+func OpenReadOnly(path string) (*DB, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, ErrNoHistory
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history %s: %w", path, err)
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the database
+func (h *DB) Close() error {
+	return h.db.Close()
+}
+
+// Apply records events, in order, and the firewall counters, in one
+// transaction.  A Banned event for an address already banned only updates
+// its record; a Lifted event for one which isn't is ignored.  Counters are
+// matched to records by address; as the firewall resets them when the chain
+// is rebuilt, a counter lower than the last one read counts in full.
+func (h *DB) Apply(events []Event, counters []firewall.Counter) error {
+	return h.db.Update(func(tx *bolt.Tx) error {
+		addrs := tx.Bucket(addressBucket)
+		log := tx.Bucket(eventBucket)
+
+		for _, e := range events {
+			r, err := get(addrs, e.Address)
+			if err != nil {
+				return err
+			}
+			if r.Bans == 0 && e.Action != Banned {
+				continue
+			}
+
+			if !r.apply(e) {
+				if err := put(addrs, r); err != nil {
+					return err
+				}
+				continue
+			}
+
+			seq, err := log.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if err := log.Put(eventKey(e.Time, seq), data); err != nil {
+				return err
+			}
+			if err := put(addrs, r); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range counters {
+			data := addrs.Get([]byte(c.Source))
+			if data == nil {
+				continue
+			}
+			r := new(Record)
+			if err := json.Unmarshal(data, r); err != nil {
+				return err
+			}
+			r.count(c)
+			if err := put(addrs, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// apply updates the record with e, reporting whether e changed whether the
+// address is banned
+func (r *Record) apply(e Event) bool {
+	if r.FirstSeen.IsZero() {
+		r.Address = e.Address
+		r.FirstSeen = e.Time
+	}
+
+	switch e.Action {
+	case Banned:
+		r.LastSeen = e.Time
+		if e.FeedID != "" {
+			r.FeedID = e.FeedID
+		}
+		if e.Expires != nil || e.Source == source.ManualName {
+			r.Expires = e.Expires
+		}
+
+		if r.Bans > 0 && r.Active() {
+			r.addSource(e.Source)
+			return false
+		}
+		r.Since = e.Time
+		r.Bans++
+		r.Sources = nil
+		r.addSource(e.Source)
+		r.Removed = nil
+		r.RemovalReason = ""
+
+	case Lifted:
+		if r.Bans == 0 || !r.Active() {
+			return false
+		}
+		t := e.Time
+		r.Removed = &t
+		r.RemovalReason = e.Reason
+	}
+
+	r.Events = append(r.Events, e)
+	if len(r.Events) > maxEvents {
+		r.Events = r.Events[len(r.Events)-maxEvents:]
+	}
+	return true
+}
+
+func (r *Record) addSource(name string) {
+	if name == "" {
+		return
+	}
+	i := sort.SearchStrings(r.Sources, name)
+	if i < len(r.Sources) && r.Sources[i] == name {
+		return
+	}
+	r.Sources = append(r.Sources, "")
+	copy(r.Sources[i+1:], r.Sources[i:])
+	r.Sources[i] = name
+}
+
+// count adds the growth of the firewall counters to the totals
+func (r *Record) count(c firewall.Counter) {
+	if c.Packets >= r.CounterPackets && c.Bytes >= r.CounterBytes {
+		r.Packets += c.Packets - r.CounterPackets
+		r.Bytes += c.Bytes - r.CounterBytes
+	} else {
+		r.Packets += c.Packets
+		r.Bytes += c.Bytes
+	}
+	r.CounterPackets = c.Packets
+	r.CounterBytes = c.Bytes
+}
+
+// Get returns the record of an address, or nil if it was never banned
+func (h *DB) Get(addr string) (*Record, error) {
+	var r *Record
+	err := h.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(addressBucket).Get([]byte(addr))
+		if data == nil {
+			return nil
+		}
+		r = new(Record)
+		return json.Unmarshal(data, r)
+	})
+	return r, err
+}
+
+// Between returns the events from from up to, but not including, to, in
+// order.  If action is not empty, only events of that action are returned.
+func (h *DB) Between(from, to time.Time, action string) ([]Event, error) {
+	out := []Event{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventBucket).Cursor()
+		end := eventKey(to, 0)
+		for k, v := c.Seek(eventKey(from, 0)); k != nil && string(k) < string(end); k, v = c.Next() {
+			e := Event{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if action == "" || e.Action == action {
+				out = append(out, e)
+			}
+		}
+		return nil
+	})
+	return out, err
+}
+
+func get(b *bolt.Bucket, addr string) (*Record, error) {
+	r := new(Record)
+	data := b.Get([]byte(addr))
+	if data == nil {
+		return r, nil
+	}
+	return r, json.Unmarshal(data, r)
+}
+
+func put(b *bolt.Bucket, r *Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(r.Address), data)
+}
+
+// eventKey orders the events by time, then by sequence
+func eventKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
@@ -0,0 +1,117 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/palner/apiban/clients/go/firewall"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := Path(filepath.Join(dir, "state.json"))
+
+	now := time.Unix(1600000000, 0).UTC()
+	until := now.Add(48 * time.Hour)
+
+	h, err := Open(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, h.Apply([]Event{
+		{Time: now, Address: "192.0.2.1", Action: Banned, Source: "apiban", FeedID: "200"},
+		{Time: now.Add(time.Minute), Address: "192.0.2.1", Action: Banned, Source: "drop"},
+		{Time: now.Add(time.Minute), Address: "198.51.100.7", Action: Lifted, Reason: "never banned"},
+		{Time: now.Add(time.Hour), Address: "203.0.113.9", Action: Banned, Source: "manual", Reason: "abuse", Expires: &until},
+	}, []firewall.Counter{{Source: "192.0.2.1", Packets: 10, Bytes: 600}}))
+	assert.NoError(t, h.Apply(nil, []firewall.Counter{{Source: "192.0.2.1", Packets: 15, Bytes: 900}}))
+
+	// The counters restart when the chain is flushed
+	assert.NoError(t, h.Apply([]Event{
+		{Time: now.Add(24 * time.Hour), Address: "192.0.2.1", Action: Lifted, Reason: "no longer listed by apiban"},
+		{Time: now.Add(72 * time.Hour), Address: "192.0.2.1", Action: Banned, Source: "apiban", FeedID: "300"},
+	}, []firewall.Counter{{Source: "192.0.2.1", Packets: 4, Bytes: 240}}))
+	assert.NoError(t, h.Close())
+
+	// Everything survives reopening
+	h, err = OpenReadOnly(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer h.Close()
+
+	r, err := h.Get("192.0.2.1")
+	if assert.NoError(t, err) && assert.NotNil(t, r) {
+		assert.True(t, now.Equal(r.FirstSeen))
+		assert.True(t, now.Add(72*time.Hour).Equal(r.LastSeen))
+		assert.True(t, now.Add(72*time.Hour).Equal(r.Since))
+		assert.Equal(t, 2, r.Bans)
+		assert.Equal(t, "300", r.FeedID)
+		assert.Equal(t, []string{"apiban"}, r.Sources)
+		assert.True(t, r.Active())
+		assert.Empty(t, r.RemovalReason)
+		assert.Equal(t, uint64(19), r.Packets)
+		assert.Equal(t, uint64(1140), r.Bytes)
+		assert.Len(t, r.Events, 3)
+	}
+
+	r, err = h.Get("203.0.113.9")
+	if assert.NoError(t, err) && assert.NotNil(t, r) {
+		assert.Equal(t, []string{"manual"}, r.Sources)
+		if assert.NotNil(t, r.Expires) {
+			assert.True(t, until.Equal(*r.Expires))
+		}
+	}
+
+	r, err = h.Get("198.51.100.7")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	testCases := map[string]struct {
+		from, to time.Time
+		action   string
+		want     []string
+	}{
+		"all": {
+			from: now, to: now.Add(100 * time.Hour),
+			want: []string{"ban 192.0.2.1", "ban 203.0.113.9", "lift 192.0.2.1", "ban 192.0.2.1"},
+		},
+		"bans": {
+			from: now, to: now.Add(100 * time.Hour), action: Banned,
+			want: []string{"ban 192.0.2.1", "ban 203.0.113.9", "ban 192.0.2.1"},
+		},
+		"end excluded": {
+			from: now.Add(time.Minute), to: now.Add(24 * time.Hour),
+			want: []string{"ban 203.0.113.9"},
+		},
+		"none": {
+			from: now.Add(-time.Hour), to: now,
+			want: []string{},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			events, err := h.Between(tc.from, tc.to, tc.action)
+			assert.NoError(t, err)
+			got := []string{}
+			for _, e := range events {
+				got = append(got, e.Action+" "+e.Address)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestOpenReadOnlyMissing(t *testing.T) {
+	_, err := OpenReadOnly(filepath.Join(os.TempDir(), "apiban-missing", Name))
+	assert.Equal(t, ErrNoHistory, err)
+}
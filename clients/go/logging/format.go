@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the encoding of records written to files and streams
+type Format int
+
+// Formats
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat returns the Format with the given name
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q", s)
+}
+
+// timeFormat is used for record times in both formats
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// appendText appends the message and fields in logfmt style
+func appendText(buf *bytes.Buffer, r *Record) {
+	buf.WriteString(r.Message)
+	for _, f := range r.Fields {
+		buf.WriteByte(' ')
+		buf.WriteString(f.Key)
+		buf.WriteByte('=')
+		buf.WriteString(textValue(f.Value))
+	}
+}
+
+// stringValue formats a value
+func stringValue(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case time.Duration:
+		return x.String()
+	case time.Time:
+		return x.Format(timeFormat)
+	}
+	return fmt.Sprint(v)
+}
+
+// textValue formats a value, quoting it if it would be ambiguous
+func textValue(v interface{}) string {
+	s := stringValue(v)
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// FormatRecord encodes a record, followed by a newline
+func FormatRecord(r *Record, format Format) []byte {
+	var buf bytes.Buffer
+
+	if format == FormatJSON {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, r.Time.Format(timeFormat))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, r.Level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, r.Message)
+		for _, f := range r.Fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.Key)
+			buf.WriteByte(':')
+			v := f.Value
+			if d, ok := v.(time.Duration); ok {
+				v = d.Seconds()
+			}
+			writeJSON(&buf, v)
+		}
+		buf.WriteString("}\n")
+		return buf.Bytes()
+	}
+
+	buf.WriteString(r.Time.Format(timeFormat))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(r.Level.String()))
+	buf.WriteByte(' ')
+	appendText(&buf, r)
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		b.Reset()
+		_ = enc.Encode(fmt.Sprint(v))
+	}
+
+	// Drop the newline added by Encode
+	buf.Write(bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+}
+
+// writerSink writes formatted records to a stream or file
+type writerSink struct {
+	w      io.WriteCloser
+	format Format
+}
+
+// NewWriterSink returns a Sink writing records to w in the given format.
+// Closing the Sink closes w.
+func NewWriterSink(w io.WriteCloser, format Format) Sink {
+	return &writerSink{w: w, format: format}
+}
+
+func (s *writerSink) Write(r *Record) error {
+	_, err := s.w.Write(FormatRecord(r, s.format))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return s.w.Close()
+}
+
+// nopCloser keeps the standard streams open when a Sink is closed
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// Discard is a Sink which drops every record
+var Discard Sink = NewWriterSink(nopCloser{ioutil.Discard}, FormatText)
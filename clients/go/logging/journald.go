@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JournalSocket is where journald listens for native protocol messages
+const JournalSocket = "/run/systemd/journal/socket"
+
+// journalSink sends records to journald using its native protocol, so that
+// each field of a record can be matched on, e.g. journalctl IP=192.0.2.1
+type journalSink struct {
+	conn       net.Conn
+	identifier string
+}
+
+// NewJournalSink returns a Sink logging to journald at socket (normally
+// JournalSocket) with the given SYSLOG_IDENTIFIER
+func NewJournalSink(socket, identifier string) (Sink, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn, identifier: identifier}, nil
+}
+
+// journalPriority maps levels to syslog priorities
+var journalPriority = map[Level]int{
+	LevelDebug:   7,
+	LevelInfo:    6,
+	LevelWarning: 4,
+	LevelError:   3,
+}
+
+func (s *journalSink) Write(r *Record) error {
+	var msg bytes.Buffer
+	appendText(&msg, r)
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", msg.String())
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(journalPriority[r.Level]))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", s.identifier)
+	for _, f := range r.Fields {
+		writeJournalField(&buf, journalFieldName(f.Key), stringValue(f.Value))
+	}
+
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *journalSink) Close() error {
+	return s.conn.Close()
+}
+
+// writeJournalField appends a field, using the binary form for values which
+// contain a newline
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName makes a valid journal field name: upper case letters,
+// digits and underscores, not starting with an underscore or digit
+func journalFieldName(key string) string {
+	name := []byte(strings.ToUpper(key))
+	for i, c := range name {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			name[i] = '_'
+		}
+	}
+
+	if len(name) == 0 || name[0] == '_' || name[0] >= '0' && name[0] <= '9' {
+		return "F_" + string(name)
+	}
+	return string(name)
+}
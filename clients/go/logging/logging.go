@@ -0,0 +1,249 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package logging is a small leveled, structured logger with text and JSON
+// formats and file, stdout, syslog and journald outputs.
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log record
+type Level int
+
+// Levels, in increasing order of severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warning", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level with the given name
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warning", "warn":
+		return LevelWarning, nil
+	case "error":
+		return LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// Field is a key and value attached to a log record
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Record is a single log entry
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Sink writes log records somewhere
+type Sink interface {
+	Write(r *Record) error
+	Close() error
+}
+
+// Logger filters records by level, removes secrets from them and passes them
+// on to a Sink.  It is safe for concurrent use.
+type Logger struct {
+	mu      sync.Mutex
+	sink    Sink
+	level   Level
+	secrets *strings.Replacer
+}
+
+// New returns a Logger writing records of at least level to sink
+func New(sink Sink, level Level) *Logger {
+	return &Logger{sink: sink, level: level}
+}
+
+// SetSecrets replaces the strings which are removed from every record
+func (l *Logger) SetSecrets(secrets ...string) {
+	var pairs []string
+	for _, s := range secrets {
+		if s != "" {
+			pairs = append(pairs, s, Redacted)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.secrets = nil
+	if len(pairs) > 0 {
+		l.secrets = strings.NewReplacer(pairs...)
+	}
+}
+
+// Redacted replaces secrets in log records
+const Redacted = "<redacted>"
+
+// Enabled reports whether records of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Log writes a record.  kv are alternating keys and values.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	r := &Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: msg,
+	}
+
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+
+		var v interface{} = "(missing)"
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+
+		switch x := v.(type) {
+		case time.Duration, time.Time:
+			// formatted by the Sink
+		case error:
+			v = x.Error()
+		case fmt.Stringer:
+			v = x.String()
+		}
+
+		r.Fields = append(r.Fields, Field{Key: key, Value: v})
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.secrets != nil {
+		r.Message = l.secrets.Replace(r.Message)
+		for i, f := range r.Fields {
+			if s, ok := f.Value.(string); ok {
+				r.Fields[i].Value = l.secrets.Replace(s)
+			}
+		}
+	}
+
+	// There is nowhere left to report a failure to log
+	_ = l.sink.Write(r)
+}
+
+// Debug logs at LevelDebug
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.Log(LevelDebug, msg, kv...) }
+
+// Info logs at LevelInfo
+func (l *Logger) Info(msg string, kv ...interface{}) { l.Log(LevelInfo, msg, kv...) }
+
+// Warning logs at LevelWarning
+func (l *Logger) Warning(msg string, kv ...interface{}) { l.Log(LevelWarning, msg, kv...) }
+
+// Error logs at LevelError
+func (l *Logger) Error(msg string, kv ...interface{}) { l.Log(LevelError, msg, kv...) }
+
+// Close closes the Sink
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sink.Close()
+}
+
+// Writer returns a Writer which logs every line written to it at level.  It
+// lets the standard library log package write through the Logger.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		w.l.Log(w.level, string(line))
+	}
+	return len(p), nil
+}
+
+var (
+	stdMu sync.RWMutex
+	std   = New(NewWriterSink(nopCloser{os.Stderr}, FormatText), LevelInfo)
+)
+
+// Default returns the Logger used by the package-level functions.  Until
+// SetDefault is called, it writes text to standard error at LevelInfo.
+func Default() *Logger {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	return std
+}
+
+// SetDefault replaces the Logger used by the package-level functions
+func SetDefault(l *Logger) {
+	stdMu.Lock()
+	defer stdMu.Unlock()
+	std = l
+}
+
+// Debug logs at LevelDebug to the default Logger
+func Debug(msg string, kv ...interface{}) { Default().Log(LevelDebug, msg, kv...) }
+
+// Info logs at LevelInfo to the default Logger
+func Info(msg string, kv ...interface{}) { Default().Log(LevelInfo, msg, kv...) }
+
+// Warning logs at LevelWarning to the default Logger
+func Warning(msg string, kv ...interface{}) { Default().Log(LevelWarning, msg, kv...) }
+
+// Error logs at LevelError to the default Logger
+func Error(msg string, kv ...interface{}) { Default().Log(LevelError, msg, kv...) }
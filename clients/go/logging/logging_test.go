@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bufferSink keeps records in memory
+type bufferSink struct {
+	bytes.Buffer
+	format Format
+}
+
+func (b *bufferSink) Write(r *Record) error {
+	r.Time = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	_, err := b.Buffer.Write(FormatRecord(r, b.format))
+	return err
+}
+
+func (b *bufferSink) Close() error { return nil }
+
+func TestLogger(t *testing.T) {
+	testCases := map[string]struct {
+		format Format
+		level  Level
+		want   string
+	}{
+		"text": {
+			format: FormatText,
+			level:  LevelInfo,
+			want: "2021-03-04T05:06:07.000Z INFO sync complete lkid=300 added=2 duration=1.5s\n" +
+				"2021-03-04T05:06:07.000Z ERROR sync failed error=\"Get <redacted>/banned: refused\" key=<redacted>\n",
+		},
+		"json": {
+			format: FormatJSON,
+			level:  LevelInfo,
+			want: `{"time":"2021-03-04T05:06:07.000Z","level":"info","msg":"sync complete","lkid":"300","added":2,"duration":1.5}` + "\n" +
+				`{"time":"2021-03-04T05:06:07.000Z","level":"error","msg":"sync failed","error":"Get <redacted>/banned: refused","key":"<redacted>"}` + "\n",
+		},
+		"debug": {
+			format: FormatText,
+			level:  LevelDebug,
+			want: "2021-03-04T05:06:07.000Z DEBUG blocking ip=192.0.2.1\n" +
+				"2021-03-04T05:06:07.000Z INFO sync complete lkid=300 added=2 duration=1.5s\n" +
+				"2021-03-04T05:06:07.000Z ERROR sync failed error=\"Get <redacted>/banned: refused\" key=<redacted>\n",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sink := &bufferSink{format: tc.format}
+			l := New(sink, tc.level)
+			l.SetSecrets("s3cret")
+
+			l.Debug("blocking", "ip", "192.0.2.1")
+			l.Info("sync complete", "lkid", "300", "added", 2, "duration", 1500*time.Millisecond)
+			l.Error("sync failed", "error", errors.New("Get s3cret/banned: refused"), "key", "s3cret")
+
+			assert.Equal(t, tc.want, sink.String())
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	sink := &bufferSink{}
+	l := New(sink, LevelInfo)
+
+	fmt.Fprint(l.Writer(LevelWarning), "first\nsecond\n")
+	assert.Equal(t, "2021-03-04T05:06:07.000Z WARNING first\n2021-03-04T05:06:07.000Z WARNING second\n", sink.String())
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("WARN")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelWarning, l)
+
+	_, err = ParseLevel("verbose")
+	assert.EqualError(t, err, `unknown log level "verbose"`)
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "client.log")
+	f, err := OpenFile(path, 10, 2)
+	assert.NoError(t, err)
+
+	for _, s := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		_, err := f.Write([]byte(s))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+
+	for name, want := range map[string]string{
+		"client.log":   "dddddd\n",
+		"client.log.1": "cccccc\n",
+		"client.log.2": "bbbbbb\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(got), name)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "client.log.3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestJournalSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "journal.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewJournalSink(socket, "apiban")
+	assert.NoError(t, err)
+	defer sink.Close()
+
+	l := New(sink, LevelInfo)
+	l.Warning("adding rule failed", "ip", "192.0.2.1", "error", "line one\nline two")
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	assert.NoError(t, err)
+
+	want := "MESSAGE=adding rule failed ip=192.0.2.1 error=\"line one\\nline two\"\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_IDENTIFIER=apiban\n" +
+		"IP=192.0.2.1\n" +
+		"ERROR\n\x11\x00\x00\x00\x00\x00\x00\x00line one\nline two\n"
+	assert.Equal(t, want, string(buf[:n]))
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package logging
+
+import "os"
+
+// Config describes where and how to log
+type Config struct {
+
+	// Output is a file name, "stdout" (or "-"), "stderr", "syslog" or
+	// "journald"
+	Output string
+
+	// Level is the minimum level logged
+	Level Level
+
+	// Format is used for files and streams; syslog and journald records
+	// are always text
+	Format Format
+
+	// MaxSize is the size in bytes at which a log file is rotated, or zero
+	// to never rotate it
+	MaxSize int64
+
+	// MaxFiles is the number of rotated log files kept
+	MaxFiles int
+
+	// Identifier names the program in syslog and journald
+	Identifier string
+}
+
+// Open returns a Logger for the configuration
+func Open(cfg Config) (*Logger, error) {
+	var sink Sink
+	var err error
+
+	switch cfg.Output {
+	case "-", "stdout":
+		sink = NewWriterSink(nopCloser{os.Stdout}, cfg.Format)
+	case "stderr":
+		sink = NewWriterSink(nopCloser{os.Stderr}, cfg.Format)
+	case "syslog":
+		sink, err = NewSyslogSink(cfg.Identifier)
+	case "journald":
+		sink, err = NewJournalSink(JournalSocket, cfg.Identifier)
+	default:
+		var f *RotatingFile
+		f, err = OpenFile(cfg.Output, cfg.MaxSize, cfg.MaxFiles)
+		if err == nil {
+			sink = NewWriterSink(f, cfg.Format)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return New(sink, cfg.Level), nil
+}
@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package logging
+
+import (
+	"bytes"
+	"log/syslog"
+)
+
+// syslogSink sends records to the local syslog daemon
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink returns a Sink logging to the local syslog daemon with the
+// daemon facility
+func NewSyslogSink(tag string) (Sink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(r *Record) error {
+	var buf bytes.Buffer
+	appendText(&buf, r)
+	msg := buf.String()
+
+	switch r.Level {
+	case LevelDebug:
+		return s.w.Debug(msg)
+	case LevelWarning:
+		return s.w.Warning(msg)
+	case LevelError:
+		return s.w.Err(msg)
+	}
+	return s.w.Info(msg)
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
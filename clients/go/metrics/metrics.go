@@ -0,0 +1,291 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package metrics is a minimal registry of counters, gauges and histograms
+// which can be exposed in the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelSep separates label values in series keys
+const labelSep = "\xff"
+
+// Registry holds a set of metrics
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*metric
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// metric is a named family of series, one per set of label values
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+
+	// value is the counter or gauge value, or the histogram sum
+	value float64
+
+	// counts are the cumulative histogram bucket counts, followed by the
+	// total count
+	counts []uint64
+}
+
+func (r *Registry) register(m *metric) *metric {
+	m.series = make(map[string]*series)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, o := range r.metrics {
+		if o.name == m.name {
+			panic(fmt.Sprintf("metric %s registered twice", m.name))
+		}
+	}
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+// get returns the series for the given label values, creating it if needed
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, labelSep)
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		if m.kind == histogramKind {
+			s.counts = make([]uint64, len(m.buckets)+1)
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	m *metric
+}
+
+// NewCounter registers a counter with the given label names
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(&metric{name: name, help: help, kind: counterKind, labels: labels})}
+}
+
+// Add adds v to the series with the given label values
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic(fmt.Sprintf("counter %s cannot decrease", c.m.name))
+	}
+
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	c.m.get(values).value += v
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	m *metric
+}
+
+// NewGauge registers a gauge with the given label names
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(&metric{name: name, help: help, kind: gaugeKind, labels: labels})}
+}
+
+// Set sets the series with the given label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	g.m.mu.Lock()
+	defer g.m.mu.Unlock()
+	g.m.get(values).value = v
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	m *metric
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds and
+// label names
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Histogram{r.register(&metric{name: name, help: help, kind: histogramKind, labels: labels, buckets: b})}
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+
+	s := h.m.get(values)
+	s.value += v
+	for i, b := range h.m.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.counts[len(h.m.buckets)]++
+}
+
+// DefaultBuckets suit durations in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// WriteTo writes all metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]*metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	for _, m := range metrics {
+		m.write(cw)
+	}
+	if cw.err == nil {
+		cw.err = bw.Flush()
+	}
+
+	return cw.n, cw.err
+}
+
+func (m *metric) write(w *countingWriter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, helpEscaper.Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := m.series[k]
+		if m.kind != histogramKind {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, labelString(m.labels, s.values, "", ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, b := range m.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.values, "le", formatFloat(b)), s.counts[i])
+		}
+		total := s.counts[len(m.buckets)]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, labelString(m.labels, s.values, "le", "+Inf"), total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, labelString(m.labels, s.values, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, labelString(m.labels, s.values, "", ""), total)
+	}
+}
+
+// Handler serves the metrics over HTTP
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_, _ = r.WriteTo(w)
+	})
+}
+
+func labelString(names, values []string, extraName, extraValue string) string {
+	var parts []string
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+var (
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
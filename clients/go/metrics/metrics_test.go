@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounter("test_errors_total", "Errors by type.", "type")
+	g := r.NewGauge("test_banned", "Banned addresses.\nPer family.", "family")
+	u := r.NewGauge("test_last_success_timestamp_seconds", "Last success.")
+	h := r.NewHistogram("test_duration_seconds", "Duration.", []float64{1, 0.1})
+
+	c.Inc("network")
+	c.Add(2, "rate_limit")
+	c.Inc("network")
+	g.Set(10, "ipv4")
+	g.Set(3, "ipv6")
+	g.Set(12, "ipv4")
+	u.Set(1.6e9)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	n, err := r.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_errors_total Errors by type.
+# TYPE test_errors_total counter
+test_errors_total{type="network"} 2
+test_errors_total{type="rate_limit"} 2
+# HELP test_banned Banned addresses.\nPer family.
+# TYPE test_banned gauge
+test_banned{family="ipv4"} 12
+test_banned{family="ipv6"} 3
+# HELP test_last_success_timestamp_seconds Last success.
+# TYPE test_last_success_timestamp_seconds gauge
+test_last_success_timestamp_seconds 1.6e+09
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 5.55
+test_duration_seconds_count 3
+`, buf.String())
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.", "reason").Inc("a \"quoted\"\\value\n")
+
+	var buf bytes.Buffer
+	_, err := r.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), `test_total{reason="a \"quoted\"\\value\n"} 1`)
+}
+
+func TestPanics(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "type")
+
+	assert.Panics(t, func() { r.NewGauge("test_total", "Again.") })
+	assert.Panics(t, func() { c.Inc() })
+	assert.Panics(t, func() { c.Add(-1, "x") })
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("test_up", "Up.").Set(1)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "test_up 1\n")
+}
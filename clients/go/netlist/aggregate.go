@@ -0,0 +1,92 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package netlist
+
+import (
+	"bytes"
+	"net"
+	"sort"
+)
+
+// Aggregate returns the shortest list of networks holding exactly the
+// addresses of nets: networks within others are dropped and adjacent halves
+// are merged.  IPv4 and IPv6 networks are aggregated separately; the result
+// is sorted, IPv4 first.
+func Aggregate(nets []*net.IPNet) []*net.IPNet {
+	sorted := append([]*net.IPNet(nil), nets...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if len(a.IP) != len(b.IP) {
+			return len(a.IP) < len(b.IP)
+		}
+		if c := bytes.Compare(a.IP, b.IP); c != 0 {
+			return c < 0
+		}
+		ai, _ := a.Mask.Size()
+		bi, _ := b.Mask.Size()
+		return ai < bi
+	})
+
+	var out []*net.IPNet
+	for _, n := range sorted {
+		// A network starting inside the previous one is within it
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			if len(last.IP) == len(n.IP) && last.Contains(n.IP) {
+				continue
+			}
+		}
+
+		out = append(out, n)
+		for len(out) >= 2 {
+			a, b := out[len(out)-2], out[len(out)-1]
+			if !Sibling(a).IP.Equal(b.IP) || !bytes.Equal(a.Mask, b.Mask) {
+				break
+			}
+			out = append(out[:len(out)-2], Parent(a))
+		}
+	}
+	return out
+}
+
+// Parent returns the network one bit shorter which holds n.  The parent of
+// a /0 is itself.
+func Parent(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if ones == 0 {
+		return n
+	}
+	mask := net.CIDRMask(ones-1, bits)
+	return &net.IPNet{IP: n.IP.Mask(mask), Mask: mask}
+}
+
+// Sibling returns the other half of the parent of n.  The sibling of a /0
+// is itself.
+func Sibling(n *net.IPNet) *net.IPNet {
+	ones, _ := n.Mask.Size()
+	if ones == 0 {
+		return n
+	}
+	ip := append(net.IP(nil), n.IP...)
+	ip[(ones-1)/8] ^= 0x80 >> uint((ones-1)%8)
+	return &net.IPNet{IP: ip, Mask: n.Mask}
+}
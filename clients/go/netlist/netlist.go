@@ -0,0 +1,172 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package netlist holds lists of networks, such as an allowlist, and matches
+// addresses and CIDRs against them.
+package netlist
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ParseNet parses an address or CIDR into a network.  A bare address is
+// treated as a host route (/32 or /128).
+func ParseNet(addr string) (*net.IPNet, error) {
+	if strings.Contains(addr, "/") {
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", addr)
+		}
+		if ip4 := n.IP.To4(); ip4 != nil {
+			n.IP = ip4
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// Overlaps reports whether a and b share any address
+func Overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Entry is a network in a List
+type Entry struct {
+	Net *net.IPNet
+
+	// Source says where the entry came from, e.g. a file name
+	Source string
+}
+
+// List is a set of networks
+type List struct {
+	entries []Entry
+}
+
+// Add parses addr and adds it to the list
+func (l *List) Add(addr, source string) error {
+	n, err := ParseNet(addr)
+	if err != nil {
+		return err
+	}
+
+	l.AddNet(n, source)
+	return nil
+}
+
+// AddNet adds a network to the list
+func (l *List) AddNet(n *net.IPNet, source string) {
+	l.entries = append(l.entries, Entry{Net: n, Source: source})
+}
+
+// Len returns the number of entries
+func (l *List) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.entries)
+}
+
+// Entries returns the entries in the order they were added
+func (l *List) Entries() []Entry {
+	if l == nil {
+		return nil
+	}
+	return append([]Entry(nil), l.entries...)
+}
+
+// Strings returns the networks in CIDR form
+func (l *List) Strings() []string {
+	var out []string
+	for _, e := range l.Entries() {
+		out = append(out, e.Net.String())
+	}
+	return out
+}
+
+// Match returns the first entry which shares any address with n
+func (l *List) Match(n *net.IPNet) (Entry, bool) {
+	for _, e := range l.Entries() {
+		if Overlaps(e.Net, n) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Covers returns the first entry which holds all of n
+func (l *List) Covers(n *net.IPNet) (Entry, bool) {
+	nOnes, _ := n.Mask.Size()
+	for _, e := range l.Entries() {
+		ones, _ := e.Net.Mask.Size()
+		if len(e.Net.IP) == len(n.IP) && ones <= nOnes && e.Net.Contains(n.IP) {
+			return e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// ReadFile reads a list of addresses and CIDRs, one per line.  Blank lines
+// and anything after a # are ignored.
+func ReadFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		out = append(out, strings.Fields(line)...)
+	}
+	return out, s.Err()
+}
+
+// Glob returns the files matching a shell pattern.  A name without wildcards
+// is returned as it is, so that reading it reports a missing file.
+func Glob(pattern string) ([]string, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		files = []string{pattern}
+	}
+	return files, nil
+}
@@ -0,0 +1,210 @@
+package netlist
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	l := new(List)
+	assert.NoError(t, l.Add("192.0.2.0/24", "office"))
+	assert.NoError(t, l.Add("2001:db8::1", "vpn"))
+	assert.Error(t, l.Add("office", "bad"))
+
+	testCases := map[string]struct {
+		addr   string
+		source string
+	}{
+		"inside":        {addr: "192.0.2.7", source: "office"},
+		"covering":      {addr: "192.0.0.0/16", source: "office"},
+		"outside":       {addr: "198.51.100.1"},
+		"ipv6 host":     {addr: "2001:db8::1", source: "vpn"},
+		"ipv6 network":  {addr: "2001:db8::/64", source: "vpn"},
+		"ipv6 outside":  {addr: "2001:db8:1::1"},
+		"mapped ipv4":   {addr: "::ffff:192.0.2.9", source: "office"},
+		"other family":  {addr: "::/0", source: "vpn"},
+		"host in other": {addr: "192.0.3.1"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			n, err := ParseNet(tc.addr)
+			assert.NoError(t, err)
+
+			e, ok := l.Match(n)
+			assert.Equal(t, tc.source != "", ok)
+			assert.Equal(t, tc.source, e.Source)
+		})
+	}
+
+	var empty *List
+	_, ok := empty.Match(l.Entries()[0].Net)
+	assert.False(t, ok)
+}
+
+func TestCovers(t *testing.T) {
+	l := new(List)
+	assert.NoError(t, l.Add("10.1.0.0/16", "lab"))
+
+	testCases := map[string]struct {
+		addr string
+		ok   bool
+	}{
+		"host":     {addr: "10.1.2.3", ok: true},
+		"same":     {addr: "10.1.0.0/16", ok: true},
+		"narrower": {addr: "10.1.2.0/24", ok: true},
+		"wider":    {addr: "10.0.0.0/8"},
+		"outside":  {addr: "10.2.0.1"},
+		"ipv6":     {addr: "::a01:203"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			n, err := ParseNet(tc.addr)
+			assert.NoError(t, err)
+			_, ok := l.Covers(n)
+			assert.Equal(t, tc.ok, ok)
+		})
+	}
+}
+
+func TestReserved(t *testing.T) {
+	r := Reserved()
+
+	testCases := map[string]string{
+		"10.0.0.0/8":         Private,
+		"172.20.1.1":         Private,
+		"192.168.1.0/24":     Private,
+		"127.0.0.1":          Loopback,
+		"169.254.169.254":    LinkLocal,
+		"100.64.0.0/10":      SharedAddress,
+		"224.0.0.251":        Multicast,
+		"203.0.113.5":        Documentation,
+		"0.0.0.0":            Unspecified,
+		"0.0.0.0/0":          Unspecified,
+		"255.255.255.255":    Broadcast,
+		"::":                 Unspecified,
+		"::1":                Loopback,
+		"fd00::1":            Private,
+		"fe80::1":            LinkLocal,
+		"ff02::1":            Multicast,
+		"2001:db8::/48":      Documentation,
+		"45.0.0.1":           "",
+		"100.128.0.1":        "",
+		"2600::/16":          "",
+		"::ffff:10.0.0.1":    Private,
+		"8.0.0.0/7":          "",
+		"2001:4860:4860::88": "",
+		"240.0.0.1":          Future,
+		"250.0.0.0/8":        Future,
+		"198.18.0.1":         Benchmarking,
+		"198.19.255.255":     Benchmarking,
+		"198.20.0.1":         "",
+		"192.0.0.9":          Protocol,
+		"192.0.1.1":          "",
+		"64:ff9b::192.0.2.1": Translation,
+		"64:ff9b:1::1":       "",
+		"100::1":             Discard,
+		"100::1:0:0:0:1":     "",
+	}
+
+	for addr, kind := range testCases {
+		t.Run(addr, func(t *testing.T) {
+			n, err := ParseNet(addr)
+			assert.NoError(t, err)
+			e, _ := r.Match(n)
+			assert.Equal(t, kind, e.Source)
+		})
+	}
+}
+
+func TestMapped(t *testing.T) {
+	testCases := map[string]bool{
+		"::ffff:45.0.0.1":    true,
+		"::ffff:0:0/96":      true,
+		"::ffff:c000:201":    true,
+		"45.0.0.1":           false,
+		"45.0.0.0/8":         false,
+		"64:ff9b::45.0.0.1":  false,
+		"2001:4860:4860::88": false,
+		"not an address":     false,
+	}
+
+	for addr, mapped := range testCases {
+		t.Run(addr, func(t *testing.T) {
+			assert.Equal(t, mapped, Mapped(addr))
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	testCases := map[string]struct {
+		in   []string
+		want []string
+	}{
+		"empty": {},
+		"single": {
+			in:   []string{"192.0.2.1"},
+			want: []string{"192.0.2.1/32"},
+		},
+		"pair": {
+			in:   []string{"192.0.2.1", "192.0.2.0"},
+			want: []string{"192.0.2.0/31"},
+		},
+		"not aligned": {
+			in:   []string{"192.0.2.1", "192.0.2.2"},
+			want: []string{"192.0.2.1/32", "192.0.2.2/32"},
+		},
+		"cascade": {
+			in:   []string{"192.0.2.3", "192.0.2.0", "192.0.2.2", "192.0.2.1", "192.0.2.4/30"},
+			want: []string{"192.0.2.0/29"},
+		},
+		"contained and duplicate": {
+			in:   []string{"198.51.100.7", "198.51.100.0/24", "198.51.100.7", "198.51.100.128/25"},
+			want: []string{"198.51.100.0/24"},
+		},
+		"gap": {
+			in:   []string{"192.0.2.0/26", "192.0.2.64/26", "192.0.2.192/26"},
+			want: []string{"192.0.2.0/25", "192.0.2.192/26"},
+		},
+		"families kept apart": {
+			in:   []string{"2001:db8::1", "192.0.2.0", "2001:db8::", "192.0.2.1", "::ffff:192.0.2.2"},
+			want: []string{"192.0.2.0/31", "192.0.2.2/32", "2001:db8::/127"},
+		},
+		"whole space": {
+			in:   []string{"0.0.0.0/1", "128.0.0.0/1"},
+			want: []string{"0.0.0.0/0"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			l := new(List)
+			for _, a := range tc.in {
+				assert.NoError(t, l.Add(a, "test"))
+			}
+			var nets []*net.IPNet
+			for _, e := range l.Entries() {
+				nets = append(nets, e.Net)
+			}
+
+			var got []string
+			for _, n := range Aggregate(nets) {
+				got = append(got, n.String())
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestSibling(t *testing.T) {
+	n, _ := ParseNet("192.0.2.64/26")
+	assert.Equal(t, "192.0.2.0/26", Sibling(n).String())
+	assert.Equal(t, "192.0.2.0/25", Parent(n).String())
+
+	n, _ = ParseNet("2001:db8::1")
+	assert.Equal(t, "2001:db8::/128", Sibling(n).String())
+	assert.Equal(t, "2001:db8::/127", Parent(n).String())
+}
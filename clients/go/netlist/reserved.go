@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package netlist
+
+import (
+	"net"
+	"strings"
+)
+
+// Kinds of reserved ranges
+const (
+	Private       = "private"
+	Loopback      = "loopback"
+	LinkLocal     = "link-local"
+	SharedAddress = "shared address space"
+	Multicast     = "multicast"
+	Documentation = "documentation"
+	Unspecified   = "unspecified"
+	Broadcast     = "broadcast"
+	Future        = "reserved for future use"
+	Benchmarking  = "benchmarking"
+	Protocol      = "protocol assignments"
+	IPv4Mapped    = "IPv4-mapped"
+	Translation   = "IPv4/IPv6 translation"
+	Discard       = "discard"
+)
+
+// reserved are the special purpose ranges which never belong in a ban list
+var reserved = []struct {
+	cidr string
+	kind string
+}{
+	{"0.0.0.0/8", Unspecified},         // RFC 1122 "this network"
+	{"10.0.0.0/8", Private},            // RFC 1918
+	{"100.64.0.0/10", SharedAddress},   // RFC 6598 carrier-grade NAT
+	{"127.0.0.0/8", Loopback},          // RFC 1122
+	{"169.254.0.0/16", LinkLocal},      // RFC 3927
+	{"172.16.0.0/12", Private},         // RFC 1918
+	{"192.0.0.0/24", Protocol},         // RFC 6890 IETF protocol assignments
+	{"192.0.2.0/24", Documentation},    // RFC 5737 TEST-NET-1
+	{"192.168.0.0/16", Private},        // RFC 1918
+	{"198.18.0.0/15", Benchmarking},    // RFC 2544
+	{"198.51.100.0/24", Documentation}, // RFC 5737 TEST-NET-2
+	{"203.0.113.0/24", Documentation},  // RFC 5737 TEST-NET-3
+	{"224.0.0.0/4", Multicast},         // RFC 5771
+	{"255.255.255.255/32", Broadcast},  // RFC 919, ahead of the class E range holding it
+	{"240.0.0.0/4", Future},            // RFC 1112 class E
+	{"::/128", Unspecified},            // RFC 4291
+	{"::1/128", Loopback},              // RFC 4291
+	{"64:ff9b::/96", Translation},      // RFC 6052 NAT64
+	{"100::/64", Discard},              // RFC 6666
+	{"fc00::/7", Private},              // RFC 4193 unique local
+	{"fe80::/10", LinkLocal},           // RFC 4291
+	{"ff00::/8", Multicast},            // RFC 4291
+	{"2001:db8::/32", Documentation},   // RFC 3849
+}
+
+// Reserved returns the private, loopback, link-local, shared (CGNAT),
+// multicast, documentation, unspecified, broadcast, class E, benchmarking,
+// protocol assignment, NAT64 and discard ranges, with their kind as the
+// source.  The IPv4-mapped range is not among them (see Mapped).
+func Reserved() *List {
+	l := new(List)
+	for _, r := range reserved {
+		if err := l.Add(r.cidr, r.kind); err != nil {
+			panic(err)
+		}
+	}
+	return l
+}
+
+// Mapped reports whether addr is written as an IPv4-mapped IPv6 address or
+// network, within ::ffff:0:0/96 (RFC 4291).  ParseNet turns those into IPv4
+// networks and net.IPNet takes ::ffff:0:0/96 for all of IPv4, so the range
+// can't be held in a List; it is told apart by the text of addr instead.
+func Mapped(addr string) bool {
+	if i := strings.IndexByte(addr, '/'); i >= 0 {
+		addr = addr[:i]
+	}
+	return strings.Contains(addr, ":") && net.ParseIP(addr).To4() != nil
+}
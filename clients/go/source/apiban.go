@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package source
+
+import (
+	"github.com/palner/apiban/clients/go/apiban"
+)
+
+// APIBAN is the APIBAN.org feed.  Its cursor is the last known ID, and each
+// Fetch returns the addresses banned since, or the whole list for "" or
+// "100".
+type APIBAN struct {
+	Client *apiban.Client
+	Key    string
+}
+
+// Name implements Source
+func (s *APIBAN) Name() string {
+	return APIBANName
+}
+
+// Fetch implements Source
+func (s *APIBAN) Fetch(cursor string) (*Batch, error) {
+	e, err := s.Client.Banned(s.Key, cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Batch{
+		Entries: e.IPs,
+		Cursor:  e.ID,
+		Full:    cursor == "" || cursor == "100",
+	}, nil
+}
@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package source
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ExportVersion is the current format of export files
+const ExportVersion = 1
+
+// Export is a set of bans written by one client for others to import, such
+// as hosts with no path to APIBAN.org
+type Export struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Host     string    `json:"host,omitempty"`
+
+	// LKID is the last known ID of the exporting client
+	LKID string `json:"lkid"`
+
+	Entries []ExportEntry `json:"entries"`
+}
+
+// ExportEntry is a banned entry and what banned it
+type ExportEntry struct {
+	Address string   `json:"address"`
+	Sources []string `json:"sources,omitempty"`
+
+	// Reason and Until describe a manual ban or an escalation
+	Reason string     `json:"reason,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+// ReadExport reads an export file, compressed with gzip or not
+func ReadExport(r io.Reader) (*Export, error) {
+	br := bufio.NewReader(r)
+	r = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	e := new(Export)
+	if err := json.NewDecoder(r).Decode(e); err != nil {
+		return nil, fmt.Errorf("not an export file: %w", err)
+	}
+	if e.Version == 0 {
+		return nil, fmt.Errorf("not an export file: no version")
+	}
+	if e.Version > ExportVersion {
+		return nil, fmt.Errorf("export file version %d is not supported", e.Version)
+	}
+	return e, nil
+}
+
+// Write writes the export as JSON, compressed with gzip if compress is set
+func (e *Export) Write(w io.Writer, compress bool) error {
+	e.Version = ExportVersion
+	if !compress {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	}
+
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(e); err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// Addresses returns the entries which have not expired at t
+func (e *Export) Addresses(t time.Time) []string {
+	var out []string
+	for _, x := range e.Entries {
+		if x.Until == nil || t.Before(*x.Until) {
+			out = append(out, x.Address)
+		}
+	}
+	return out
+}
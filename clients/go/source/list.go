@@ -0,0 +1,218 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package source
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// File is a local list.  Its cursor is the modification time and size of
+// the file, so an unchanged file is not read again.
+type File struct {
+	Path   string
+	Format string
+	Column int
+
+	name string
+}
+
+// Name implements Source
+func (f *File) Name() string {
+	return f.name
+}
+
+// Fetch implements Source
+func (f *File) Fetch(cursor string) (*Batch, error) {
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	cur := fmt.Sprintf("%d-%d", fi.ModTime().UnixNano(), fi.Size())
+	if cur == cursor {
+		return &Batch{Cursor: cursor}, nil
+	}
+
+	r, err := os.Open(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	entries, err := Parse(r, f.Format, f.Column)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return &Batch{Entries: entries, Cursor: cur, Full: true}, nil
+}
+
+// HTTP is a remote list.  Its cursor is the ETag or Last-Modified header of
+// the last response, sent back so that the server can answer 304 Not
+// Modified.
+type HTTP struct {
+	URL    string
+	Format string
+	Column int
+	Client *http.Client
+
+	// MaxSize is the largest response read, in bytes; 0 means no limit
+	MaxSize int64
+
+	name string
+}
+
+// Name implements Source
+func (h *HTTP) Name() string {
+	return h.name
+}
+
+// Fetch implements Source
+func (h *HTTP) Fetch(cursor string) (*Batch, error) {
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case cursor == "":
+	case strings.HasPrefix(cursor, `"`) || strings.HasPrefix(cursor, `W/"`):
+		req.Header.Set("If-None-Match", cursor)
+	default:
+		req.Header.Set("If-Modified-Since", cursor)
+	}
+
+	hc := h.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return &Batch{Cursor: cursor}, nil
+	default:
+		return nil, fmt.Errorf("%s: unexpected status %s", h.URL, resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	var lr *io.LimitedReader
+	if h.MaxSize > 0 {
+		// Read one byte more, to tell a list of exactly MaxSize from a
+		// longer one
+		lr = &io.LimitedReader{R: resp.Body, N: h.MaxSize + 1}
+		body = lr
+	}
+
+	entries, err := Parse(body, h.Format, h.Column)
+	if lr != nil && lr.N == 0 {
+		return nil, fmt.Errorf("%s: larger than %d bytes", h.URL, h.MaxSize)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", h.URL, err)
+	}
+
+	cur := resp.Header.Get("ETag")
+	if cur == "" {
+		cur = resp.Header.Get("Last-Modified")
+	}
+	return &Batch{Entries: entries, Cursor: cur, Full: true}, nil
+}
+
+// Parse reads a list in the given format.  column is the column of a CSV
+// list holding the address, from 1.
+func Parse(r io.Reader, format string, column int) ([]string, error) {
+	switch format {
+	case FormatCSV:
+		return parseCSV(r, column)
+	case FormatExport:
+		e, err := ReadExport(r)
+		if err != nil {
+			return nil, err
+		}
+		return e.Addresses(time.Now()), nil
+	}
+	return parseText(r)
+}
+
+// parseText reads the first field of each line.  Anything after a # or a ;
+// is a comment, which covers both the FireHOL and the Spamhaus DROP lists.
+func parseText(r io.Reader) ([]string, error) {
+	var out []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.Fields(line); len(f) > 0 {
+			out = append(out, f[0])
+		}
+	}
+	return out, s.Err()
+}
+
+// parseCSV reads a column of comma separated values.  A first row which
+// doesn't hold an address is taken as a header.
+func parseCSV(r io.Reader, column int) ([]string, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	var out []string
+	for row := 0; ; row++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return out, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rec) < column {
+			return nil, fmt.Errorf("row %d has no column %d", row+1, column)
+		}
+		v := strings.TrimSpace(rec[column-1])
+		if row == 0 {
+			if _, err := netlist.ParseNet(v); err != nil {
+				continue
+			}
+		}
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+}
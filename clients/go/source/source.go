@@ -0,0 +1,252 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package source fetches lists of addresses to ban: the APIBAN.org feed,
+// local text and CSV files and remote plain-text lists such as the FireHOL
+// and Spamhaus DROP lists.
+package source
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/palner/apiban/clients/go/netlist"
+)
+
+// DefaultRefresh is how often a list is fetched unless its Spec says
+// otherwise
+const DefaultRefresh = time.Hour
+
+// DefaultMaxSize is the largest remote list read, in MB, unless its Spec
+// says otherwise
+const DefaultMaxSize = 64
+
+// Names the sources which are not configured by a Spec
+const (
+	// APIBANName is the name of the APIBAN.org feed
+	APIBANName = "apiban"
+
+	// ManualName stands for the bans added by hand
+	ManualName = "manual"
+
+	// ImportName is the list of the last file imported (see Export)
+	ImportName = "import"
+)
+
+// Formats of a list
+const (
+	// FormatText is one address or CIDR per line, as the first field;
+	// anything after a # or ; is a comment
+	FormatText = "text"
+
+	// FormatCSV is comma separated values, with the address in one column
+	FormatCSV = "csv"
+
+	// FormatExport is a file written by the export command, compressed or
+	// not (see Export)
+	FormatExport = "export"
+)
+
+// Source is a list of addresses to ban
+type Source interface {
+
+	// Name identifies the source in the state and the logs
+	Name() string
+
+	// Fetch returns the entries listed since cursor, which is what the
+	// previous Fetch returned in Batch.Cursor, or "" the first time
+	Fetch(cursor string) (*Batch, error)
+}
+
+// Batch is the result of a Fetch
+type Batch struct {
+
+	// Entries are the addresses and CIDRs fetched
+	Entries []string
+
+	// Cursor is passed to the next Fetch
+	Cursor string
+
+	// Full indicates Entries is the whole list, replacing what was fetched
+	// before, rather than what was added since the cursor.  A Batch which is
+	// neither Full nor has Entries means nothing changed.
+	Full bool
+}
+
+// Unchanged reports whether nothing changed since the cursor
+func (b *Batch) Unchanged() bool {
+	return !b.Full && len(b.Entries) == 0
+}
+
+// Spec describes a list to merge with the APIBAN feed, in the form
+//
+//	name=location[;option=value...]
+//
+// where location is a file or an http(s) URL and the options are format
+// (text, csv or export), column (the column of a CSV list holding the address,
+// from 1), refresh (how often to fetch the list), weight (what the list
+// adds to the score of its entries), maxsize (the largest remote list read,
+// in MB) and allow (an address, CIDR or file pattern of addresses which the
+// list may not ban; repeatable).
+type Spec struct {
+	Name     string
+	Location string
+	Format   string
+	Column   int
+	Refresh  time.Duration
+	Weight   int
+	Allow    []string
+
+	// MaxSize is in MB; 0 means DefaultMaxSize
+	MaxSize int
+}
+
+var specName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// ParseSpec parses the description of a list
+func ParseSpec(s string) (*Spec, error) {
+	parts := strings.Split(s, ";")
+	i := strings.IndexByte(parts[0], '=')
+	if i < 0 {
+		return nil, fmt.Errorf("%q is not name=location", s)
+	}
+
+	spec := &Spec{
+		Name:     parts[0][:i],
+		Location: parts[0][i+1:],
+		Format:   FormatText,
+		Column:   1,
+		Refresh:  DefaultRefresh,
+		Weight:   1,
+	}
+	if !specName.MatchString(spec.Name) {
+		return nil, fmt.Errorf("%q is not a valid source name (lower case letters, digits, - and _)", spec.Name)
+	}
+	if spec.Name == APIBANName || spec.Name == ManualName || spec.Name == ImportName {
+		return nil, fmt.Errorf("%q is reserved", spec.Name)
+	}
+	if spec.Location == "" {
+		return nil, fmt.Errorf("%s: no location", spec.Name)
+	}
+	if strings.HasSuffix(strings.ToLower(spec.Location), ".csv") {
+		spec.Format = FormatCSV
+	}
+
+	for _, opt := range parts[1:] {
+		i := strings.IndexByte(opt, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%s: %q is not option=value", spec.Name, opt)
+		}
+		key, value := opt[:i], opt[i+1:]
+
+		switch key {
+		case "format":
+			if value != FormatText && value != FormatCSV && value != FormatExport {
+				return nil, fmt.Errorf("%s: format %q is not text, csv or export", spec.Name, value)
+			}
+			spec.Format = value
+		case "column":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s: column %q is not a number from 1", spec.Name, value)
+			}
+			spec.Column = n
+		case "refresh":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("%s: refresh %q is not a duration such as 1h", spec.Name, value)
+			}
+			spec.Refresh = d
+		case "weight":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s: weight %q is not a whole number from 0", spec.Name, value)
+			}
+			spec.Weight = n
+		case "maxsize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%s: maxsize %q is not a number of MB from 1", spec.Name, value)
+			}
+			spec.MaxSize = n
+		case "allow":
+			spec.Allow = append(spec.Allow, value)
+		default:
+			return nil, fmt.Errorf("%s: unknown option %q", spec.Name, key)
+		}
+	}
+
+	if spec.Column > 1 && spec.Format != FormatCSV {
+		return nil, fmt.Errorf("%s: column only applies to CSV lists", spec.Name)
+	}
+
+	return spec, nil
+}
+
+// IsRemote reports whether the list is fetched over HTTP
+func (s *Spec) IsRemote() bool {
+	l := strings.ToLower(s.Location)
+	return strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://")
+}
+
+// Open returns the Source for the list; hc is used for remote lists
+func (s *Spec) Open(hc *http.Client) Source {
+	if s.IsRemote() {
+		max := s.MaxSize
+		if max == 0 {
+			max = DefaultMaxSize
+		}
+		return &HTTP{name: s.Name, URL: s.Location, Format: s.Format, Column: s.Column, MaxSize: int64(max) << 20, Client: hc}
+	}
+	return &File{name: s.Name, Path: s.Location, Format: s.Format, Column: s.Column}
+}
+
+// Allowlist returns the networks which the list may not ban
+func (s *Spec) Allowlist() (*netlist.List, error) {
+	l := new(netlist.List)
+	for _, a := range s.Allow {
+		if _, err := netlist.ParseNet(a); err == nil {
+			l.Add(a, s.Name+" allow")
+			continue
+		}
+
+		files, err := netlist.Glob(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Name, err)
+		}
+		for _, file := range files {
+			addrs, err := netlist.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", s.Name, err)
+			}
+			for _, addr := range addrs {
+				if err := l.Add(addr, file); err != nil {
+					return nil, fmt.Errorf("%s: %s: %v", s.Name, file, err)
+				}
+			}
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,269 @@
+package source
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSpec(t *testing.T) {
+	testCases := map[string]struct {
+		spec string
+		want *Spec
+		err  string
+	}{
+		"file": {
+			spec: "local=/etc/apiban/blocklist.txt",
+			want: &Spec{Name: "local", Location: "/etc/apiban/blocklist.txt", Format: FormatText, Column: 1, Refresh: DefaultRefresh, Weight: 1},
+		},
+		"csv by extension": {
+			spec: "abuse=/etc/apiban/abuse.csv;column=2;allow=192.0.2.0/24;allow=/etc/apiban/abuse-allow.txt",
+			want: &Spec{Name: "abuse", Location: "/etc/apiban/abuse.csv", Format: FormatCSV, Column: 2, Refresh: DefaultRefresh, Weight: 1,
+				Allow: []string{"192.0.2.0/24", "/etc/apiban/abuse-allow.txt"}},
+		},
+		"remote": {
+			spec: "drop=https://www.spamhaus.org/drop/drop.txt;refresh=12h;weight=2",
+			want: &Spec{Name: "drop", Location: "https://www.spamhaus.org/drop/drop.txt", Format: FormatText, Column: 1, Refresh: 12 * time.Hour, Weight: 2},
+		},
+		"no location": {
+			spec: "local",
+			err:  `"local" is not name=location`,
+		},
+		"bad name": {
+			spec: "Local List=/tmp/x",
+			err:  `"Local List" is not a valid source name (lower case letters, digits, - and _)`,
+		},
+		"reserved name": {
+			spec: "apiban=/tmp/x",
+			err:  `"apiban" is reserved`,
+		},
+		"export": {
+			spec: "hub=/var/lib/apiban/hub.json.gz;format=export",
+			want: &Spec{Name: "hub", Location: "/var/lib/apiban/hub.json.gz", Format: FormatExport, Column: 1, Refresh: DefaultRefresh, Weight: 1},
+		},
+		"import is reserved": {
+			spec: "import=/tmp/x;format=export",
+			err:  `"import" is reserved`,
+		},
+		"bad format": {
+			spec: "local=/tmp/x;format=xml",
+			err:  `local: format "xml" is not text, csv or export`,
+		},
+		"bad refresh": {
+			spec: "local=/tmp/x;refresh=soon",
+			err:  `local: refresh "soon" is not a duration such as 1h`,
+		},
+		"bad weight": {
+			spec: "local=/tmp/x;weight=-1",
+			err:  `local: weight "-1" is not a whole number from 0`,
+		},
+		"max size": {
+			spec: "drop=https://www.spamhaus.org/drop/drop.txt;maxsize=8",
+			want: &Spec{Name: "drop", Location: "https://www.spamhaus.org/drop/drop.txt", Format: FormatText, Column: 1, Refresh: DefaultRefresh, Weight: 1, MaxSize: 8},
+		},
+		"bad max size": {
+			spec: "drop=https://www.spamhaus.org/drop/drop.txt;maxsize=0",
+			err:  `drop: maxsize "0" is not a number of MB from 1`,
+		},
+		"unknown option": {
+			spec: "local=/tmp/x;priority=2",
+			err:  `local: unknown option "priority"`,
+		},
+		"column of text": {
+			spec: "local=/tmp/x;column=2",
+			err:  "local: column only applies to CSV lists",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			spec, err := ParseSpec(tc.spec)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, spec)
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	testCases := map[string]struct {
+		data   string
+		format string
+		column int
+		want   []string
+		err    string
+	}{
+		"firehol": {
+			data:   "#\n# firehol_level1\n#\n192.0.2.0/24\n198.51.100.7\n",
+			format: FormatText,
+			want:   []string{"192.0.2.0/24", "198.51.100.7"},
+		},
+		"spamhaus drop": {
+			data:   "; Spamhaus DROP List\n192.0.2.0/24 ; SBL1\n198.51.100.0/22 ; SBL2\n",
+			format: FormatText,
+			want:   []string{"192.0.2.0/24", "198.51.100.0/22"},
+		},
+		"csv with header": {
+			data:   "first_seen,ip,reason\n2020-01-01,192.0.2.1,scan\n# comment\n2020-01-02, 2001:db8::1,flood\n",
+			format: FormatCSV,
+			column: 2,
+			want:   []string{"192.0.2.1", "2001:db8::1"},
+		},
+		"csv short row": {
+			data:   "192.0.2.1,scan\n198.51.100.7\n",
+			format: FormatCSV,
+			column: 2,
+			err:    "row 2 has no column 2",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tc.data), tc.format, tc.column)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "blocklist.txt")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("192.0.2.1\n192.0.2.2\n"), 0644))
+
+	spec, err := ParseSpec("local=" + path)
+	assert.NoError(t, err)
+	src := spec.Open(nil)
+	assert.Equal(t, "local", src.Name())
+
+	b, err := src.Fetch("")
+	assert.NoError(t, err)
+	assert.True(t, b.Full)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, b.Entries)
+
+	// An unchanged file is not read again
+	b2, err := src.Fetch(b.Cursor)
+	assert.NoError(t, err)
+	assert.True(t, b2.Unchanged())
+
+	assert.NoError(t, os.Remove(path))
+	_, err = src.Fetch(b.Cursor)
+	assert.Error(t, err)
+}
+
+func TestHTTP(t *testing.T) {
+	list := "192.0.2.0/24 ; SBL1\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/drop.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		etag := `"` + strings.Fields(list)[0] + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	spec, err := ParseSpec("drop=" + srv.URL + "/drop.txt")
+	assert.NoError(t, err)
+	src := spec.Open(srv.Client())
+
+	b, err := src.Fetch("")
+	assert.NoError(t, err)
+	assert.Equal(t, &Batch{Entries: []string{"192.0.2.0/24"}, Cursor: `"192.0.2.0/24"`, Full: true}, b)
+
+	b, err = src.Fetch(b.Cursor)
+	assert.NoError(t, err)
+	assert.True(t, b.Unchanged())
+
+	list = "198.51.100.0/22 ; SBL2\n"
+	b, err = src.Fetch(b.Cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"198.51.100.0/22"}, b.Entries)
+
+	spec.Location = srv.URL + "/missing.txt"
+	_, err = spec.Open(srv.Client()).Fetch("")
+	assert.EqualError(t, err, srv.URL+"/missing.txt: unexpected status 404 Not Found")
+}
+
+func TestHTTPMaxSize(t *testing.T) {
+	list := "192.0.2.0/24\n198.51.100.0/22\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(list))
+	}))
+	defer srv.Close()
+
+	h := &HTTP{URL: srv.URL, Format: FormatText, Client: srv.Client(), MaxSize: int64(len(list))}
+	b, err := h.Fetch("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.0/24", "198.51.100.0/22"}, b.Entries)
+
+	h.MaxSize--
+	_, err = h.Fetch("")
+	assert.EqualError(t, err, fmt.Sprintf("%s: larger than %d bytes", srv.URL, len(list)-1))
+
+	spec, err := ParseSpec("drop=" + srv.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(DefaultMaxSize)<<20, spec.Open(nil).(*HTTP).MaxSize)
+}
+
+func TestExport(t *testing.T) {
+	now := time.Unix(1600000000, 0).UTC()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	e := &Export{Exported: now, Host: "sbc1", LKID: "1234", Entries: []ExportEntry{
+		{Address: "192.0.2.1", Sources: []string{"apiban", "drop"}},
+		{Address: "198.51.100.7", Sources: []string{"manual"}, Reason: "SIP scan", Until: &future},
+		{Address: "198.51.100.8", Sources: []string{"manual"}, Until: &past},
+	}}
+
+	for _, compress := range []bool{false, true} {
+		var buf bytes.Buffer
+		assert.NoError(t, e.Write(&buf, compress))
+		assert.Equal(t, compress, buf.Bytes()[0] == 0x1f)
+
+		got, err := ReadExport(&buf)
+		if assert.NoError(t, err) {
+			assert.Equal(t, ExportVersion, got.Version)
+			assert.True(t, now.Equal(got.Exported))
+			assert.Equal(t, "1234", got.LKID)
+			assert.Len(t, got.Entries, 3)
+			assert.Equal(t, []string{"192.0.2.1", "198.51.100.7"}, got.Addresses(now))
+		}
+	}
+
+	entries, err := Parse(strings.NewReader(`{"version":1,"lkid":"5","entries":[{"address":"203.0.113.5"}]}`), FormatExport, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.5"}, entries)
+
+	_, err = ReadExport(strings.NewReader(`{"version":2,"entries":[]}`))
+	assert.EqualError(t, err, "export file version 2 is not supported")
+	_, err = ReadExport(strings.NewReader(`{"entries":[]}`))
+	assert.EqualError(t, err, "not an export file: no version")
+	_, err = ReadExport(strings.NewReader("192.0.2.1\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// snapshotVersion is the current snapshot file format
+const snapshotVersion = 1
+
+// ErrNoSnapshot is returned by LoadSnapshot when no snapshot was taken yet
+var ErrNoSnapshot = errors.New("no snapshot has been taken yet")
+
+// Snapshot is the set of entries the firewall held after a sync, kept so it
+// can be put back at boot before APIBAN.org is reachable
+type Snapshot struct {
+	Version int       `json:"version"`
+	Taken   time.Time `json:"taken"`
+	LKID    string    `json:"lkid"`
+
+	// Entries are the banned entries, sorted
+	Entries []string `json:"entries"`
+}
+
+// SnapshotFile returns the location of the snapshot kept with the given
+// state file
+func SnapshotFile(stateFile string) string {
+	return filepath.Join(filepath.Dir(stateFile), "snapshot.json")
+}
+
+// LoadSnapshot reads the snapshot at path
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+
+	s := new(Snapshot)
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+	}
+	if s.Version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s has unsupported version %d", path, s.Version)
+	}
+	return s, nil
+}
+
+// Save writes the snapshot atomically to path
+func (s *Snapshot) Save(path string) error {
+	s.Version = snapshotVersion
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return WriteFile(path, append(data, '\n'))
+}
@@ -0,0 +1,460 @@
+/*
+ * Copyright (C) 2020-2021 Fred Posner (palner.com)
+ *
+ * This file is part of APIBAN.org.
+ *
+ * apiban-iptables-client is free software; you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation; either version 2 of the License, or
+ * (at your option) any later version
+ *
+ * apiban-iptables-client is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+ *
+ */
+
+// Package state persists the mutable state of the APIBAN client, separately
+// from its configuration.
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// DefaultFile is the default location of the state file
+const DefaultFile = "/var/lib/apiban/state.json"
+
+// version is the current state file format
+const version = 1
+
+// State is the mutable state of the client
+type State struct {
+
+	// LKID is the last known ID received from APIBAN.org
+	LKID string
+
+	// Flushed is the time the chain was last flushed
+	Flushed time.Time
+
+	// LastSuccess is the time of the last successful sync
+	LastSuccess time.Time
+
+	// Aggregated indicates the rules were applied aggregated
+	Aggregated bool
+
+	// Scoring describes the threshold and weights the rules were applied
+	// with
+	Scoring string
+
+	// ShadowSince is the start of the current observation window of the
+	// hooks in shadow mode, or zero if there are none
+	ShadowSince time.Time
+
+	// Restored is when the bans were put back from the snapshot, until the
+	// next sync reconciles them with the state
+	Restored time.Time
+
+	applied     map[string]struct{}
+	quarantine  map[string]Quarantined
+	escalations map[string]Escalation
+	manual      map[string]Manual
+	sources     map[string]Source
+	path        string
+}
+
+// Source is what is kept of a list merged with the APIBAN feed: where its
+// last fetch left off and the entries it bans
+type Source struct {
+	Name    string    `json:"name"`
+	Cursor  string    `json:"cursor,omitempty"`
+	Fetched time.Time `json:"fetched"`
+
+	// Entries are sorted
+	Entries []string `json:"entries,omitempty"`
+}
+
+// Lists reports whether the source bans addr
+func (src Source) Lists(addr string) bool {
+	i := sort.SearchStrings(src.Entries, addr)
+	return i < len(src.Entries) && src.Entries[i] == addr
+}
+
+// Manual is a ban added by hand.  Manual bans are kept apart from the feed
+// entries and survive flushes.
+type Manual struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason,omitempty"`
+	Since   time.Time `json:"since"`
+
+	// Until is when the ban expires, or nil if it does not
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Expired reports whether the ban has expired at t
+func (m Manual) Expired(t time.Time) bool {
+	return m.Until != nil && !t.Before(*m.Until)
+}
+
+// Escalation is a network banned because many of its addresses are
+type Escalation struct {
+	Network string    `json:"network"`
+	Reason  string    `json:"reason"`
+	Members []string  `json:"members"`
+	Since   time.Time `json:"since"`
+}
+
+// Quarantined is a feed entry held back from the firewall for review
+type Quarantined struct {
+	Address string    `json:"address"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+}
+
+// file is the on-disk form of a State
+type file struct {
+	Version     int        `json:"version"`
+	LKID        string     `json:"lkid"`
+	Flushed     time.Time  `json:"flushed"`
+	LastSuccess time.Time  `json:"last_success"`
+	Applied     []string   `json:"applied"`
+	Aggregated  bool       `json:"aggregated,omitempty"`
+	Scoring     string     `json:"scoring,omitempty"`
+	ShadowSince *time.Time `json:"shadow_since,omitempty"`
+	Restored    *time.Time `json:"restored,omitempty"`
+
+	Quarantine  []Quarantined `json:"quarantine,omitempty"`
+	Escalations []Escalation  `json:"escalations,omitempty"`
+	Manual      []Manual      `json:"manual,omitempty"`
+	Sources     []Source      `json:"sources,omitempty"`
+}
+
+// Load reads the state from path.  A missing file is not an error; an empty
+// State is returned, for which IsNew reports true.
+func Load(path string) (*State, error) {
+	s := &State{
+		applied:     make(map[string]struct{}),
+		quarantine:  make(map[string]Quarantined),
+		escalations: make(map[string]Escalation),
+		manual:      make(map[string]Manual),
+		sources:     make(map[string]Source),
+		path:        path,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	f := new(file)
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, fmt.Errorf("failed to decode state file %s: %w", path, err)
+	}
+	if f.Version > version {
+		return nil, fmt.Errorf("state file %s has unsupported version %d", path, f.Version)
+	}
+
+	s.LKID = f.LKID
+	s.Flushed = f.Flushed
+	s.LastSuccess = f.LastSuccess
+	s.Aggregated = f.Aggregated
+	s.Scoring = f.Scoring
+	if f.ShadowSince != nil {
+		s.ShadowSince = *f.ShadowSince
+	}
+	if f.Restored != nil {
+		s.Restored = *f.Restored
+	}
+	for _, a := range f.Applied {
+		s.applied[a] = struct{}{}
+	}
+	for _, q := range f.Quarantine {
+		s.quarantine[q.Address] = q
+	}
+	for _, e := range f.Escalations {
+		s.escalations[e.Network] = e
+	}
+	for _, m := range f.Manual {
+		s.manual[m.Address] = m
+	}
+	for _, src := range f.Sources {
+		s.SetSource(src)
+	}
+
+	return s, nil
+}
+
+// Path returns the location of the state file
+func (s *State) Path() string {
+	return s.path
+}
+
+// IsNew reports whether the state has never been saved
+func (s *State) IsNew() bool {
+	_, err := os.Stat(s.path)
+	return os.IsNotExist(err)
+}
+
+// Applied returns the applied addresses, sorted
+func (s *State) Applied() []string {
+	out := make([]string, 0, len(s.applied))
+	for a := range s.applied {
+		out = append(out, a)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// SetApplied records whether addr is applied to the firewall
+func (s *State) SetApplied(addr string, applied bool) {
+	if applied {
+		s.applied[addr] = struct{}{}
+	} else {
+		delete(s.applied, addr)
+	}
+}
+
+// IsApplied reports whether addr is recorded as applied
+func (s *State) IsApplied(addr string) bool {
+	_, ok := s.applied[addr]
+	return ok
+}
+
+// ClearApplied forgets all applied addresses and escalations, after a flush
+func (s *State) ClearApplied() {
+	s.applied = make(map[string]struct{})
+	s.escalations = make(map[string]Escalation)
+}
+
+// Escalate records an escalated network, keeping the time it was first
+// escalated
+func (s *State) Escalate(e Escalation) {
+	if old, ok := s.escalations[e.Network]; ok {
+		e.Since = old.Since
+	}
+	s.escalations[e.Network] = e
+}
+
+// Deescalate forgets an escalated network
+func (s *State) Deescalate(network string) {
+	delete(s.escalations, network)
+}
+
+// Escalation returns the escalation of network, if any
+func (s *State) Escalation(network string) (Escalation, bool) {
+	e, ok := s.escalations[network]
+	return e, ok
+}
+
+// Escalations returns the escalated networks, sorted
+func (s *State) Escalations() []Escalation {
+	out := make([]Escalation, 0, len(s.escalations))
+	for _, e := range s.escalations {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Network < out[j].Network })
+	return out
+}
+
+// Ban records a manual ban, replacing any earlier one of the same address
+func (s *State) Ban(m Manual) {
+	s.manual[m.Address] = m
+}
+
+// Unban forgets the manual ban of addr, reporting whether there was one
+func (s *State) Unban(addr string) bool {
+	_, ok := s.manual[addr]
+	delete(s.manual, addr)
+	return ok
+}
+
+// ManualBan returns the manual ban of addr, if any
+func (s *State) ManualBan(addr string) (Manual, bool) {
+	m, ok := s.manual[addr]
+	return m, ok
+}
+
+// Manual returns the manual bans, sorted by address
+func (s *State) Manual() []Manual {
+	out := make([]Manual, 0, len(s.manual))
+	for _, m := range s.manual {
+		out = append(out, m)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// SetSource records a source, replacing any earlier record of the same name
+func (s *State) SetSource(src Source) {
+	entries := append([]string(nil), src.Entries...)
+	sort.Strings(entries)
+	src.Entries = entries[:0]
+	for i, e := range entries {
+		if i == 0 || e != entries[i-1] {
+			src.Entries = append(src.Entries, e)
+		}
+	}
+	s.sources[src.Name] = src
+}
+
+// Source returns the record of a source, if any
+func (s *State) Source(name string) (Source, bool) {
+	src, ok := s.sources[name]
+	return src, ok
+}
+
+// DropSource forgets a source
+func (s *State) DropSource(name string) {
+	delete(s.sources, name)
+}
+
+// Sources returns the sources, sorted by name
+func (s *State) Sources() []Source {
+	out := make([]Source, 0, len(s.sources))
+	for _, src := range s.sources {
+		out = append(out, src)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Listed returns the names of the sources banning addr, sorted
+func (s *State) Listed(addr string) []string {
+	var out []string
+	for _, src := range s.Sources() {
+		if src.Lists(addr) {
+			out = append(out, src.Name)
+		}
+	}
+	return out
+}
+
+// Unlist removes addr from every source
+func (s *State) Unlist(addr string) {
+	for name, src := range s.sources {
+		i := sort.SearchStrings(src.Entries, addr)
+		if i < len(src.Entries) && src.Entries[i] == addr {
+			src.Entries = append(src.Entries[:i:i], src.Entries[i+1:]...)
+			s.sources[name] = src
+		}
+	}
+}
+
+// Quarantine holds addr back for review, keeping the time it was first
+// quarantined
+func (s *State) Quarantine(addr, reason string, at time.Time) {
+	if q, ok := s.quarantine[addr]; ok {
+		at = q.Since
+	}
+	s.quarantine[addr] = Quarantined{Address: addr, Reason: reason, Since: at}
+}
+
+// Release takes addr out of quarantine
+func (s *State) Release(addr string) {
+	delete(s.quarantine, addr)
+}
+
+// Quarantined returns the quarantined entries, sorted by address
+func (s *State) Quarantined() []Quarantined {
+	out := make([]Quarantined, 0, len(s.quarantine))
+	for _, q := range s.quarantine {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// Save writes the state atomically: it is written to a temporary file in the
+// same directory, synced to disk and then renamed over the old file, so a
+// crash leaves either the old or the new state, never a partial one.
+func (s *State) Save() error {
+	var shadowSince, restored *time.Time
+	if !s.ShadowSince.IsZero() {
+		shadowSince = &s.ShadowSince
+	}
+	if !s.Restored.IsZero() {
+		restored = &s.Restored
+	}
+
+	data, err := json.MarshalIndent(&file{
+		Version:     version,
+		LKID:        s.LKID,
+		Flushed:     s.Flushed,
+		LastSuccess: s.LastSuccess,
+		Applied:     s.Applied(),
+		Aggregated:  s.Aggregated,
+		Scoring:     s.Scoring,
+		ShadowSince: shadowSince,
+		Restored:    restored,
+		Quarantine:  s.Quarantined(),
+		Escalations: s.Escalations(),
+		Manual:      s.Manual(),
+		Sources:     s.Sources(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return WriteFile(s.path, append(data, '\n'))
+}
+
+// WriteFile atomically replaces path with data, creating the directory if
+// needed.  The file is created with mode 0600.
+func WriteFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	// Remove the temporary file unless it was renamed into place
+	done := false
+	defer func() {
+		if !done {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+	done = true
+
+	// Make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	_ = d.Sync()
+
+	return nil
+}
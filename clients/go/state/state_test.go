@@ -0,0 +1,187 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "apiban")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadMissing(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := Load(filepath.Join(dir, "state.json"))
+	assert.NoError(t, err)
+	assert.True(t, s.IsNew())
+	assert.Empty(t, s.LKID)
+	assert.Empty(t, s.Applied())
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "sub", "state.json")
+
+	s, err := Load(path)
+	assert.NoError(t, err)
+
+	now := time.Unix(1600000000, 0).UTC()
+	s.LKID = "1234"
+	s.Flushed = now
+	s.LastSuccess = now.Add(time.Minute)
+	s.ShadowSince = now
+	s.Restored = now
+	s.Scoring = "threshold=2 apiban=2"
+	s.SetApplied("192.0.2.2", true)
+	s.SetApplied("192.0.2.1", true)
+	s.SetApplied("192.0.2.3", true)
+	s.SetApplied("192.0.2.3", false)
+	s.Quarantine("10.0.0.0/8", "private", now)
+	s.Quarantine("10.0.0.0/8", "private", now.Add(time.Hour))
+	s.Quarantine("127.0.0.1", "loopback", now)
+	s.Release("127.0.0.1")
+	s.Escalate(Escalation{Network: "198.51.100.0/24", Reason: "3 banned", Members: []string{"198.51.100.1"}, Since: now})
+	s.Escalate(Escalation{Network: "198.51.100.0/24", Reason: "4 banned", Members: []string{"198.51.100.1"}, Since: now.Add(time.Hour)})
+	until := now.Add(6 * time.Hour)
+	s.Ban(Manual{Address: "203.0.113.9/32", Reason: "abuse", Since: now, Until: &until})
+	s.Ban(Manual{Address: "203.0.113.0/24", Since: now})
+	s.Ban(Manual{Address: "203.0.113.7/32", Since: now})
+	assert.True(t, s.Unban("203.0.113.7/32"))
+	assert.False(t, s.Unban("203.0.113.7/32"))
+	s.SetSource(Source{Name: "drop", Cursor: `"abc"`, Fetched: now, Entries: []string{"198.51.100.0/24", "192.0.2.1", "198.51.100.0/24"}})
+	s.SetSource(Source{Name: "local", Fetched: now, Entries: []string{"192.0.2.1", "203.0.113.5"}})
+	s.SetSource(Source{Name: "old"})
+	s.DropSource("old")
+	s.Unlist("203.0.113.5")
+	assert.NoError(t, s.Save())
+	assert.False(t, s.IsNew())
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// No temporary files are left behind
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	l, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "1234", l.LKID)
+	assert.True(t, now.Equal(l.Flushed))
+	assert.True(t, now.Add(time.Minute).Equal(l.LastSuccess))
+	assert.True(t, now.Equal(l.ShadowSince))
+	assert.True(t, now.Equal(l.Restored))
+	assert.Equal(t, "threshold=2 apiban=2", l.Scoring)
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, l.Applied())
+	assert.True(t, l.IsApplied("192.0.2.1"))
+	assert.False(t, l.IsApplied("192.0.2.3"))
+	if assert.Len(t, l.Quarantined(), 1) {
+		q := l.Quarantined()[0]
+		assert.Equal(t, "10.0.0.0/8", q.Address)
+		assert.Equal(t, "private", q.Reason)
+		assert.True(t, now.Equal(q.Since))
+	}
+
+	if assert.Len(t, l.Escalations(), 1) {
+		e := l.Escalations()[0]
+		assert.Equal(t, "4 banned", e.Reason)
+		assert.True(t, now.Equal(e.Since))
+	}
+
+	if assert.Len(t, l.Manual(), 2) {
+		m := l.Manual()[1]
+		assert.Equal(t, "203.0.113.9/32", m.Address)
+		assert.Equal(t, "abuse", m.Reason)
+		assert.False(t, m.Expired(now))
+		assert.True(t, m.Expired(until))
+		assert.False(t, l.Manual()[0].Expired(until))
+	}
+
+	if assert.Len(t, l.Sources(), 2) {
+		src, ok := l.Source("drop")
+		assert.True(t, ok)
+		assert.Equal(t, `"abc"`, src.Cursor)
+		assert.True(t, now.Equal(src.Fetched))
+		assert.Equal(t, []string{"192.0.2.1", "198.51.100.0/24"}, src.Entries)
+		assert.True(t, src.Lists("198.51.100.0/24"))
+		assert.False(t, src.Lists("198.51.100.1"))
+	}
+	assert.Equal(t, []string{"drop", "local"}, l.Listed("192.0.2.1"))
+	assert.Empty(t, l.Listed("203.0.113.5"))
+
+	l.ClearApplied()
+	assert.Empty(t, l.Applied())
+	assert.Empty(t, l.Escalations())
+	assert.Len(t, l.Manual(), 2)
+	assert.Len(t, l.Sources(), 2)
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "state.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err := Load(path)
+	assert.Error(t, err)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"version":99}`), 0600))
+	_, err = Load(path)
+	assert.EqualError(t, err, "state file "+path+" has unsupported version 99")
+}
+
+func TestLock(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := LockFile(filepath.Join(dir, "state.json"))
+
+	l, err := Acquire(path)
+	assert.NoError(t, err)
+
+	_, err = Acquire(path)
+	assert.Equal(t, ErrLocked, err)
+
+	assert.NoError(t, l.Release())
+
+	l, err = Acquire(path)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Release())
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := SnapshotFile(filepath.Join(dir, "state.json"))
+	assert.Equal(t, filepath.Join(dir, "snapshot.json"), path)
+
+	_, err := LoadSnapshot(path)
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	now := time.Unix(1600000000, 0).UTC()
+	s := &Snapshot{Taken: now, LKID: "1234", Entries: []string{"192.0.2.1", "198.51.100.0/24"}}
+	assert.NoError(t, s.Save(path))
+
+	l, err := LoadSnapshot(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, l.Version)
+	assert.True(t, now.Equal(l.Taken))
+	assert.Equal(t, "1234", l.LKID)
+	assert.Equal(t, []string{"192.0.2.1", "198.51.100.0/24"}, l.Entries)
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"version":99}`), 0600))
+	_, err = LoadSnapshot(path)
+	assert.EqualError(t, err, "snapshot "+path+" has unsupported version 99")
+}
@@ -78,17 +78,11 @@ else
 fi
 
 echo "-> setting configuration to use your apikey"
-echo "{\"APIKEY\":\"$APIKEY\",\"LKID\":\"100\",\"VERSION\":\"0.7\",\"FLUSH\":\"200\"}" > config.json
+(umask 077 && echo "{\"APIKEY\":\"$APIKEY\",\"LKID\":\"100\",\"VERSION\":\"0.7\",\"FLUSH\":\"200\"}" > config.json)
+chmod 600 config.json
 chmod +x /usr/local/bin/apiban/apiban-iptables-client
-echo "-> setting log rotation"
-cat > /etc/logrotate.d/apiban-client << EOF
-/var/log/apiban-client.log {
-        daily
-        copytruncate
-        rotate 7
-        compress
-}
-EOF
+echo "-> removing old log rotation (the client rotates its log itself)"
+rm -f /etc/logrotate.d/apiban-client
 echo "-> setting up service"
 cd /lib/systemd/system/
 wget https://raw.githubusercontent.com/palner/apiban/master/clients/go/systemd/apiban-iptables.service
@@ -99,7 +93,6 @@ else
   echo "  -x download FAILED!!"
   exit 1
 fi
-wget https://raw.githubusercontent.com/palner/apiban/master/clients/go/systemd/apiban-iptables.timer
 systemctl enable apiban-iptables.service
 if [ "$?" -eq "0" ]
 then
@@ -108,7 +101,22 @@ else
   echo "  -x download FAILED!!"
   exit 1
 fi
-systemctl enable apiban-iptables.timer
-systemctl start apiban-iptables.timer
+echo "-> setting up restore service"
+wget https://raw.githubusercontent.com/palner/apiban/master/clients/go/systemd/apiban-iptables-restore.service
+if [ "$?" -eq "0" ]
+then
+  echo "  -o downloaded"
+else
+  echo "  -x download FAILED!!"
+  exit 1
+fi
+systemctl enable apiban-iptables-restore.service
+if [ "$?" -eq "0" ]
+then
+  echo "  -o enabled"
+else
+  echo "  -x enable FAILED!!"
+  exit 1
+fi
 systemctl start apiban-iptables.service
 echo "-> all done."